@@ -0,0 +1,155 @@
+package spellbook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/appengine/log"
+	"strings"
+	"time"
+)
+
+// the actions of the audited writes
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionPatch  = "patch"
+	AuditActionDelete = "delete"
+)
+
+// AuditEntry records a write done through a RestController
+type AuditEntry struct {
+	// the identity the write has been authorized as, empty for anonymous writes such as logins
+	Actor string
+	// the real actor, if the identity was impersonated
+	Impersonator string
+	// the go type of the resource, such as "identity.User"
+	ResourceType string
+	ResourceId   string
+	Action       string
+	Timestamp    time.Time
+	IP           string
+	// the top level fields of the JSON representation changed by the write
+	Diff map[string]AuditChange
+}
+
+// AuditChange is the value of a field before and after a write. Values missing on one side are omitted
+type AuditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditSink stores the audit entries, see the audit package
+type AuditSink interface {
+	Record(ctx context.Context, entry AuditEntry) error
+}
+
+// the sink of the writes of every RestController. Writes are not audited if nil
+var DefaultAuditSink AuditSink
+
+// AuditRepresenter is implemented by the resources whose id or representation holds secrets, such as tokens.
+// Their writes are audited with AuditId and AuditRepresentation instead of their id and JSON representation
+type AuditRepresenter interface {
+	AuditId() string
+	AuditRepresentation() ([]byte, error)
+}
+
+func auditId(resource Resource) string {
+	if r, ok := resource.(AuditRepresenter); ok {
+		return r.AuditId()
+	}
+	return resource.Id()
+}
+
+func auditRepresentation(resource Resource) ([]byte, error) {
+	if r, ok := resource.(AuditRepresenter); ok {
+		return r.AuditRepresentation()
+	}
+	return resource.ToRepresentation(RepresentationTypeJSON)
+}
+
+// returns the representation of the resource before a write, nil if writes are not audited
+func auditSnapshot(ctx context.Context, resource Resource) []byte {
+	if DefaultAuditSink == nil {
+		return nil
+	}
+	data, err := auditRepresentation(resource)
+	if err != nil {
+		log.Errorf(ctx, "error representing %T for the audit: %s", resource, err.Error())
+		return nil
+	}
+	return data
+}
+
+// records the write of the resource with DefaultAuditSink.
+// The write is already done: errors are logged
+func auditWrite(ctx context.Context, action string, resource Resource, before []byte) {
+	if DefaultAuditSink == nil {
+		return
+	}
+
+	var after []byte
+	if action != AuditActionDelete {
+		after = auditSnapshot(ctx, resource)
+	}
+
+	entry := AuditEntry{
+		ResourceType: strings.TrimPrefix(fmt.Sprintf("%T", resource), "*"),
+		ResourceId:   auditId(resource),
+		Action:       action,
+		Timestamp:    time.Now().UTC(),
+		Diff:         AuditDiff(before, after),
+	}
+	if current := IdentityFromContext(ctx); current != nil {
+		entry.Actor = current.Username()
+	}
+	if impersonator := ImpersonatorFromContext(ctx); impersonator != nil {
+		entry.Impersonator = impersonator.Username()
+	}
+	if ip := ClientIP(ctx); ip != nil {
+		entry.IP = ip.String()
+	}
+
+	if err := DefaultAuditSink.Record(ctx, entry); err != nil {
+		log.Errorf(ctx, "error auditing the %s of %s %s: %s", action, entry.ResourceType, entry.ResourceId, err.Error())
+	}
+}
+
+// Returns the top level fields that differ between two JSON representations.
+// Representations that are not objects are compared as a whole, under the empty field
+func AuditDiff(before []byte, after []byte) map[string]AuditChange {
+	b, okb := auditFields(before)
+	a, oka := auditFields(after)
+	if !okb || !oka {
+		if bytes.Equal(before, after) {
+			return map[string]AuditChange{}
+		}
+		return map[string]AuditChange{"": {Before: before, After: after}}
+	}
+
+	diff := make(map[string]AuditChange)
+	for field, value := range b {
+		if other, ok := a[field]; !ok || !bytes.Equal(value, other) {
+			diff[field] = AuditChange{Before: value, After: a[field]}
+		}
+	}
+	for field, value := range a {
+		if _, ok := b[field]; !ok {
+			diff[field] = AuditChange{After: value}
+		}
+	}
+	return diff
+}
+
+// returns the fields of a JSON object. An empty representation has no fields
+func auditFields(data []byte) (map[string]json.RawMessage, bool) {
+	fields := make(map[string]json.RawMessage)
+	if len(data) == 0 {
+		return fields, true
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false
+	}
+	return fields, true
+}
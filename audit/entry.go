@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"decodica.com/spellbook"
+	"encoding/json"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"time"
+)
+
+// Entry is a stored spellbook.AuditEntry.
+// The diff is stored as its JSON representation, a map of the changed fields to their values before and after the write
+type Entry struct {
+	model.Model  `json:"-"`
+	ID           uint `model:"-" json:"-"`
+	Actor        string
+	Impersonator string
+	ResourceType string
+	ResourceId   string
+	Action       string
+	Timestamp    time.Time
+	IP           string
+	Diff         string `model:"noindex" gorm:"type:text"`
+}
+
+// the sql table of the entries
+func (entry Entry) TableName() string {
+	return "audit_entries"
+}
+
+func newEntry(e spellbook.AuditEntry) (*Entry, error) {
+	diff, err := json.Marshal(e.Diff)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the diff of %s %s: %s", e.ResourceType, e.ResourceId, err.Error())
+	}
+
+	return &Entry{
+		Actor:        e.Actor,
+		Impersonator: e.Impersonator,
+		ResourceType: e.ResourceType,
+		ResourceId:   e.ResourceId,
+		Action:       e.Action,
+		Timestamp:    e.Timestamp,
+		IP:           e.IP,
+		Diff:         string(diff),
+	}, nil
+}
+
+func (entry *Entry) MarshalJSON() ([]byte, error) {
+	diff := json.RawMessage(entry.Diff)
+	if entry.Diff == "" {
+		diff = json.RawMessage("{}")
+	}
+
+	return json.Marshal(&struct {
+		Id           string          `json:"id"`
+		Actor        string          `json:"actor"`
+		Impersonator string          `json:"impersonator,omitempty"`
+		ResourceType string          `json:"resourceType"`
+		ResourceId   string          `json:"resourceId"`
+		Action       string          `json:"action"`
+		Timestamp    time.Time       `json:"timestamp"`
+		IP           string          `json:"ip"`
+		Diff         json.RawMessage `json:"diff"`
+	}{
+		Id:           entry.Id(),
+		Actor:        entry.Actor,
+		Impersonator: entry.Impersonator,
+		ResourceType: entry.ResourceType,
+		ResourceId:   entry.ResourceId,
+		Action:       entry.Action,
+		Timestamp:    entry.Timestamp,
+		IP:           entry.IP,
+		Diff:         diff,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (entry *Entry) Id() string {
+	if key := entry.EncodedKey(); key != "" {
+		return key
+	}
+	return fmt.Sprintf("%d", entry.ID)
+}
+
+// entries are only written by the sinks
+func (entry *Entry) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (entry *Entry) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(entry)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+func NewEntryController() *spellbook.RestController {
+	return NewEntryControllerWithKey("")
+}
+
+func NewEntryControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: EntryManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// EntryManager reads the audit entries stored by DatastoreSink, with PermissionReadAudit.
+// The entries can't be written through the manager
+type EntryManager struct{}
+
+func (manager EntryManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Entry{}, nil
+}
+
+func (manager EntryManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	entry := Entry{}
+	if err := model.FromEncodedKey(ctx, &entry, id); err != nil {
+		log.Errorf(ctx, "could not retrieve audit entry %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (manager EntryManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager EntryManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	var entries []*Entry
+	q := model.NewQuery(&Entry{})
+
+	if opts.Order != "" {
+		dir := model.ASC
+		if opts.Descending {
+			dir = model.DESC
+		}
+		q = q.OrderBy(opts.Order, dir)
+	}
+
+	q, err := filtersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q, err = spellbook.PaginateQuery(q, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &entries)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]spellbook.Resource, len(entries))
+	for i := range entries {
+		resources[i] = entries[i]
+	}
+
+	next, err := spellbook.NextQueryCursor(ctx, q, &entries, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager EntryManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	q := model.NewQuery(&Entry{})
+	q, err := filtersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
+}
+
+func (manager EntryManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager EntryManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager EntryManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager EntryManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// the datastore compares the timestamps as times: the filters on the Timestamp are
+// parsed as RFC 3339 times, the others, and the OR groups, are left to spellbook.FiltersToQuery
+func filtersToQuery(q *model.Query, fs []spellbook.Filter) (*model.Query, error) {
+	var others []spellbook.Filter
+	for _, f := range fs {
+		if f.Field != "Timestamp" || f.Group != "" {
+			others = append(others, f)
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, f.Value)
+		if err != nil {
+			return nil, spellbook.NewFieldError(f.Field, fmt.Errorf("invalid time %q: %s", f.Value, err.Error()))
+		}
+
+		switch f.Operator {
+		case spellbook.FilterOperatorLessThan:
+			q = q.WithField("Timestamp <", t)
+		case spellbook.FilterOperatorGreaterThan:
+			q = q.WithField("Timestamp >", t)
+		case spellbook.FilterOperatorLessOrEqualThan:
+			q = q.WithField("Timestamp <=", t)
+		case spellbook.FilterOperatorGreaterOrEqualThan:
+			q = q.WithField("Timestamp >=", t)
+		case spellbook.FilterOperatorExact, "":
+			q = q.WithField("Timestamp =", t)
+		default:
+			return nil, spellbook.NewUnsupportedErrorWithReason(fmt.Sprintf("filter %s: operator %q is not supported on times", f.Field, f.Operator))
+		}
+	}
+	return spellbook.FiltersToQuery(q, others)
+}
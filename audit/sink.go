@@ -0,0 +1,23 @@
+package audit
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+)
+
+// DatastoreSink stores the audit entries in the datastore.
+// Set spellbook.DefaultAuditSink to DatastoreSink{} to audit the writes
+type DatastoreSink struct{}
+
+func (sink DatastoreSink) Record(ctx context.Context, e spellbook.AuditEntry) error {
+	entry, err := newEntry(e)
+	if err != nil {
+		return err
+	}
+	if err := model.Create(ctx, entry); err != nil {
+		return fmt.Errorf("error storing the audit entry of %s %s: %s", e.ResourceType, e.ResourceId, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"google.golang.org/appengine/log"
+	"strconv"
+)
+
+func NewSqlEntryController() *spellbook.RestController {
+	return NewSqlEntryControllerWithKey("")
+}
+
+func NewSqlEntryControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlEntryManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// SqlEntryManager reads the audit entries stored by SqlSink, with PermissionReadAudit.
+// The entries can't be written through the manager
+type SqlEntryManager struct{}
+
+// fields that can be used to filter and order the entries
+var entryColumns = sql.Columns{
+	"id":            "id",
+	"actor":         "actor",
+	"impersonator":  "impersonator",
+	"resource_type": "resource_type",
+	"resource_id":   "resource_id",
+	"action":        "action",
+	"timestamp":     "timestamp",
+	"ip":            "ip",
+}
+
+func (manager SqlEntryManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Entry{}, nil
+}
+
+func (manager SqlEntryManager) FromId(ctx context.Context, strId string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	id, err := strconv.ParseInt(strId, 10, 64)
+	if err != nil {
+		return nil, spellbook.NewFieldError(strId, err)
+	}
+
+	entry := Entry{}
+	db := sql.FromContext(ctx)
+	if res := db.First(&entry, id); res.Error != nil {
+		log.Errorf(ctx, "could not retrieve audit entry %d: %s", id, res.Error.Error())
+		return nil, res.Error
+	}
+
+	return &entry, nil
+}
+
+func (manager SqlEntryManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlEntryManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	var entries []*Entry
+	db := sql.FromContext(ctx)
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, entryColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &Entry{}, opts, entryColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&entries); res.Error != nil {
+		log.Errorf(ctx, "error retrieving audit entries: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(entries) > opts.Size {
+		entries = entries[:opts.Size]
+		next, err = sql.NewCursor(db, entries[len(entries)-1], opts, entryColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(entries))
+	for i := range entries {
+		resources[i] = entries[i]
+	}
+
+	return resources, next, nil
+}
+
+func (manager SqlEntryManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadAudit) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadAudit))
+	}
+
+	db := sql.FromContext(ctx).Model(&Entry{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, entryColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting audit entries: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlEntryManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlEntryManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SqlEntryManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SqlEntryManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,23 @@
+package audit
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+)
+
+// SqlSink stores the audit entries in the audit_entries table
+type SqlSink struct{}
+
+func (sink SqlSink) Record(ctx context.Context, e spellbook.AuditEntry) error {
+	entry, err := newEntry(e)
+	if err != nil {
+		return err
+	}
+	db := sql.FromContext(ctx)
+	if err := db.Create(entry).Error; err != nil {
+		return fmt.Errorf("error storing the audit entry of %s %s: %s", e.ResourceType, e.ResourceId, err.Error())
+	}
+	return nil
+}
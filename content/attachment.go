@@ -153,6 +153,10 @@ func (attachment *Attachment) Id() string {
 	return fmt.Sprintf("%d", attachment.ID)
 }
 
+func (attachment *Attachment) Version() string {
+	return spellbook.TimeVersion(attachment.Updated)
+}
+
 func (attachment *Attachment) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
 	switch rtype {
 	case spellbook.RepresentationTypeJSON:
@@ -52,18 +52,22 @@ func (manager AttachmentManager) FromId(ctx context.Context, strId string) (spel
 }
 
 func (manager AttachmentManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager AttachmentManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 	if current := spellbook.IdentityFromContext(ctx); current == nil || (!current.HasPermission(spellbook.PermissionReadContent) && !current.HasPermission(spellbook.PermissionReadMedia)) {
 		var p spellbook.Permission
 		p = spellbook.PermissionReadContent
 		if !current.HasPermission(spellbook.PermissionReadMedia) {
 			p = spellbook.PermissionReadMedia
 		}
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(p))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(p))
 	}
 
 	var attachments []*Attachment
 	q := model.NewQuery(&Attachment{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -73,17 +77,19 @@ func (manager AttachmentManager) ListOf(ctx context.Context, opts spellbook.List
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &attachments)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &attachments)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(attachments))
@@ -91,7 +97,30 @@ func (manager AttachmentManager) ListOf(ctx context.Context, opts spellbook.List
 		resources[i] = attachments[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &attachments, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager AttachmentManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || (!current.HasPermission(spellbook.PermissionReadContent) && !current.HasPermission(spellbook.PermissionReadMedia)) {
+		var p spellbook.Permission
+		p = spellbook.PermissionReadContent
+		if !current.HasPermission(spellbook.PermissionReadMedia) {
+			p = spellbook.PermissionReadMedia
+		}
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(p))
+	}
+
+	q := model.NewQuery(&Attachment{})
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
 func (manager AttachmentManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -126,15 +155,14 @@ func (manager AttachmentManager) ListOfProperties(ctx context.Context, opts spel
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, err
 	}
 
 	q = q.Distinct(name)
 	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
+	err = q.GetAll(ctx, &conts)
 	if err != nil {
 		log.Errorf(ctx, "Error retrieving result: %+v", err)
 		return nil, err
@@ -241,7 +269,13 @@ func (manager AttachmentManager) Update(ctx context.Context, res spellbook.Resou
 	attachment.Updated = time.Now().UTC()
 	attachment.AltText = other.AltText
 
-	return model.Update(ctx, attachment)
+	return spellbook.VersionedWrite(ctx, attachment.EncodedKey(), func(ctx context.Context) (spellbook.Versioned, error) {
+		stored := Attachment{}
+		err := model.FromEncodedKey(ctx, &stored, attachment.EncodedKey())
+		return &stored, err
+	}, func(ctx context.Context) error {
+		return model.Update(ctx, attachment)
+	})
 }
 
 func (manager AttachmentManager) Delete(ctx context.Context, res spellbook.Resource) error {
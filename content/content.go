@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/decodica/model/v2"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -101,11 +102,11 @@ const AttachmentParentTypeContent = "content"
 type Content struct {
 	model.Model `json:"-"`
 	ID          uint           `model:"-" json:"-"`
-	Type        string         `model:"search"`
+	Type        string         `model:"search" validate:"required"`
 	IdTranslate string         `gorm:"UNIQUE_INDEX:content_idtranslate_locale"`
 	Slug        string         `gorm:"-"`
 	SqlSlug     sql.NullString `model:"-" gorm:"column:slug;UNIQUE_INDEX:content_slug"`
-	Title       string         `model:"search"`
+	Title       string         `model:"search" validate:"required"`
 	Subtitle    string         `model:"search"`
 	Body        string         `model:"search,noindex,HTML"`
 	Tags        string         `model:"search"`
@@ -336,6 +337,11 @@ func (content *Content) Id() string {
 	return fmt.Sprintf("%d", content.ID)
 }
 
+// the revision is incremented by each update
+func (content *Content) Version() string {
+	return strconv.Itoa(content.Revision)
+}
+
 func (content *Content) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
 	switch rtype {
 	case spellbook.RepresentationTypeJSON:
@@ -4,7 +4,6 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"decodica.com/spellbook"
-	"decodica.com/spellbook/identity"
 	"errors"
 	"fmt"
 	"github.com/decodica/model/v2"
@@ -33,7 +32,8 @@ func (manager ContentManager) NewResource(ctx context.Context) (spellbook.Resour
 
 func (manager ContentManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
 	}
 
@@ -44,6 +44,14 @@ func (manager ContentManager) FromId(ctx context.Context, id string) (spellbook.
 		return nil, err
 	}
 
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkContentRules(rules, ContentAccessRead, &cont, current); err != nil {
+		return nil, err
+	}
+
 	// attachment
 	q := model.NewQuery((*Attachment)(nil))
 	q = q.WithField("ParentKey =", cont.Id())
@@ -57,14 +65,34 @@ func (manager ContentManager) FromId(ctx context.Context, id string) (spellbook.
 }
 
 func (manager ContentManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
+// The contents are restricted to the ones matched by the content rules of the identity.
+// Datastore queries can't express alternatives: with more than one rule each page is filtered,
+// and can be shorter than the requested size
+func (manager ContentManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
+	}
+
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return nil, "", err
+	}
+	granting := rulesFor(rules, ContentAccessRead)
+	if len(rules) > 0 && len(granting) == 0 {
+		return []spellbook.Resource{}, "", nil
 	}
 
 	var conts []*Content
 	q := model.NewQuery(&Content{})
-	q = q.OffsetBy(opts.Page * opts.Size)
+	if len(granting) == 1 {
+		q = ruleToQuery(q, granting[0], contentAuthor(current))
+	}
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -73,17 +101,31 @@ func (manager ContentManager) ListOf(ctx context.Context, opts spellbook.ListOpt
 		}
 		q = q.OrderBy(opts.Order, dir)
 	}
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err = spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &conts)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &conts)
+	if err != nil {
+		return nil, "", err
+	}
+	// the cursor depends on the number of results of the query
+	count := len(conts)
+
+	if len(granting) > 1 {
+		allowed := conts[:0]
+		for _, c := range conts {
+			if checkContentRules(granting, ContentAccessRead, c, current) == nil {
+				allowed = append(allowed, c)
+			}
+		}
+		conts = allowed
 	}
 
 	resources := make([]spellbook.Resource, len(conts))
@@ -91,12 +133,51 @@ func (manager ContentManager) ListOf(ctx context.Context, opts spellbook.ListOpt
 		resources[i] = conts[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &conts, cursor, count, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager ContentManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
+	}
+
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return 0, err
+	}
+	granting := rulesFor(rules, ContentAccessRead)
+	if len(rules) > 0 && len(granting) == 0 {
+		return 0, nil
+	}
+	// the datastore can't count the union of the rules without reading every content
+	if len(granting) > 1 {
+		return 0, spellbook.NewUnsupportedErrorWithReason("the contents granted by more than one rule can't be counted")
+	}
+
+	q := model.NewQuery(&Content{})
+	if len(granting) == 1 {
+		q = ruleToQuery(q, granting[0], contentAuthor(current))
+	}
+	q, err = spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
+// With content rules the values are the ones of the contents matched by the rules.
+// Each rule is queried on its own, and its values are merged
 func (manager ContentManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
 	}
 
@@ -112,36 +193,52 @@ func (manager ContentManager) ListOfProperties(ctx context.Context, opts spellbo
 		return nil, datastore.ErrNoSuchEntity
 	}
 
-	var conts []*Content
-	q := model.NewQuery(&Content{})
-	q = q.OffsetBy(opts.Page * opts.Size)
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	granting := rulesFor(rules, ContentAccessRead)
+	if len(rules) == 0 {
+		// a nil rule doesn't restrict the query
+		granting = []*ContentRule{nil}
+	}
 
-	if opts.Order != "" {
-		dir := model.ASC
-		if opts.Descending {
-			dir = model.DESC
+	var result []string
+	seen := make(map[string]bool)
+	for _, rule := range granting {
+		var conts []*Content
+		q := model.NewQuery(&Content{})
+		if rule != nil {
+			q = ruleToQuery(q, rule, contentAuthor(current))
+		}
+		q = q.OffsetBy(opts.Page * opts.Size)
+
+		if opts.Order != "" {
+			dir := model.ASC
+			if opts.Descending {
+				dir = model.DESC
+			}
+			q = q.OrderBy(opts.Order, dir)
 		}
-		q = q.OrderBy(opts.Order, dir)
-	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
+		q, err := spellbook.FiltersToQuery(q, opts.Filters)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	q = q.Distinct(name)
-	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
-	if err != nil {
-		log.Errorf(ctx, "Error retrieving result: %+v", err)
-		return nil, err
-	}
-	var result []string
-	for _, c := range conts {
-		value := reflect.ValueOf(c).Elem().FieldByName(name).String()
-		if len(value) > 0 {
-			result = append(result, value)
+		q = q.Distinct(name)
+		q = q.Limit(opts.Size + 1)
+		err = q.GetAll(ctx, &conts)
+		if err != nil {
+			log.Errorf(ctx, "Error retrieving result: %+v", err)
+			return nil, err
+		}
+		for _, c := range conts {
+			value := reflect.ValueOf(c).Elem().FieldByName(name).String()
+			if len(value) > 0 && !seen[value] {
+				seen[value] = true
+				result = append(result, value)
+			}
 		}
 	}
 	return result, nil
@@ -182,12 +279,8 @@ func (manager ContentManager) Create(ctx context.Context, res spellbook.Resource
 		content.PublicationState = PublicationStateUnpublished
 	}
 
-	if content.Type == "" {
-		return spellbook.NewFieldError("type", errors.New("type can't be empty"))
-	}
-
-	if content.Title == "" {
-		return spellbook.NewFieldError("title", errors.New("title can't be empty"))
+	if err := spellbook.ValidateStruct(content); err != nil {
+		return err
 	}
 
 	if content.Slug == "" && content.Code == "" {
@@ -223,8 +316,16 @@ func (manager ContentManager) Create(ctx context.Context, res spellbook.Resource
 		return spellbook.NewFieldError("endDate", errors.New(msg))
 	}
 
-	if user, ok := current.(identity.User); ok {
-		content.Author = user.Username()
+	if author := contentAuthor(current); author != "" {
+		content.Author = author
+	}
+
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
 	}
 
 	// // WARNING: the volatile field Multimedia because Memcache (Gob)
@@ -254,17 +355,22 @@ func (manager ContentManager) Update(ctx context.Context, res spellbook.Resource
 
 	content := res.(*Content)
 
+	// the content must be writable both before and after the update
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
+
 	other := &Content{}
 	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
 		return spellbook.NewFieldError("", fmt.Errorf("invalid json for content %s: %s", content.StringID(), err.Error()))
 	}
 
-	if other.Type == "" {
-		return spellbook.NewFieldError("type", errors.New("type can't be empty"))
-	}
-
-	if other.Title == "" {
-		return spellbook.NewFieldError("title", errors.New("title can't be empty"))
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
 	}
 
 	// if the same slug already exists, we must return
@@ -286,7 +392,7 @@ func (manager ContentManager) Update(ctx context.Context, res spellbook.Resource
 	}
 
 	compare := Content{}
-	err := q.First(ctx, &compare)
+	err = q.First(ctx, &compare)
 	if err == nil && compare.EncodedKey() != content.EncodedKey() {
 		return spellbook.NewFieldError("slug", fmt.Errorf("a content with the same %s already exists", reason))
 	}
@@ -295,6 +401,9 @@ func (manager ContentManager) Update(ctx context.Context, res spellbook.Resource
 		return spellbook.NewFieldError("slug", fmt.Errorf("error verifying content correctness: %s", err.Error()))
 	}
 
+	// only the version of the If-Match header is enforced: the revision of the body is ignored,
+	// as clients send back the revision they read, or the one they expect the update to produce
+
 	content.Type = other.Type
 	content.Title = other.Title
 	content.Subtitle = other.Subtitle
@@ -305,7 +414,7 @@ func (manager ContentManager) Update(ctx context.Context, res spellbook.Resource
 	content.setCode(other.Code)
 	content.Body = other.Body
 	content.Cover = other.Cover
-	content.Revision = other.Revision
+	content.Revision++
 	content.Editor = other.Editor
 	content.Order = other.Order
 	content.Updated = time.Now().UTC()
@@ -338,31 +447,55 @@ func (manager ContentManager) Update(ctx context.Context, res spellbook.Resource
 	content.StartDate = other.StartDate
 	content.EndDate = other.EndDate
 
-	if user, ok := current.(identity.User); ok {
-		content.Author = user.Username()
+	if author := contentAuthor(current); author != "" {
+		content.Author = author
 	}
 
-	tmp := content.Attachments
-	content.Attachments = nil
-
-	if err := model.Update(ctx, content); err != nil {
-		return fmt.Errorf("error updating post %s: %s", content.Slug, err)
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
 	}
 
+	tmp := content.Attachments
+	content.Attachments = nil
 	// return the swapped multimedia value
-	content.Attachments = tmp
-
-	return nil
+	defer func() { content.Attachments = tmp }()
+
+	return spellbook.VersionedWrite(ctx, content.EncodedKey(), func(ctx context.Context) (spellbook.Versioned, error) {
+		stored := Content{}
+		err := model.FromEncodedKey(ctx, &stored, content.EncodedKey())
+		return &stored, err
+	}, func(ctx context.Context) error {
+		if err := model.Update(ctx, content); err != nil {
+			return fmt.Errorf("error updating post %s: %s", content.Slug, err)
+		}
+		return nil
+	})
 }
 
 func (manager ContentManager) Delete(ctx context.Context, res spellbook.Resource) error {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionWriteContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionWriteContent) {
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteContent))
 	}
 
 	content := res.(*Content)
-	err := model.Delete(ctx, content, nil)
+
+	rules, err := contentRules(ctx, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
+
+	err = spellbook.VersionedWrite(ctx, content.EncodedKey(), func(ctx context.Context) (spellbook.Versioned, error) {
+		stored := Content{}
+		err := model.FromEncodedKey(ctx, &stored, content.EncodedKey())
+		return &stored, err
+	}, func(ctx context.Context) error {
+		return model.Delete(ctx, content, nil)
+	})
 	if err != nil {
 		log.Errorf(ctx, "error deleting content %s: %s", content.Slug, err.Error())
 		return err
@@ -0,0 +1,222 @@
+package content
+
+import (
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/identity"
+	"encoding/json"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"strings"
+)
+
+// ContentAccess is the access a content rule grants. Write access includes read access
+type ContentAccess string
+
+const (
+	ContentAccessRead  ContentAccess = "read"
+	ContentAccessWrite ContentAccess = "write"
+)
+
+// the kinds of identity a content rule applies to
+const (
+	RuleSubjectUser           = "user"
+	RuleSubjectGroup          = "group"
+	RuleSubjectServiceAccount = "serviceaccount"
+)
+
+// ContentRule scopes the access of a user, of the members of a group or of a service account to the contents.
+// A rule matches the contents with its category, type and locale, if set,
+// and, if Own is set, only the contents authored by the identity.
+// An identity without rules can access every content its permissions allow;
+// an identity with rules can only access the contents matched by one of its rules
+type ContentRule struct {
+	model.Model `json:"-"`
+	SqlName     string        `model:"-" json:"-" gorm:"PRIMARY_KEY;column:name"`
+	Description string        `json:"description"`
+	SubjectType string        `json:"subjectType" gorm:"NOT NULL;INDEX:idx_content_rules_subject" validate:"required,enum=user|group|serviceaccount"`
+	Subject     string        `json:"subject" gorm:"NOT NULL;INDEX:idx_content_rules_subject" validate:"required"`
+	Access      ContentAccess `json:"access" gorm:"NOT NULL" validate:"required,enum=read|write"`
+	Category    string        `json:"category"`
+	Type        string        `json:"type"`
+	Locale      string        `json:"locale"`
+	Own         bool          `json:"own"`
+	// the name, while the rule is not yet stored
+	name string `model:"-" gorm:"-"`
+}
+
+// the name of the rule is its id
+func (rule *ContentRule) Id() string {
+	if rule.EncodedKey() != "" {
+		return rule.StringID()
+	}
+	if rule.SqlName != "" {
+		return rule.SqlName
+	}
+	return rule.name
+}
+
+// reports whether the rule grants the access
+func (rule *ContentRule) allows(access ContentAccess) bool {
+	return rule.Access == ContentAccessWrite || rule.Access == access
+}
+
+// reports whether the rule matches the content. author is the author value of the identity the rule is applied to, see contentAuthor
+func (rule *ContentRule) matches(content *Content, author string) bool {
+	if rule.Category != "" && rule.Category != content.Category {
+		return false
+	}
+	if rule.Type != "" && rule.Type != content.Type {
+		return false
+	}
+	if rule.Locale != "" && rule.Locale != content.Locale {
+		return false
+	}
+	if rule.Own && content.Author != author {
+		return false
+	}
+	return true
+}
+
+func (rule *ContentRule) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		SubjectType string        `json:"subjectType"`
+		Subject     string        `json:"subject"`
+		Access      ContentAccess `json:"access"`
+		Category    string        `json:"category"`
+		Type        string        `json:"type"`
+		Locale      string        `json:"locale"`
+		Own         bool          `json:"own"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	rule.name = alias.Name
+	rule.Description = alias.Description
+	rule.SubjectType = alias.SubjectType
+	rule.Subject = alias.Subject
+	rule.Access = alias.Access
+	rule.Category = alias.Category
+	rule.Type = alias.Type
+	rule.Locale = alias.Locale
+	rule.Own = alias.Own
+	return nil
+}
+
+func (rule *ContentRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		SubjectType string        `json:"subjectType"`
+		Subject     string        `json:"subject"`
+		Access      ContentAccess `json:"access"`
+		Category    string        `json:"category"`
+		Type        string        `json:"type"`
+		Locale      string        `json:"locale"`
+		Own         bool          `json:"own"`
+	}{
+		Name:        rule.Id(),
+		Description: rule.Description,
+		SubjectType: rule.SubjectType,
+		Subject:     rule.Subject,
+		Access:      rule.Access,
+		Category:    rule.Category,
+		Type:        rule.Type,
+		Locale:      rule.Locale,
+		Own:         rule.Own,
+	})
+}
+
+func (rule *ContentRule) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, rule)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (rule *ContentRule) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(rule)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// copies everything but the name
+func (rule *ContentRule) update(other *ContentRule) {
+	rule.Description = other.Description
+	rule.SubjectType = other.SubjectType
+	rule.Subject = other.Subject
+	rule.Access = other.Access
+	rule.Category = other.Category
+	rule.Type = other.Type
+	rule.Locale = other.Locale
+	rule.Own = other.Own
+}
+
+// returns the subject of the rules of the identity and the groups it belongs to.
+// Identities that are neither users nor service accounts have no rules
+func ruleSubjects(current spellbook.Identity) (subjectType string, subject string, groups []string) {
+	switch id := current.(type) {
+	case identity.User:
+		return RuleSubjectUser, id.Username(), id.Groups
+	case identity.ServiceAccount:
+		return RuleSubjectServiceAccount, id.Label, nil
+	}
+	return "", "", nil
+}
+
+// returns the author recorded on the contents written by the identity, which the Own rules match.
+// Service accounts are prefixed by their subject type, so that they can't be mistaken for a user with the same name.
+// Identities that are neither users nor service accounts are not authors
+func contentAuthor(current spellbook.Identity) string {
+	switch id := current.(type) {
+	case identity.User:
+		return id.Username()
+	case identity.ServiceAccount:
+		return RuleSubjectServiceAccount + ":" + id.Label
+	}
+	return ""
+}
+
+// returns the rules that grant the access
+func rulesFor(rules []*ContentRule, access ContentAccess) []*ContentRule {
+	var granting []*ContentRule
+	for _, rule := range rules {
+		if rule.allows(access) {
+			granting = append(granting, rule)
+		}
+	}
+	return granting
+}
+
+// returns a PermissionError naming the rules of the identity if none of them grants the access to the content
+func checkContentRules(rules []*ContentRule, access ContentAccess, content *Content, current spellbook.Identity) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	permission := spellbook.PermissionReadContent
+	if access == ContentAccessWrite {
+		permission = spellbook.PermissionWriteContent
+	}
+
+	granting := rulesFor(rules, access)
+	if len(granting) == 0 {
+		return spellbook.NewPermissionError(fmt.Sprintf("%s (no content rule grants %s access)", spellbook.PermissionName(permission), access))
+	}
+
+	names := make([]string, len(granting))
+	for i, rule := range granting {
+		if rule.matches(content, contentAuthor(current)) {
+			return nil
+		}
+		names[i] = rule.Id()
+	}
+
+	return spellbook.NewPermissionError(fmt.Sprintf("%s (content rule %s)", spellbook.PermissionName(permission), strings.Join(names, ", ")))
+}
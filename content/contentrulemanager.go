@@ -0,0 +1,201 @@
+package content
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+)
+
+func NewContentRuleController() *spellbook.RestController {
+	return NewContentRuleControllerWithKey("")
+}
+
+func NewContentRuleControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: ContentRuleManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// ContentRuleManager manages the content rules.
+// Rules are read with PermissionReadUser and written with PermissionEditPermissions
+type ContentRuleManager struct{}
+
+func (manager ContentRuleManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &ContentRule{}, nil
+}
+
+func (manager ContentRuleManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	rule := ContentRule{}
+	if err := model.FromStringID(ctx, &rule, id, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve content rule %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+func (manager ContentRuleManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager ContentRuleManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var rules []*ContentRule
+	q := model.NewQuery(&ContentRule{})
+
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q, err = spellbook.PaginateQuery(q, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &rules)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]spellbook.Resource, len(rules))
+	for i := range rules {
+		resources[i] = rules[i]
+	}
+
+	next, err := spellbook.NextQueryCursor(ctx, q, &rules, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager ContentRuleManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager ContentRuleManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	rule := res.(*ContentRule)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{rule.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+	if err := spellbook.ValidateStruct(rule); err != nil {
+		return err
+	}
+
+	err := model.FromStringID(ctx, &ContentRule{}, rule.name, nil)
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("content rule %s already exists", rule.name))
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(rule.name)
+	if err := model.CreateWithOptions(ctx, rule, &opts); err != nil {
+		return fmt.Errorf("error creating content rule %s: %s", rule.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates everything but the name of the rule
+func (manager ContentRuleManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*ContentRule)
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
+	}
+
+	rule := res.(*ContentRule)
+	rule.update(other)
+
+	return model.Update(ctx, rule)
+}
+
+func (manager ContentRuleManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	rule := res.(*ContentRule)
+	if err := model.Delete(ctx, rule, nil); err != nil {
+		return fmt.Errorf("error deleting content rule %s: %s", rule.Id(), err.Error())
+	}
+
+	return nil
+}
+
+// returns the content rules of the identity, including the ones of its groups
+func contentRules(ctx context.Context, current spellbook.Identity) ([]*ContentRule, error) {
+	subjectType, subject, groups := ruleSubjects(current)
+	if subjectType == "" {
+		return nil, nil
+	}
+
+	var rules []*ContentRule
+	q := model.NewQuery(&ContentRule{})
+	q = q.WithField("SubjectType =", subjectType)
+	q = q.WithField("Subject =", subject)
+	if err := q.GetAll(ctx, &rules); err != nil {
+		return nil, fmt.Errorf("error retrieving the content rules of %s: %s", subject, err.Error())
+	}
+
+	for _, group := range groups {
+		var rs []*ContentRule
+		q := model.NewQuery(&ContentRule{})
+		q = q.WithField("SubjectType =", RuleSubjectGroup)
+		q = q.WithField("Subject =", group)
+		if err := q.GetAll(ctx, &rs); err != nil {
+			return nil, fmt.Errorf("error retrieving the content rules of group %s: %s", group, err.Error())
+		}
+		rules = append(rules, rs...)
+	}
+
+	return rules, nil
+}
+
+// restricts the query to the contents matched by the rule
+func ruleToQuery(q *model.Query, rule *ContentRule, author string) *model.Query {
+	if rule.Category != "" {
+		q = q.WithField("Category =", rule.Category)
+	}
+	if rule.Type != "" {
+		q = q.WithField("Type =", rule.Type)
+	}
+	if rule.Locale != "" {
+		q = q.WithField("Locale =", rule.Locale)
+	}
+	if rule.Own {
+		q = q.WithField("Author =", author)
+	}
+	return q
+}
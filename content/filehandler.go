@@ -34,7 +34,7 @@ func (handler fileHandler) HandlePost(ctx context.Context, out *flamel.ResponseO
 func (handler fileHandler) ErrorToStatus(ctx context.Context, err error, out *flamel.ResponseOutput) flamel.HttpResponse {
 	if err == storage.ErrObjectNotExist {
 		log.Errorf(ctx, "%s", err.Error())
-		return flamel.HttpResponse{Status: http.StatusNotFound}
+		return spellbook.NewProblem(http.StatusNotFound, spellbook.ProblemCodeNotFound, "the file doesn't exist").Render(out)
 	}
 	return handler.BaseRestHandler.ErrorToStatus(ctx, err, out)
 }
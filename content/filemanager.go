@@ -79,6 +79,12 @@ func (manager FileManager) FromId(ctx context.Context, id string) (spellbook.Res
 }
 
 func (manager FileManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+// lists the files of the bucket. The cursor is the page token of the storage listing
+func (manager FileManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 
 	if current := spellbook.IdentityFromContext(ctx); current == nil || (!current.HasPermission(spellbook.PermissionReadContent) && !current.HasPermission(spellbook.PermissionReadMedia)) {
 		var p spellbook.Permission
@@ -86,17 +92,17 @@ func (manager FileManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		if !current.HasPermission(spellbook.PermissionReadMedia) {
 			p = spellbook.PermissionReadMedia
 		}
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(p))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(p))
 	}
 
 	bucket, err := manager.BucketName(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	client, err := manager.NewClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %s", err.Error())
+		return nil, "", fmt.Errorf("failed to create client: %s", err.Error())
 	}
 	defer client.Close()
 
@@ -108,10 +114,10 @@ func (manager FileManager) ListOf(ctx context.Context, opts spellbook.ListOption
 	q.Versions = false
 
 	it := handle.Objects(ctx, q)
-	objs, err := manager.listPagination(ctx, it, opts)
+	objs, next, err := manager.listPagination(ctx, it, opts)
 	if err != nil {
 		log.Errorf(ctx, "listBucket: unable to list bucket %q: %v", bucket, err)
-		return nil, err
+		return nil, "", err
 	}
 	for _, obj := range objs {
 		name := obj.Name
@@ -134,18 +140,32 @@ func (manager FileManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		resources[i] = files[i]
 	}
 
-	return resources, nil
+	return resources, next, nil
 }
 
-func (manager FileManager) listPagination(ctx context.Context, it *storage.ObjectIterator, opts spellbook.ListOptions) ([]*storage.ObjectAttrs, error) {
-	p := iterator.NewPager(it, opts.Size+1, "")
+// returns the objects of the requested page and the token of the following page.
+// The page is read directly from the token, if the list options carry one
+func (manager FileManager) listPagination(ctx context.Context, it *storage.ObjectIterator, opts spellbook.ListOptions) ([]*storage.ObjectAttrs, string, error) {
+	if opts.Cursor != "" {
+		p := iterator.NewPager(it, opts.Size, opts.Cursor)
+		objs := make([]*storage.ObjectAttrs, 0, 0)
+		nextPageToken, err := p.NextPage(&objs)
+		if err != nil {
+			return nil, "", spellbook.NewFieldError(spellbook.FilterCursorKey, fmt.Errorf("invalid cursor %q: %s", opts.Cursor, err.Error()))
+		}
+		return objs, nextPageToken, nil
+	}
+
+	p := iterator.NewPager(it, opts.Size, "")
 	var objs []*storage.ObjectAttrs
+	nextPageToken := ""
 	for i := 0; i < opts.Page+1; i++ {
 		objs = make([]*storage.ObjectAttrs, 0, 0)
-		nextPageToken, err := p.NextPage(&objs)
+		token, err := p.NextPage(&objs)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
+		nextPageToken = token
 		if nextPageToken == "" {
 			// end pagination
 			if i != opts.Page {
@@ -155,7 +175,7 @@ func (manager FileManager) listPagination(ctx context.Context, it *storage.Objec
 			break
 		}
 	}
-	return objs, nil
+	return objs, nextPageToken, nil
 }
 
 func (manager FileManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -124,6 +124,10 @@ func (place *Place) Id() string {
 	return place.StringID()
 }
 
+func (place *Place) Version() string {
+	return spellbook.TimeVersion(place.Updated)
+}
+
 func (place *Place) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
 	switch rtype {
 	case spellbook.RepresentationTypeJSON:
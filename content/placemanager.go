@@ -52,13 +52,17 @@ func (manager PlaceManager) FromId(ctx context.Context, strId string) (spellbook
 }
 
 func (manager PlaceManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager PlaceManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadPlace) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadPlace))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadPlace))
 	}
 
 	var places []*Place
 	q := model.NewQuery(&Place{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -68,17 +72,19 @@ func (manager PlaceManager) ListOf(ctx context.Context, opts spellbook.ListOptio
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &places)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &places)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(places))
@@ -86,7 +92,25 @@ func (manager PlaceManager) ListOf(ctx context.Context, opts spellbook.ListOptio
 		resources[i] = places[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &places, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager PlaceManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadPlace) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadPlace))
+	}
+
+	q := model.NewQuery(&Place{})
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
 func (manager PlaceManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -116,15 +140,14 @@ func (manager PlaceManager) ListOfProperties(ctx context.Context, opts spellbook
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, err
 	}
 
 	q = q.Distinct(name)
 	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
+	err = q.GetAll(ctx, &conts)
 	if err != nil {
 		log.Errorf(ctx, "Error retrieving result: %+v", err)
 		return nil, err
@@ -192,11 +215,16 @@ func (manager PlaceManager) Update(ctx context.Context, res spellbook.Resource,
 		return spellbook.NewFieldError("address", errors.New("address and position can't be empty"))
 	}
 
-	if err := model.Update(ctx, place); err != nil {
-		return fmt.Errorf("error updating place %s: %s", place.Address, err)
-	}
-
-	return nil
+	return spellbook.VersionedWrite(ctx, place.EncodedKey(), func(ctx context.Context) (spellbook.Versioned, error) {
+		stored := Place{}
+		err := model.FromIntID(ctx, &stored, place.IntID(), nil)
+		return &stored, err
+	}, func(ctx context.Context) error {
+		if err := model.Update(ctx, place); err != nil {
+			return fmt.Errorf("error updating place %s: %s", place.Address, err)
+		}
+		return nil
+	})
 }
 
 func (manager PlaceManager) Delete(ctx context.Context, res spellbook.Resource) error {
@@ -7,9 +7,9 @@ import (
 	"decodica.com/spellbook/sql"
 	"errors"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"google.golang.org/appengine/log"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -26,6 +26,23 @@ func NewSqlAttachmentControllerWithKey(key string) *spellbook.RestController {
 
 type SqlAttachmentManager struct{}
 
+// fields that can be used to filter and order attachments
+var attachmentColumns = sql.Columns{
+	"id":            "id",
+	"name":          "name",
+	"alt_text":      "alt_text",
+	"description":   "description",
+	"group":         "group",
+	"type":          "type",
+	"parent_key":    "parent_key",
+	"parent_type":   "parent_type",
+	"parent_id":     "parent_id",
+	"display_order": "display_order",
+	"created":       "created",
+	"updated":       "updated",
+	"uploader":      "uploader",
+}
+
 func (manager SqlAttachmentManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
 	return &Attachment{}, nil
 }
@@ -58,40 +75,84 @@ func (manager SqlAttachmentManager) FromId(ctx context.Context, strId string) (s
 }
 
 func (manager SqlAttachmentManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlAttachmentManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 	if current := spellbook.IdentityFromContext(ctx); current == nil || (!current.HasPermission(spellbook.PermissionReadContent) && !current.HasPermission(spellbook.PermissionReadMedia)) {
 		var p spellbook.Permission
 		p = spellbook.PermissionReadContent
 		if !current.HasPermission(spellbook.PermissionReadMedia) {
 			p = spellbook.PermissionReadMedia
 		}
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(p))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(p))
 	}
 
 	var attachments []*Attachment
 	db := sql.FromContext(ctx)
-	db = db.Offset(opts.Page * opts.Size)
 
-	db = db.Where(sql.FiltersToCondition(opts.Filters, nil))
+	where, args, err := sql.FiltersToCondition(opts.Filters, attachmentColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
 
-	if opts.Order != "" {
-		dir := " asc"
-		if opts.Descending {
-			dir = " desc"
-		}
-		db = db.Order(fmt.Sprintf("%q %s", strings.ToLower(opts.Order), dir))
+	db, err = sql.Paginate(db, &Attachment{}, opts, attachmentColumns)
+	if err != nil {
+		return nil, "", err
 	}
 
-	db = db.Limit(opts.Size + 1)
 	if res := db.Find(&attachments); res.Error != nil {
 		log.Errorf(ctx, "error retrieving content: %s", res.Error.Error())
-		return nil, res.Error
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(attachments) > opts.Size {
+		attachments = attachments[:opts.Size]
+		next, err = sql.NewCursor(db, attachments[len(attachments)-1], opts, attachmentColumns)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	resources := make([]spellbook.Resource, len(attachments))
 	for i := range attachments {
 		resources[i] = attachments[i]
 	}
-	return resources, nil
+	return resources, next, nil
+}
+
+func (manager SqlAttachmentManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || (!current.HasPermission(spellbook.PermissionReadContent) && !current.HasPermission(spellbook.PermissionReadMedia)) {
+		var p spellbook.Permission
+		p = spellbook.PermissionReadContent
+		if !current.HasPermission(spellbook.PermissionReadMedia) {
+			p = spellbook.PermissionReadMedia
+		}
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(p))
+	}
+
+	db := sql.FromContext(ctx).Model(&Attachment{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, attachmentColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting attachments: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
 }
 
 func (manager SqlAttachmentManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -223,9 +284,12 @@ func (manager SqlAttachmentManager) Update(ctx context.Context, res spellbook.Re
 	attachment.AltText = other.AltText
 
 	db := sql.FromContext(ctx)
-	if res := db.Save(&attachment); res.Error != nil {
-		log.Errorf(ctx, "error updating attachment %s: %s", attachment.Name, res.Error.Error())
-		return res.Error
+	err := sql.VersionedWrite(ctx, db, &Attachment{}, attachment.ID, func(tx *gorm.DB) error {
+		return tx.Save(&attachment).Error
+	})
+	if err != nil {
+		log.Errorf(ctx, "error updating attachment %s: %s", attachment.Name, err.Error())
+		return err
 	}
 	return nil
 }
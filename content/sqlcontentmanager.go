@@ -3,14 +3,12 @@ package content
 import (
 	"context"
 	"decodica.com/spellbook"
-	"decodica.com/spellbook/identity"
 	"decodica.com/spellbook/sql"
 	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	"google.golang.org/appengine/log"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -29,13 +27,42 @@ type SqlContentManager struct {
 	ContentManager
 }
 
+// fields that can be used to filter and order contents
+var contentColumns = sql.Columns{
+	"id":                "id",
+	"type":              "type",
+	"id_translate":      "id_translate",
+	"slug":              "slug",
+	"title":             "title",
+	"subtitle":          "subtitle",
+	"tags":              "tags",
+	"category":          "category",
+	"topic":             "topic",
+	"locale":            "locale",
+	"description":       "description",
+	"revision":          "revision",
+	"order":             "order",
+	"author":            "author",
+	"editor":            "editor",
+	"created":           "created",
+	"updated":           "updated",
+	"published":         "published",
+	"publication_state": "publication_state",
+	"parent":            "parent",
+	"parent_key":        "parent",
+	"code":              "code",
+	"start_date":        "start_date",
+	"end_date":          "end_date",
+}
+
 func (manager SqlContentManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
 	return &Content{}, nil
 }
 
 func (manager SqlContentManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
 	}
 
@@ -56,46 +83,106 @@ func (manager SqlContentManager) FromId(ctx context.Context, id string) (spellbo
 		return nil, err
 	}
 
+	rules, err := sqlContentRules(sql.FromContext(ctx), current)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkContentRules(rules, ContentAccessRead, &content, current); err != nil {
+		return nil, err
+	}
+
 	return &content, nil
 }
 
 func (manager SqlContentManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
+// The contents are restricted to the ones matched by the content rules of the identity
+func (manager SqlContentManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
 	}
 
 	var conts []*Content
 
 	db := sql.FromContext(ctx)
-	db = db.Offset(opts.Page * opts.Size)
 
-	db = db.Where(sql.FiltersToCondition(opts.Filters, nil))
+	db, err := sqlRestrictToRules(ctx, db, current)
+	if err != nil {
+		return nil, "", err
+	}
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, contentColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
 
-	if opts.Order != "" {
-		dir := " asc"
-		if opts.Descending {
-			dir = " desc"
-		}
-		db = db.Order(fmt.Sprintf("%q %s", strings.ToLower(opts.Order), dir))
+	db, err = sql.Paginate(db, &Content{}, opts, contentColumns)
+	if err != nil {
+		return nil, "", err
 	}
 
-	db = db.Limit(opts.Size + 1)
 	if res := db.Find(&conts); res.Error != nil {
 		log.Errorf(ctx, "error retrieving content: %s", res.Error.Error())
-		return nil, res.Error
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(conts) > opts.Size {
+		conts = conts[:opts.Size]
+		next, err = sql.NewCursor(db, conts[len(conts)-1], opts, contentColumns)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	resources := make([]spellbook.Resource, len(conts))
 	for i := range conts {
 		resources[i] = conts[i]
 	}
-	return resources, nil
+	return resources, next, nil
+}
+
+func (manager SqlContentManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
+	}
+
+	db, err := sqlRestrictToRules(ctx, sql.FromContext(ctx).Model(&Content{}), current)
+	if err != nil {
+		return 0, err
+	}
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, contentColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting contents: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
 }
 
 func (manager SqlContentManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionReadContent) {
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadContent))
 	}
 
@@ -117,7 +204,20 @@ func (manager SqlContentManager) ListOfProperties(ctx context.Context, opts spel
 
 	var result []string
 	db := sql.FromContext(ctx)
-	rows, err := db.Raw(fmt.Sprintf("SELECT DISTINCT %s FROM contents", property)).Rows()
+
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM contents", property)
+	var args []interface{}
+	rules, err := sqlContentRules(db, current)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		var where string
+		where, args = sqlRulesCondition(rulesFor(rules, ContentAccessRead), contentAuthor(current))
+		query += " WHERE " + where
+	}
+
+	rows, err := db.Raw(query, args...).Rows()
 	if err != nil {
 		log.Errorf(ctx, "error retrieving property list for property %s: %s", property, err)
 		return nil, err
@@ -157,12 +257,8 @@ func (manager SqlContentManager) Create(ctx context.Context, res spellbook.Resou
 		content.PublicationState = PublicationStateUnpublished
 	}
 
-	if content.Type == "" {
-		return spellbook.NewFieldError("type", errors.New("type can't be empty"))
-	}
-
-	if content.Title == "" {
-		return spellbook.NewFieldError("title", errors.New("title can't be empty"))
+	if err := spellbook.ValidateStruct(content); err != nil {
+		return err
 	}
 
 	if !content.StartDate.IsZero() && !content.EndDate.IsZero() && content.EndDate.Before(content.StartDate) {
@@ -170,11 +266,19 @@ func (manager SqlContentManager) Create(ctx context.Context, res spellbook.Resou
 		return spellbook.NewFieldError("endDate", errors.New(msg))
 	}
 
-	if user, ok := current.(identity.User); ok {
-		content.Author = user.Username()
+	if author := contentAuthor(current); author != "" {
+		content.Author = author
 	}
 
 	db := sql.FromContext(ctx)
+	rules, err := sqlContentRules(db, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
+
 	if res := db.Create(&content); res.Error != nil {
 		log.Errorf(ctx, "error creating content %s: %s", content.Id(), res.Error)
 		return res.Error
@@ -192,22 +296,31 @@ func (manager SqlContentManager) Update(ctx context.Context, res spellbook.Resou
 	}
 
 	content := res.(*Content)
+	db := sql.FromContext(ctx)
+
+	// the content must be writable both before and after the update
+	rules, err := sqlContentRules(db, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
 
 	other := &Content{}
 	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
 		return spellbook.NewFieldError("", fmt.Errorf("invalid json for content %s: %s", content.StringID(), err.Error()))
 	}
 
-	if other.Type == "" {
-		return spellbook.NewFieldError("type", errors.New("type can't be empty"))
-	}
-
-	if other.Title == "" {
-		return spellbook.NewFieldError("title", errors.New("title can't be empty"))
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
 	}
 
 	// check if content locale is
 
+	// only the version of the If-Match header is enforced: the revision of the body is ignored,
+	// as clients send back the revision they read, or the one they expect the update to produce
+
 	content.Type = other.Type
 	content.Title = other.Title
 	content.Subtitle = other.Subtitle
@@ -218,7 +331,7 @@ func (manager SqlContentManager) Update(ctx context.Context, res spellbook.Resou
 	content.setCode(other.Code)
 	content.Body = other.Body
 	content.Cover = other.Cover
-	content.Revision = other.Revision
+	content.Revision++
 	content.Editor = other.Editor
 	content.Order = other.Order
 	content.Updated = time.Now().UTC()
@@ -251,14 +364,22 @@ func (manager SqlContentManager) Update(ctx context.Context, res spellbook.Resou
 	content.StartDate = other.StartDate
 	content.EndDate = other.EndDate
 
-	if user, ok := current.(identity.User); ok {
-		content.Author = user.Username()
+	if author := contentAuthor(current); author != "" {
+		content.Author = author
 	}
 
-	db := sql.FromContext(ctx)
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
 
-	if res := db.Save(content); res.Error != nil {
-		return fmt.Errorf("error updating post %s: %s", content.Slug, res.Error)
+	err = sql.VersionedWrite(ctx, db, &Content{}, content.ID, func(tx *gorm.DB) error {
+		return tx.Save(content).Error
+	})
+	if _, ok := err.(spellbook.PreconditionFailedError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error updating post %s: %s", content.Slug, err)
 	}
 
 	return nil
@@ -266,16 +387,43 @@ func (manager SqlContentManager) Update(ctx context.Context, res spellbook.Resou
 
 func (manager SqlContentManager) Delete(ctx context.Context, res spellbook.Resource) error {
 
-	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionWriteContent) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionWriteContent) {
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteContent))
 	}
 
 	content := res.(*Content)
 	db := sql.FromContext(ctx)
-	if res := db.Delete(content); res.Error != nil {
-		log.Errorf(ctx, "error deleting content %s: %s", content.Slug, res.Error)
-		return res.Error
+
+	rules, err := sqlContentRules(db, current)
+	if err != nil {
+		return err
+	}
+	if err := checkContentRules(rules, ContentAccessWrite, content, current); err != nil {
+		return err
+	}
+
+	err = sql.VersionedWrite(ctx, db, &Content{}, content.ID, func(tx *gorm.DB) error {
+		return tx.Delete(content).Error
+	})
+	if err != nil {
+		log.Errorf(ctx, "error deleting content %s: %s", content.Slug, err)
+		return err
 	}
 
 	return nil
 }
+
+// restricts the query to the contents the identity can read according to its content rules
+func sqlRestrictToRules(ctx context.Context, db *gorm.DB, current spellbook.Identity) (*gorm.DB, error) {
+	rules, err := sqlContentRules(sql.FromContext(ctx), current)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return db, nil
+	}
+
+	where, args := sqlRulesCondition(rulesFor(rules, ContentAccessRead), contentAuthor(current))
+	return db.Where(where, args...), nil
+}
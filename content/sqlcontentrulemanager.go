@@ -0,0 +1,255 @@
+package content
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"strings"
+)
+
+// fields that can be used to filter and order content rules
+var contentRuleColumns = sql.Columns{
+	"name":        "name",
+	"subjectType": "subject_type",
+	"subject":     "subject",
+	"access":      "access",
+	"category":    "category",
+	"type":        "type",
+	"locale":      "locale",
+}
+
+func NewSqlContentRuleController() *spellbook.RestController {
+	return NewSqlContentRuleControllerWithKey("")
+}
+
+func NewSqlContentRuleControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlContentRuleManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlContentRuleManager manages the content rules.
+// Rules are read with PermissionReadUser and written with PermissionEditPermissions
+type SqlContentRuleManager struct{}
+
+func (manager SqlContentRuleManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &ContentRule{}, nil
+}
+
+func (manager SqlContentRuleManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	rule := ContentRule{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("name = ?", id).First(&rule).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve content rule %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+func (manager SqlContentRuleManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlContentRuleManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var rules []*ContentRule
+	db := sql.FromContext(ctx)
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, contentRuleColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &ContentRule{}, opts, contentRuleColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&rules); res.Error != nil {
+		log.Errorf(ctx, "error retrieving content rules: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(rules) > opts.Size {
+		rules = rules[:opts.Size]
+		next, err = sql.NewCursor(db, rules[len(rules)-1], opts, contentRuleColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(rules))
+	for i := range rules {
+		resources[i] = rules[i]
+	}
+	return resources, next, nil
+}
+
+func (manager SqlContentRuleManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	db := sql.FromContext(ctx).Model(&ContentRule{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, contentRuleColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting content rules: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlContentRuleManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlContentRuleManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	rule := res.(*ContentRule)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{rule.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+	if err := spellbook.ValidateStruct(rule); err != nil {
+		return err
+	}
+
+	db := sql.FromContext(ctx)
+	err := db.Where("name = ?", rule.name).First(&ContentRule{}).Error
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("content rule %s already exists", rule.name))
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	rule.SqlName = rule.name
+	if err := db.Create(rule).Error; err != nil {
+		return fmt.Errorf("error creating content rule %s: %s", rule.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates everything but the name of the rule
+func (manager SqlContentRuleManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*ContentRule)
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
+	}
+
+	rule := res.(*ContentRule)
+	rule.update(other)
+
+	db := sql.FromContext(ctx)
+	return db.Save(rule).Error
+}
+
+func (manager SqlContentRuleManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	rule := res.(*ContentRule)
+
+	db := sql.FromContext(ctx)
+	if err := db.Delete(rule).Error; err != nil {
+		return fmt.Errorf("error deleting content rule %s: %s", rule.Id(), err.Error())
+	}
+
+	return nil
+}
+
+// returns the content rules of the identity, including the ones of its groups
+func sqlContentRules(db *gorm.DB, current spellbook.Identity) ([]*ContentRule, error) {
+	subjectType, subject, groups := ruleSubjects(current)
+	if subjectType == "" {
+		return nil, nil
+	}
+
+	where := "(subject_type = ? AND subject = ?)"
+	args := []interface{}{subjectType, subject}
+	if len(groups) > 0 {
+		where += " OR (subject_type = ? AND subject IN (?))"
+		args = append(args, RuleSubjectGroup, groups)
+	}
+
+	var rules []*ContentRule
+	if err := db.Where(where, args...).Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving the content rules of %s: %s", subject, err.Error())
+	}
+	return rules, nil
+}
+
+// returns the condition that restricts the contents to the ones matched by at least one of the rules.
+// No rules match no content
+func sqlRulesCondition(rules []*ContentRule, author string) (string, []interface{}) {
+	if len(rules) == 0 {
+		return "1 = 0", nil
+	}
+
+	var alternatives []string
+	var args []interface{}
+	for _, rule := range rules {
+		conditions := []string{"1 = 1"}
+		if rule.Category != "" {
+			conditions = append(conditions, "category = ?")
+			args = append(args, rule.Category)
+		}
+		if rule.Type != "" {
+			conditions = append(conditions, "type = ?")
+			args = append(args, rule.Type)
+		}
+		if rule.Locale != "" {
+			conditions = append(conditions, "locale = ?")
+			args = append(args, rule.Locale)
+		}
+		if rule.Own {
+			conditions = append(conditions, "author = ?")
+			args = append(args, author)
+		}
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 var ErrMissingField = errors.New("missing field")
@@ -29,6 +31,19 @@ func (errs *Errors) Clear() {
 	errs.errors = nil
 }
 
+// Errors is itself an error, so that managers can report every invalid field at once
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs.errors))
+	for i, err := range errs.errors {
+		msgs[i] = fmt.Sprintf("%s: %s", err.field, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs Errors) FieldErrors() []FieldError {
+	return errs.errors
+}
+
 func (errs Errors) MarshalJSON() ([]byte, error) {
 	return json.Marshal(errs.errors)
 }
@@ -42,14 +57,42 @@ type FieldError struct {
 	args  []string
 }
 
+// Returns a FieldError for the given field.
+// If the error is itself a FieldError, as returned by the validators, its message and arguments are kept
 func NewFieldError(field string, error error) FieldError {
+	if fe, ok := error.(FieldError); ok {
+		fe.field = field
+		return fe
+	}
 	return FieldError{error: error, field: field}
 }
 
+// Returns a FieldError not yet bound to a field, as returned by the validators.
+// The message is a template: it is the key of the message catalogue and args are its arguments
+func NewValidationError(message string, args ...string) FieldError {
+	return FieldError{error: errors.New(message), args: args}
+}
+
 func (err *FieldError) AddArgument(argument string) {
 	err.args = append(err.args, argument)
 }
 
+// Returns the message with the arguments applied to the template
+func (err FieldError) Error() string {
+	if len(err.args) == 0 {
+		return err.error.Error()
+	}
+	return fmt.Sprintf(err.error.Error(), err.arguments()...)
+}
+
+func (err FieldError) arguments() []interface{} {
+	args := make([]interface{}, len(err.args))
+	for i := range err.args {
+		args[i] = err.args[i]
+	}
+	return args
+}
+
 func (err FieldError) MarshalJSON() ([]byte, error) {
 	type Alias struct {
 		Field string   `json:"field"`
@@ -73,13 +116,79 @@ func NewPermissionError(permission string) PermissionError {
 	return PermissionError{permission}
 }
 
+// Unauthorized error is used to notify that the credentials of the request are missing, invalid or expired
+type UnauthorizedError struct {
+	reason string
+}
+
+func (err UnauthorizedError) Error() string {
+	return fmt.Sprintf("unauthorized: %s", err.reason)
+}
+
+func NewUnauthorizedError(reason string) UnauthorizedError {
+	return UnauthorizedError{reason}
+}
+
 // Unsupported error is used to notify that the action requested is not supported
-type UnsupportedError struct{}
+type UnsupportedError struct {
+	reason string
+}
 
 func (err UnsupportedError) Error() string {
+	if err.reason != "" {
+		return fmt.Sprintf("action is not supported: %s", err.reason)
+	}
 	return fmt.Sprint("action is not supported")
 }
 
 func NewUnsupportedError() UnsupportedError {
 	return UnsupportedError{}
 }
+
+// Returns an UnsupportedError that explains why the action can't be performed
+func NewUnsupportedErrorWithReason(reason string) UnsupportedError {
+	return UnsupportedError{reason}
+}
+
+// PreconditionFailedError is used to notify that the resource doesn't match
+// the version the request expected, usually because it was modified in the meanwhile
+type PreconditionFailedError struct {
+	reason string
+}
+
+func (err PreconditionFailedError) Error() string {
+	return fmt.Sprintf("precondition failed: %s", err.reason)
+}
+
+func NewPreconditionFailedError(reason string) PreconditionFailedError {
+	return PreconditionFailedError{reason}
+}
+
+// Conflict error is used to notify that the request conflicts with the state of the resource,
+// for example because a resource with the same unique fields already exists
+type ConflictError struct {
+	reason string
+}
+
+func (err ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %s", err.reason)
+}
+
+func NewConflictError(reason string) ConflictError {
+	return ConflictError{reason}
+}
+
+// RateLimited error is used to notify that the requestor sent too many requests.
+// The request can be retried after the given duration
+type RateLimitedError struct {
+	reason     string
+	RetryAfter time.Duration
+}
+
+func (err RateLimitedError) Error() string {
+	return fmt.Sprintf("too many requests: %s", err.reason)
+}
+
+func NewRateLimitedError(reason string, retryAfter time.Duration) RateLimitedError {
+	return RateLimitedError{reason: reason, RetryAfter: retryAfter}
+}
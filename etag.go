@@ -0,0 +1,124 @@
+package spellbook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderETag        string = "ETag"
+	HeaderIfMatch     string = "If-Match"
+	HeaderIfNoneMatch string = "If-None-Match"
+	keyVersion        string = "__pVersion__"
+)
+
+// Versioned is implemented by the resources that carry their own version,
+// such as a revision number or the time of the last update.
+// The version is used as the ETag of the resource
+type Versioned interface {
+	Version() string
+}
+
+// Returns the version of a resource that is versioned by the time of its last update.
+// The time is truncated to microseconds, the precision of the storage backends
+func TimeVersion(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10)
+}
+
+// Returns the ETag of the resource.
+// The ETag is the version of the resource, if the resource is Versioned,
+// or the hash of its JSON representation otherwise
+func ETag(resource Resource) (string, error) {
+	if v, ok := resource.(Versioned); ok {
+		return fmt.Sprintf("%q", v.Version()), nil
+	}
+
+	data, err := resource.ToRepresentation(RepresentationTypeJSON)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:16])), nil
+}
+
+// Returns true if the etag is listed in the value of an If-Match or If-None-Match header.
+// Weak validators are compared as strong ones
+func MatchETag(header string, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a context that carries the version of the resource that the request expects to modify
+func ContextWithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, keyVersion, version)
+}
+
+// Returns the version of the resource that the request expects to modify, if any
+func VersionFromContext(ctx context.Context) (string, bool) {
+	if v := ctx.Value(keyVersion); v != nil {
+		return v.(string), true
+	}
+	return "", false
+}
+
+// Checks that the stored copy of a resource has the version expected by the request.
+// Managers call it inside the write, on the freshly read resource, so that
+// concurrent writes that happened after the request was validated are detected.
+// Returns nil if the request doesn't expect any version
+func CheckVersion(ctx context.Context, stored Versioned) error {
+	expected, ok := VersionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if actual := stored.Version(); actual != expected {
+		return NewPreconditionFailedError(fmt.Sprintf("the resource was modified: expected version %s, found %s", expected, actual))
+	}
+	return nil
+}
+
+// the lease of the lock of a versioned write, longer than any write
+const versionedWriteLease = 30 * time.Second
+
+// Executes the datastore write, provided that the stored entity returned by read has the version expected by the request.
+// The read, the check and the write hold the lock of the key of the entity, see DefaultLocker, so that two writers
+// that expect the same version can't both pass the check: a writer that finds the entity locked by another one
+// fails with a PreconditionFailedError.
+// If the request doesn't expect any version, the write is executed as is, without the lock
+func VersionedWrite(ctx context.Context, key string, read func(ctx context.Context) (Versioned, error), write func(ctx context.Context) error) error {
+	if _, ok := VersionFromContext(ctx); !ok {
+		return write(ctx)
+	}
+
+	unlock, ok, err := DefaultLocker.Lock(ctx, "version:"+key, versionedWriteLease)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NewPreconditionFailedError("the resource is being modified")
+	}
+	defer unlock()
+
+	stored, err := read(ctx)
+	if err != nil {
+		return err
+	}
+	if err := CheckVersion(ctx, stored); err != nil {
+		return err
+	}
+	return write(ctx)
+}
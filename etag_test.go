@@ -0,0 +1,78 @@
+package spellbook
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type versionedResource struct {
+	revision int
+}
+
+func (resource *versionedResource) Version() string {
+	return strconv.Itoa(resource.revision)
+}
+
+func TestVersionedWriteConcurrent(t *testing.T) {
+	locker := DefaultLocker
+	DefaultLocker = NewMemoryLocker()
+	defer func() { DefaultLocker = locker }()
+
+	var mu sync.Mutex
+	stored := versionedResource{revision: 1}
+	read := func(ctx context.Context) (Versioned, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := stored
+		return &copied, nil
+	}
+	write := func(ctx context.Context) error {
+		// leaves room for the other writer to read the version that is being replaced
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		stored.revision++
+		return nil
+	}
+
+	// both writers expect the same version
+	ctx := ContextWithVersion(context.Background(), "1")
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = VersionedWrite(ctx, "resource", read, write)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		switch err.(type) {
+		case nil:
+		case PreconditionFailedError:
+			failed++
+		default:
+			t.Fatalf("unexpected error %s", err.Error())
+		}
+	}
+	if failed != 1 {
+		t.Errorf("exactly one writer should fail the precondition, %d did", failed)
+	}
+	if stored.revision != 2 {
+		t.Errorf("the resource should be written once, it's at revision %d", stored.revision)
+	}
+
+	// the lock is released: a writer that expects the current version succeeds
+	if err := VersionedWrite(ContextWithVersion(context.Background(), "2"), "resource", read, write); err != nil {
+		t.Errorf("the write should succeed: %s", err.Error())
+	}
+	if err := VersionedWrite(ContextWithVersion(context.Background(), "2"), "resource", read, write); err == nil {
+		t.Error("a writer that expects a replaced version should fail the precondition")
+	}
+}
@@ -1,7 +1,106 @@
 package spellbook
 
-import "context"
+import (
+	"context"
+	"google.golang.org/appengine/log"
+)
 
+// hooks of the lifecycle of a resource
+const (
+	HookBeforeCreate = "before_create"
+	HookAfterCreate  = "after_create"
+	HookBeforeUpdate = "before_update"
+	HookAfterUpdate  = "after_update"
+	HookBeforePatch  = "before_patch"
+	HookBeforeDelete = "before_delete"
+	HookAfterDelete  = "after_delete"
+	HookAfterRead    = "after_read"
+)
+
+const keyExtenders string = "__pExtenders__"
+
+// Extender customizes the lifecycle of the resources of a RestController.
+// An extender is only invoked for the hooks it is registered to with AddExtender.
+// Before hooks reject the write by returning an error, usually a FieldError or a PermissionError.
+// After hooks of writes can't undo the write: their errors are logged.
+// AfterRead is invoked before the resource is sent, and its error is returned to the client
 type Extender interface {
 	BeforeCreate(ctx context.Context, resource Resource) error
+	AfterCreate(ctx context.Context, resource Resource) error
+	// bundle is the representation of the resource sent by the client
+	BeforeUpdate(ctx context.Context, resource Resource, bundle []byte) error
+	// invoked after both updates and patches
+	AfterUpdate(ctx context.Context, resource Resource) error
+	BeforePatch(ctx context.Context, resource Resource, fields map[string]interface{}) error
+	BeforeDelete(ctx context.Context, resource Resource) error
+	AfterDelete(ctx context.Context, resource Resource) error
+	AfterRead(ctx context.Context, resource Resource) error
+}
+
+// BaseExtender implements every hook as a no-op.
+// Embed it to implement only the hooks of interest
+type BaseExtender struct{}
+
+func (extender BaseExtender) BeforeCreate(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func (extender BaseExtender) AfterCreate(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func (extender BaseExtender) BeforeUpdate(ctx context.Context, resource Resource, bundle []byte) error {
+	return nil
+}
+
+func (extender BaseExtender) AfterUpdate(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func (extender BaseExtender) BeforePatch(ctx context.Context, resource Resource, fields map[string]interface{}) error {
+	return nil
+}
+
+func (extender BaseExtender) BeforeDelete(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func (extender BaseExtender) AfterDelete(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func (extender BaseExtender) AfterRead(ctx context.Context, resource Resource) error {
+	return nil
+}
+
+func contextWithExtenders(ctx context.Context, extenders map[string][]Extender) context.Context {
+	return context.WithValue(ctx, keyExtenders, extenders)
+}
+
+func extendersFromContext(ctx context.Context, hook string) []Extender {
+	if e := ctx.Value(keyExtenders); e != nil {
+		return e.(map[string][]Extender)[hook]
+	}
+	return nil
+}
+
+// Invokes the extenders registered to the hook, in order of registration.
+// Stops at the first extender that returns an error
+func runHook(ctx context.Context, hook string, call func(extender Extender) error) error {
+	for _, extender := range extendersFromContext(ctx, hook) {
+		if err := call(extender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invokes the extenders registered to an after hook of a write.
+// The write is already done: errors are logged and don't stop the following extenders
+func runAfterHook(ctx context.Context, hook string, call func(extender Extender) error) {
+	for _, extender := range extendersFromContext(ctx, hook) {
+		if err := call(extender); err != nil {
+			log.Errorf(ctx, "extender %T failed on %s: %s", extender, hook, err.Error())
+		}
+	}
 }
@@ -9,6 +9,7 @@ require (
 	github.com/disintegration/imaging v1.6.0
 	github.com/jinzhu/gorm v1.9.10
 	github.com/stretchr/objx v0.1.1 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/text v0.3.2
 	google.golang.org/api v0.24.0
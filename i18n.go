@@ -0,0 +1,97 @@
+package spellbook
+
+import (
+	"context"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+	"strings"
+)
+
+// Catalog holds the translations of the error messages.
+// The keys are the English messages, as returned by the validators and the managers:
+// applications can translate their own messages, or add languages, with Catalog.SetString
+var Catalog = catalog.NewBuilder(catalog.Fallback(language.English))
+
+// Returns the printer of the request language, as set by the router.
+// Falls back to English if the request has no language
+func PrinterFromContext(ctx context.Context) *message.Printer {
+	tag, ok := ctx.Value(KeyLanguageTag).(language.Tag)
+	if !ok {
+		tag = language.English
+	}
+	return message.NewPrinter(tag, message.Catalog(Catalog))
+}
+
+// Returns the message translated in the request language.
+// The arguments are applied to the translated template
+func Localize(ctx context.Context, msg string, args ...interface{}) string {
+	// a message without arguments that contains verbs can't be a template
+	if len(args) == 0 && strings.Contains(msg, "%") {
+		return msg
+	}
+	return PrinterFromContext(ctx).Sprintf(msg, args...)
+}
+
+// Returns the message of the error translated in the request language
+func LocalizeError(ctx context.Context, err error) string {
+	if fe, ok := err.(FieldError); ok {
+		return Localize(ctx, fe.error.Error(), fe.arguments()...)
+	}
+	return Localize(ctx, err.Error())
+}
+
+func init() {
+	translations := map[language.Tag]map[string]string{
+		language.Italian: {
+			"missing field":                                                                 "campo obbligatorio",
+			"field must be at least %s characters":                                          "il campo deve contenere almeno %s caratteri",
+			"field can't be more than %s characters":                                        "il campo non può contenere più di %s caratteri",
+			"field length must be between %s and %s characters":                             "il campo deve contenere tra %s e %s caratteri",
+			"string is empty":                                                               "il testo è vuoto",
+			"%s can't start with '__'":                                                      "%s non può iniziare con '__'",
+			"file name can't be larger than 1024 bytes":                                     "il nome del file non può superare i 1024 byte",
+			"invalid file name: %s":                                                         "nome del file non valido: %s",
+			"file name can't start with '.well-known/acme-challenge'":                       "il nome del file non può iniziare con '.well-known/acme-challenge'",
+			"file name can't contain new lines or line feeds":                               "il nome del file non può contenere a capo",
+			"file name %s contains invalid character %s":                                    "il nome del file %s contiene il carattere non valido %s",
+			"phone number too short":                                                        "numero di telefono troppo corto",
+			"phone number does not start with international prefix":                         "il numero di telefono non inizia con il prefisso internazionale",
+			"phone number does not comply with E.164 international standard specifications": "il numero di telefono non rispetta lo standard internazionale E.164",
+			"phone number contains non-numeric characters":                                  "il numero di telefono contiene caratteri non numerici",
+			"text contains non-alphanumeric characters":                                     "il testo contiene caratteri non alfanumerici",
+			"text contains non-numeric characters":                                          "il testo contiene caratteri non numerici",
+			"invalid url %s":                                                                "url non valido %s",
+			"url scheme %s is not allowed":                                                  "lo schema %s non è ammesso",
+			"invalid slug %s: only lower case letters, numbers and dashes are allowed":      "slug non valido %s: sono ammessi solo lettere minuscole, numeri e trattini",
+			"%s doesn't match the pattern %s":                                               "%s non rispetta il formato %s",
+			"%s is not an integer":                                                          "%s non è un numero intero",
+			"%s is not a number":                                                            "%s non è un numero",
+			"value must be between %s and %s":                                               "il valore deve essere compreso tra %s e %s",
+			"value must be at least %s":                                                     "il valore deve essere almeno %s",
+			"value must be at most %s":                                                      "il valore deve essere al massimo %s",
+			"invalid date %s, expected format %s":                                           "data non valida %s, il formato atteso è %s",
+			"date must not be before %s":                                                    "la data non può essere precedente al %s",
+			"date must not be after %s":                                                     "la data non può essere successiva al %s",
+			"%s is not one of %s":                                                           "%s non è uno tra %s",
+			"invalid iban %s":                                                               "iban non valido %s",
+			"invalid vat number %s":                                                         "partita iva non valida %s",
+			"invalid vat number %s: unknown country %s":                                     "partita iva non valida %s: paese sconosciuto %s",
+			"text contains invalid characters":                                              "il testo contiene caratteri non validi",
+			"invalid network %s":                                                            "rete non valida %s",
+			"invalid ip address %s":                                                         "indirizzo ip non valido %s",
+			"invalid email address %s":                                                      "indirizzo email non valido %s",
+			"the request has invalid parameters":                                            "la richiesta contiene parametri non validi",
+			"the resource doesn't exist":                                                    "la risorsa non esiste",
+			"authentication is required":                                                    "è necessario autenticarsi",
+		},
+	}
+
+	for tag, messages := range translations {
+		for key, msg := range messages {
+			if err := Catalog.SetString(tag, key, msg); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
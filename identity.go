@@ -2,66 +2,81 @@ package spellbook
 
 import "context"
 
-type Permission int64
+// Permission is a named permission, such as "PERMISSION_READ_CONTENT".
+// The name is also its JSON form. Permissions are declared with RegisterPermission
+type Permission string
 
 const (
 	HeaderToken string = "X-Authentication"
 	keyUser     string = "__pUser__"
 )
 
+// the permissions of spellbook, always registered
 const (
-	PermissionEnabled = 1 << iota
-	PermissionEditPermissions
-	PermissionReadUser
-	PermissionWriteUser
-	PermissionReadContent
-	PermissionWriteContent
-	PermissionReadMailMessage
-	PermissionWriteMailMessage
-	PermissionReadPlace
-	PermissionWritePlace
-	PermissionReadMedia
-	PermissionWriteMedia
-	PermissionReadPage
-	PermissionWritePage
-	PermissionWriteSubscription
-	PermissionReadSubscription
-	PermissionWriteAction
-	PermissionReadAction
+	PermissionEnabled           Permission = "PERMISSION_ENABLED"
+	PermissionEditPermissions   Permission = "PERMISSION_EDIT_PERMISSIONS"
+	PermissionReadUser          Permission = "PERMISSION_READ_USER"
+	PermissionWriteUser         Permission = "PERMISSION_WRITE_USER"
+	PermissionReadContent       Permission = "PERMISSION_READ_CONTENT"
+	PermissionWriteContent      Permission = "PERMISSION_WRITE_CONTENT"
+	PermissionReadMailMessage   Permission = "PERMISSION_READ_MAILMESSAGE"
+	PermissionWriteMailMessage  Permission = "PERMISSION_WRITE_MAILMESSAGE"
+	PermissionReadPlace         Permission = "PERMISSION_READ_PLACE"
+	PermissionWritePlace        Permission = "PERMISSION_WRITE_PLACE"
+	PermissionReadMedia         Permission = "PERMISSION_READ_MEDIA"
+	PermissionWriteMedia        Permission = "PERMISSION_WRITE_MEDIA"
+	PermissionReadPage          Permission = "PERMISSION_READ_PAGE"
+	PermissionWritePage         Permission = "PERMISSION_WRITE_PAGE"
+	PermissionWriteSubscription Permission = "PERMISSION_WRITE_SUBSCRIPTION"
+	PermissionReadSubscription  Permission = "PERMISSION_READ_SUBSCRIPTION"
+	PermissionWriteAction       Permission = "PERMISSION_WRITE_ACTION"
+	PermissionReadAction        Permission = "PERMISSION_READ_ACTION"
+	// acting as another user, see ImpersonatorFromContext
+	PermissionImpersonate Permission = "PERMISSION_IMPERSONATE"
+	// reading the audit log, see AuditSink
+	PermissionReadAudit Permission = "PERMISSION_READ_AUDIT"
 )
 
-var Permissions = map[Permission]string{
-	PermissionEnabled:           "PERMISSION_ENABLED",
-	PermissionEditPermissions:   "PERMISSION_EDIT_PERMISSIONS",
-	PermissionReadUser:          "PERMISSION_READ_USER",
-	PermissionWriteUser:         "PERMISSION_WRITE_USER",
-	PermissionReadContent:       "PERMISSION_READ_CONTENT",
-	PermissionWriteContent:      "PERMISSION_WRITE_CONTENT",
-	PermissionReadMailMessage:   "PERMISSION_READ_MAILMESSAGE",
-	PermissionWriteMailMessage:  "PERMISSION_WRITE_MAILMESSAGE",
-	PermissionReadPlace:         "PERMISSION_READ_PLACE",
-	PermissionWritePlace:        "PERMISSION_WRITE_PLACE",
-	PermissionReadMedia:         "PERMISSION_READ_MEDIA",
-	PermissionWriteMedia:        "PERMISSION_WRITE_MEDIA",
-	PermissionReadPage:          "PERMISSION_READ_PAGE",
-	PermissionWritePage:         "PERMISSION_WRITE_PAGE",
-	PermissionReadSubscription:  "PERMISSION_READ_SUBSCRIPTION",
-	PermissionWriteSubscription: "PERMISSION_WRITE_SUBSCRIPTION",
-	PermissionWriteAction:       "PERMISSION_READ_ACTION",
-	PermissionReadAction:        "PERMISSION_WRITE_ACTION",
+// the permissions in the order of the bits of the bitmasks stored before the registry
+var legacyPermissionBits = []Permission{
+	PermissionEnabled,
+	PermissionEditPermissions,
+	PermissionReadUser,
+	PermissionWriteUser,
+	PermissionReadContent,
+	PermissionWriteContent,
+	PermissionReadMailMessage,
+	PermissionWriteMailMessage,
+	PermissionReadPlace,
+	PermissionWritePlace,
+	PermissionReadMedia,
+	PermissionWriteMedia,
+	PermissionReadPage,
+	PermissionWritePage,
+	PermissionWriteSubscription,
+	PermissionReadSubscription,
+	PermissionWriteAction,
+	PermissionReadAction,
+}
+
+func init() {
+	for _, permission := range legacyPermissionBits {
+		RegisterPermission(string(permission))
+	}
+	RegisterPermission(string(PermissionImpersonate))
+	RegisterPermission(string(PermissionReadAudit))
 }
 
 func PermissionName(permission Permission) string {
-	return Permissions[permission]
+	return string(permission)
 }
 
+// returns the registered permission with the given name, or the empty permission
 func NamedPermissionToPermission(name string) Permission {
-	for permission, n := range Permissions {
-		if n == name {
-			return permission
-		}
+	if IsRegisteredPermission(Permission(name)) {
+		return Permission(name)
 	}
-	return Permission(0)
+	return Permission("")
 }
 
 type Identity interface {
@@ -79,3 +94,26 @@ func IdentityFromContext(ctx context.Context) Identity {
 func ContextWithIdentity(ctx context.Context, id Identity) context.Context {
 	return context.WithValue(ctx, keyUser, id)
 }
+
+// Impersonation is implemented by the identities that can act on behalf of another user.
+// Impersonator returns the real actor, nil if the identity is not impersonated
+type Impersonation interface {
+	Impersonator() Identity
+}
+
+// Returns the real actor of the request if the identity is impersonated, nil otherwise.
+// Permissions are checked against the impersonated identity
+func ImpersonatorFromContext(ctx context.Context) Identity {
+	if i, ok := IdentityFromContext(ctx).(Impersonation); ok {
+		return i.Impersonator()
+	}
+	return nil
+}
+
+// Returns the real actor of the request: the impersonator if the identity is impersonated, the identity otherwise
+func ActorFromContext(ctx context.Context) Identity {
+	if impersonator := ImpersonatorFromContext(ctx); impersonator != nil {
+		return impersonator
+	}
+	return IdentityFromContext(ctx)
+}
@@ -0,0 +1,152 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The keys of the signed access tokens. If set, the sql token and refresh managers issue access tokens
+// that are jwts carrying the username, the session, the permissions and the groups of the user, and SqlAuthenticator
+// accepts them without retrieving the session or the user.
+// The permissions and the groups are the ones of the login or of the last refresh: changes to the user and to its roles
+// apply when the token is refreshed.
+// The access tokens of a closed session are revoked through DefaultTokenDenyList, which must be set: they are rejected
+// at once by the instance that closes the session, and by the other instances once they reload the deny-list,
+// within the Refresh of a SqlTokenDenyList, TokenDenyListRefresh by default. Until then they are still accepted.
+// Refresh tokens are not signed, and keep being checked against their session
+var DefaultJWTKeys *JWTKeySet
+
+// the claims of a signed access token
+type accessClaims struct {
+	Issuer       string   `json:"iss,omitempty"`
+	Subject      string   `json:"sub"`
+	Session      string   `json:"sid"`
+	IssuedAt     int64    `json:"iat"`
+	Expires      int64    `json:"exp"`
+	Permissions  []string `json:"perms"`
+	SecondFactor bool     `json:"sf,omitempty"`
+	// the groups scope the content rules of the user
+	Groups []string `json:"groups,omitempty"`
+	// the impersonator, if the session is an impersonation
+	Actor *accessActor `json:"act,omitempty"`
+}
+
+type accessActor struct {
+	Subject string `json:"sub"`
+}
+
+// reports whether the token is a jwt rather than a session, service account or legacy token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// replaces the access token of the session with a token signed with DefaultJWTKeys.
+// The user must have been granted its roles
+func signAccessToken(u User, session *Session, token *Token) error {
+	if DefaultJWTKeys == nil {
+		return nil
+	}
+	// without a deny-list the tokens of closed sessions would be accepted until they expire
+	if DefaultTokenDenyList == nil {
+		return errors.New("signed access tokens require a DefaultTokenDenyList")
+	}
+
+	u.applyTwoFactor(session)
+	claims := accessClaims{
+		Issuer:       DefaultJWTKeys.Issuer,
+		Subject:      u.Username(),
+		Session:      session.Id(),
+		IssuedAt:     time.Now().Unix(),
+		Expires:      session.AccessExpires.Unix(),
+		Permissions:  u.Permissions(),
+		Groups:       u.Groups,
+		SecondFactor: session.SecondFactor,
+	}
+	if session.Impersonator != "" {
+		claims.Actor = &accessActor{Subject: session.Impersonator}
+	}
+
+	signed, err := DefaultJWTKeys.sign(claims)
+	if err != nil {
+		return fmt.Errorf("error signing the access token of user %s: %s", u.Username(), err.Error())
+	}
+	token.Value = signed
+	return nil
+}
+
+// returns the user and the session of a signed access token. Nothing is retrieved from the storage:
+// the user only has its username, the permissions and the groups of the token, the session only its id.
+// The impersonator of an impersonation is checked when the token is issued, and it's not checked again
+func userFromAccessToken(ctx context.Context, token string) (User, *Session, error) {
+	u := User{}
+	if DefaultJWTKeys == nil {
+		return u, nil, errors.New("signed access tokens are not enabled")
+	}
+
+	claims := accessClaims{}
+	if err := DefaultJWTKeys.verify(token, &claims); err != nil {
+		return u, nil, err
+	}
+
+	now := time.Now()
+	if claims.Subject == "" || claims.Session == "" {
+		return u, nil, errInvalidJWT
+	}
+	if DefaultJWTKeys.Issuer != "" && claims.Issuer != DefaultJWTKeys.Issuer {
+		return u, nil, errInvalidJWT
+	}
+	if !now.Before(time.Unix(claims.Expires, 0)) {
+		return u, nil, spellbook.NewUnauthorizedError("invalid or expired token")
+	}
+
+	if DefaultTokenDenyList == nil {
+		return u, nil, errors.New("signed access tokens require a DefaultTokenDenyList")
+	}
+	denied, err := DefaultTokenDenyList.Denied(ctx, claims.Session)
+	if err != nil {
+		return u, nil, fmt.Errorf("error checking the revocation of session %s: %s", claims.Session, err.Error())
+	}
+	if denied {
+		return u, nil, spellbook.NewUnauthorizedError("the session has been revoked")
+	}
+
+	u.SqlUsername = claims.Subject
+	u.SetPermissions(spellbook.PermissionSetFromNames(claims.Permissions))
+	u.Groups = claims.Groups
+	session := Session{
+		SqlId:         claims.Session,
+		Username:      claims.Subject,
+		AccessExpires: time.Unix(claims.Expires, 0).UTC(),
+		SecondFactor:  claims.SecondFactor,
+	}
+	// the impersonator is only known by its username
+	if claims.Actor != nil && claims.Actor.Subject != "" {
+		session.Impersonator = claims.Actor.Subject
+		u.impersonator = &User{SqlUsername: claims.Actor.Subject}
+	}
+	return u, &session, nil
+}
+
+// revokes the signed access tokens of the sessions, which are otherwise accepted until they expire.
+// Nothing is done if access tokens are not signed
+func revokeAccessTokens(ctx context.Context, sessions ...string) error {
+	if DefaultJWTKeys == nil {
+		return nil
+	}
+	if DefaultTokenDenyList == nil {
+		return errors.New("signed access tokens require a DefaultTokenDenyList")
+	}
+
+	// no token of the sessions outlives a token issued now
+	until := time.Now().UTC().Add(AccessTokenDuration)
+	for _, id := range sessions {
+		if err := DefaultTokenDenyList.Deny(ctx, id, until); err != nil {
+			return fmt.Errorf("error revoking the access tokens of session %s: %s", id, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package identity
+
+import (
+	"decodica.com/spellbook"
+	"encoding/json"
+	"github.com/decodica/model/v2"
+	"time"
+)
+
+// the actions a one-time token authorizes
+const (
+	ActionPasswordReset     = "password-reset"
+	ActionEmailVerification = "email-verification"
+)
+
+// lifetimes of the one-time tokens
+var (
+	PasswordResetTokenDuration     = time.Hour
+	EmailVerificationTokenDuration = 48 * time.Hour
+)
+
+// ActionToken is a one-time token sent by mail to a user, such as the token that resets the password.
+// It expires, it's deleted when used and it's replaced when a new one is requested for the same action.
+// Only the hash of the token is stored, and it's the id of the token
+type ActionToken struct {
+	model.Model `json:"-"`
+	SqlHash     string `model:"-" gorm:"PRIMARY_KEY;column:hash"`
+	Username    string `gorm:"NOT NULL;INDEX:idx_action_tokens_username"`
+	Action      string `gorm:"NOT NULL"`
+	// the address the token has been sent to
+	Email   string
+	Created time.Time
+	Expires time.Time
+	// the wrong codes sent for a two factor challenge
+	Attempts int
+	// the hash, while the token is not yet stored
+	hash string `model:"-" gorm:"-"`
+}
+
+// Returns a new token of the user for the action, and its clear value.
+// The token must be stored by the caller
+func newActionToken(user User, action string, duration time.Duration) (*ActionToken, string, error) {
+	tkn, err := NewRandomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	token := ActionToken{
+		SqlHash:  HashToken(tkn),
+		Username: user.Username(),
+		Action:   action,
+		Email:    user.Email,
+		Created:  now,
+		Expires:  now.Add(duration),
+	}
+	token.hash = token.SqlHash
+	return &token, tkn, nil
+}
+
+func (token *ActionToken) Id() string {
+	if token.EncodedKey() != "" {
+		return token.StringID()
+	}
+	if token.SqlHash != "" {
+		return token.SqlHash
+	}
+	return token.hash
+}
+
+// reports whether the token authorizes the action and is not expired
+func (token *ActionToken) valid(action string, now time.Time) bool {
+	return token.Action == action && now.Before(token.Expires)
+}
+
+// PasswordReset is a request to reset the password of a user, and its confirmation.
+// The request names the user by username or by email and mails a token to the user.
+// The confirmation is sent to the token and carries the new password
+type PasswordReset struct {
+	Username string
+	Email    string
+	Password string
+	token    *ActionToken
+}
+
+func (reset *PasswordReset) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	reset.Username = alias.Username
+	reset.Email = alias.Email
+	reset.Password = alias.Password
+	return nil
+}
+
+// nothing is returned: the response must not tell whether the user exists
+func (reset *PasswordReset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct{}{})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (reset *PasswordReset) Id() string {
+	return ""
+}
+
+func (reset *PasswordReset) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, reset)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (reset *PasswordReset) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(reset)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// EmailVerification is a request to verify the email of a user, and its confirmation.
+// The request mails a token to the current email of the user, the confirmation is sent to the token
+type EmailVerification struct {
+	Username string
+	Email    string
+	Verified bool
+	token    *ActionToken
+}
+
+func (verification *EmailVerification) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Username string `json:"username"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	verification.Username = alias.Username
+	return nil
+}
+
+func (verification *EmailVerification) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}{
+		Username: verification.Username,
+		Email:    verification.Email,
+		Verified: verification.Verified,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (verification *EmailVerification) Id() string {
+	return ""
+}
+
+func (verification *EmailVerification) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, verification)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (verification *EmailVerification) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(verification)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,321 @@
+package identity
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"strings"
+	"time"
+)
+
+func NewPasswordResetController() *spellbook.RestController {
+	return NewPasswordResetControllerWithKey("")
+}
+
+func NewPasswordResetControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: PasswordResetManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// PasswordResetManager resets forgotten passwords.
+// POST mails a reset token to the user named by username or email,
+// PUT to the token sets the new password and closes every session of the user
+type PasswordResetManager struct{}
+
+func (manager PasswordResetManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &PasswordReset{}, nil
+}
+
+// returns the reset of the token. Fails with datastore.ErrNoSuchEntity if the token is invalid or expired
+func (manager PasswordResetManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	token, err := actionTokenFromId(ctx, id, ActionPasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordReset{Username: token.Username, token: token}, nil
+}
+
+func (manager PasswordResetManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager PasswordResetManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// mails a reset token to the user. The request succeeds even if the user doesn't exist,
+// so that it can't be used to find out the registered users
+func (manager PasswordResetManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	reset := res.(*PasswordReset)
+	if reset.Username == "" && reset.Email == "" {
+		return spellbook.NewFieldError("username", spellbook.ErrMissingField)
+	}
+
+	if DefaultMailSender == nil {
+		return ErrNoMailSender
+	}
+
+	u := User{}
+	var err error
+	if reset.Username != "" {
+		err = model.FromStringID(ctx, &u, SanitizeUserName(reset.Username), nil)
+	} else {
+		err = model.NewQuery(&User{}).WithField("Email =", strings.TrimSpace(reset.Email)).First(ctx, &u)
+	}
+	if err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "password reset requested for an unknown user")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !u.IsEnabled() || u.Email == "" {
+		log.Infof(ctx, "password reset requested for user %s, which can't receive it", u.Username())
+		return nil
+	}
+
+	tkn, token, err := issueActionToken(ctx, u, ActionPasswordReset, PasswordResetTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(ctx, NewPasswordResetMail(u, tkn, token.Expires))
+}
+
+// sets the new password. The token can't be used again, and every session of the user is closed
+func (manager PasswordResetManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	reset := res.(*PasswordReset)
+
+	other := PasswordReset{}
+	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	meta := struct {
+		Password string `json:"password" validate:"required,len=8:"`
+	}{other.Password}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, reset.token.Username, nil); err != nil {
+		return err
+	}
+
+	// the token is spent before the password is changed
+	if err := model.Delete(ctx, reset.token, nil); err != nil {
+		return fmt.Errorf("error deleting the reset token of user %s: %s", u.Username(), err.Error())
+	}
+
+	hash, err := NewPasswordHash(other.Password)
+	if err != nil {
+		return fmt.Errorf("error hashing the password of user %s: %s", u.Username(), err.Error())
+	}
+	u.Password = hash
+	u.setToken("")
+	// the token has been received at the address of the user
+	if reset.token.Email == u.Email {
+		u.EmailVerified = time.Now().UTC()
+	}
+
+	if err := model.Update(ctx, &u); err != nil {
+		return fmt.Errorf("error updating the password of user %s: %s", u.Username(), err.Error())
+	}
+
+	return closeSessions(ctx, u.Username())
+}
+
+func (manager PasswordResetManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func NewEmailVerificationController() *spellbook.RestController {
+	return NewEmailVerificationControllerWithKey("")
+}
+
+func NewEmailVerificationControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: EmailVerificationManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// EmailVerificationManager verifies the emails of the users.
+// POST mails a verification token to the email of the current user, or of the named user with PermissionWriteUser.
+// PUT to the token marks the email as verified
+type EmailVerificationManager struct{}
+
+func (manager EmailVerificationManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &EmailVerification{}, nil
+}
+
+// returns the verification of the token. Fails with datastore.ErrNoSuchEntity if the token is invalid or expired
+func (manager EmailVerificationManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	token, err := actionTokenFromId(ctx, id, ActionEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailVerification{Username: token.Username, Email: token.Email, token: token}, nil
+}
+
+func (manager EmailVerificationManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager EmailVerificationManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// mails a verification token to the email of the user
+func (manager EmailVerificationManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	verification := res.(*EmailVerification)
+	username, err := verificationUsername(ctx, verification)
+	if err != nil {
+		return err
+	}
+
+	if DefaultMailSender == nil {
+		return ErrNoMailSender
+	}
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, username, nil); err != nil {
+		return err
+	}
+
+	if err := checkVerifiable(u); err != nil {
+		return err
+	}
+
+	tkn, token, err := issueActionToken(ctx, u, ActionEmailVerification, EmailVerificationTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	verification.Username = u.Username()
+	verification.Email = u.Email
+	return sendMail(ctx, NewEmailVerificationMail(u, tkn, token.Expires))
+}
+
+// marks the email as verified, if it's still the email the token has been sent to
+func (manager EmailVerificationManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	verification := res.(*EmailVerification)
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, verification.token.Username, nil); err != nil {
+		return err
+	}
+
+	if err := model.Delete(ctx, verification.token, nil); err != nil {
+		return fmt.Errorf("error deleting the verification token of user %s: %s", u.Username(), err.Error())
+	}
+
+	if u.Email != verification.token.Email {
+		return spellbook.NewConflictError(fmt.Sprintf("the email of user %s changed after the token was sent", u.Username()))
+	}
+
+	u.EmailVerified = time.Now().UTC()
+	if err := model.Update(ctx, &u); err != nil {
+		return fmt.Errorf("error verifying the email of user %s: %s", u.Username(), err.Error())
+	}
+
+	verification.Verified = true
+	return nil
+}
+
+func (manager EmailVerificationManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// returns the user whose email must be verified: the current user,
+// or the user of the request if the current user has PermissionWriteUser
+func verificationUsername(ctx context.Context, verification *EmailVerification) (string, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	if verification.Username == "" || verification.Username == current.Username() {
+		if _, ok := current.(User); !ok {
+			return "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+		}
+		return current.Username(), nil
+	}
+
+	if !current.HasPermission(spellbook.PermissionWriteUser) {
+		return "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+	return verification.Username, nil
+}
+
+// returns an error if there is no email to verify
+func checkVerifiable(u User) error {
+	if u.Email == "" {
+		return spellbook.NewFieldError("email", spellbook.ErrMissingField)
+	}
+	if u.IsEmailVerified() {
+		return spellbook.NewConflictError(fmt.Sprintf("the email of user %s is already verified", u.Username()))
+	}
+	return nil
+}
+
+// stores a new token of the user for the action, replacing the previous ones, and returns its clear value
+func issueActionToken(ctx context.Context, u User, action string, duration time.Duration) (string, *ActionToken, error) {
+	var previous []*ActionToken
+	q := model.NewQuery(&ActionToken{}).WithField("Username =", u.Username()).WithField("Action =", action)
+	if err := q.GetAll(ctx, &previous); err != nil {
+		return "", nil, fmt.Errorf("error retrieving the %s tokens of user %s: %s", action, u.Username(), err.Error())
+	}
+	for _, p := range previous {
+		if err := model.Delete(ctx, p, nil); err != nil {
+			return "", nil, fmt.Errorf("error deleting a %s token of user %s: %s", action, u.Username(), err.Error())
+		}
+	}
+
+	token, tkn, err := newActionToken(u, action, duration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(token.Id())
+	if err := model.CreateWithOptions(ctx, token, &opts); err != nil {
+		return "", nil, fmt.Errorf("error saving the %s token of user %s: %s", action, u.Username(), err.Error())
+	}
+
+	return tkn, token, nil
+}
+
+// returns the stored token. Tokens of other actions and expired tokens don't exist
+func actionTokenFromId(ctx context.Context, id string, action string) (*ActionToken, error) {
+	token := ActionToken{}
+	if err := model.FromStringID(ctx, &token, HashToken(id), nil); err != nil {
+		return nil, err
+	}
+	if !token.valid(action, time.Now().UTC()) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return &token, nil
+}
+
+// closes every session of the user
+func closeSessions(ctx context.Context, username string) error {
+	var sessions []*Session
+	q := model.NewQuery(&Session{}).WithField("Username =", username)
+	if err := q.GetAll(ctx, &sessions); err != nil {
+		return fmt.Errorf("error retrieving the sessions of user %s: %s", username, err.Error())
+	}
+	for _, session := range sessions {
+		if err := model.Delete(ctx, session, nil); err != nil {
+			return fmt.Errorf("error closing session %s: %s", session.Id(), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package identity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The resources below return credentials to their caller: their writes are audited without them.
+// See spellbook.AuditRepresenter
+
+// Id returns the access token, a credential: the audit log records the session the token belongs to instead
+func (token *Token) AuditId() string {
+	return token.Session
+}
+
+func (token *Token) AuditRepresentation() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username        string    `json:"username"`
+		Expires         time.Time `json:"expires"`
+		Session         string    `json:"session"`
+		EnrollTwoFactor bool      `json:"enrollTwoFactor,omitempty"`
+	}{
+		Username:        token.Username,
+		Expires:         token.Expires,
+		Session:         token.Session,
+		EnrollTwoFactor: token.EnrollTwoFactor,
+	})
+}
+
+func (impersonation *Impersonation) AuditId() string {
+	return impersonation.Id()
+}
+
+func (impersonation *Impersonation) AuditRepresentation() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username     string    `json:"username"`
+		Impersonator string    `json:"impersonator"`
+		Expires      time.Time `json:"expires"`
+		Session      string    `json:"session"`
+	}{
+		Username:     impersonation.Username,
+		Impersonator: impersonation.Impersonator,
+		Expires:      impersonation.token.Expires,
+		Session:      impersonation.token.Session,
+	})
+}
+
+func (tf *TwoFactor) AuditId() string {
+	return tf.Id()
+}
+
+func (tf *TwoFactor) AuditRepresentation() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username string `json:"username"`
+		Enabled  bool   `json:"enabled"`
+		Required bool   `json:"required"`
+	}{
+		Username: tf.Username,
+		Enabled:  tf.Enabled,
+		Required: tf.Required,
+	})
+}
+
+func (sa *ServiceAccount) AuditId() string {
+	return sa.Id()
+}
+
+func (sa *ServiceAccount) AuditRepresentation() ([]byte, error) {
+	token := sa.Token
+	sa.Token = ""
+	defer func() { sa.Token = token }()
+	return json.Marshal(sa)
+}
+
+func (key *ServiceAccountKey) AuditId() string {
+	return key.Id()
+}
+
+func (key *ServiceAccountKey) AuditRepresentation() ([]byte, error) {
+	token := key.token
+	key.token = ""
+	defer func() { key.token = token }()
+	return json.Marshal(key)
+}
+
+// the state of a login is only known to the client, and the completed login holds the tokens of the session
+func (login *OIDCLogin) AuditId() string {
+	if login.token != nil {
+		return login.token.AuditId()
+	}
+	return login.Provider
+}
+
+func (login *OIDCLogin) AuditRepresentation() ([]byte, error) {
+	if login.token != nil {
+		return login.token.AuditRepresentation()
+	}
+
+	return json.Marshal(&struct {
+		Provider string    `json:"provider"`
+		Expires  time.Time `json:"expires"`
+	}{
+		Provider: login.Provider,
+		Expires:  login.Expires,
+	})
+}
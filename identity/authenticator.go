@@ -4,8 +4,11 @@ import (
 	"context"
 	"decodica.com/flamel"
 	"decodica.com/spellbook"
+	"errors"
 	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
+	"time"
 )
 
 type UserAuthenticator struct {
@@ -16,24 +19,91 @@ func (authenticator UserAuthenticator) Authenticate(ctx context.Context) context
 	inputs := flamel.InputsFromContext(ctx)
 	if tkn, ok := inputs[spellbook.HeaderToken]; ok {
 		token := tkn.Value()
-		// grab the last chars after hashLength
-		encoded := token[hashLen:]
-		u := User{}
-		err := model.FromEncodedKey(ctx, &u, encoded)
-		if err != nil || u.Token != token {
+		if _, ok := sessionIdFromToken(token); ok {
+			u, session, err := userFromSession(ctx, token)
+			if err != nil || !u.IsEnabled() {
+				return ctx
+			}
+			grantRoles(ctx, &u)
+			u.applyTwoFactor(session)
+			if err := impersonate(ctx, &u, session); err != nil {
+				log.Warningf(ctx, "invalid impersonation of user %s: %s", u.Username(), err.Error())
+				return ctx
+			}
+			ctx = contextWithSession(ctx, session)
+			return spellbook.ContextWithIdentity(ctx, u)
+		}
+
+		// tokens issued before sessions: they are accepted until they expire or the user logs out
+		u, err := userFromToken(ctx, token)
+		if err != nil {
+			return ctx
+		}
+
+		ok, legacy := MatchToken(token, u.Token)
+		if !ok {
 			return ctx
 		}
 
+		expired, started := u.legacyTokenExpired(time.Now().UTC())
+		if expired {
+			log.Debugf(ctx, "the token of user %s expired on %s", u.StringID(), u.TokenExpires)
+			return ctx
+		}
+
+		// migrates the plaintext token to its hash
+		if legacy {
+			u.setToken(token)
+		}
+		if legacy || started {
+			if err := model.Update(ctx, &u); err != nil {
+				log.Errorf(ctx, "error updating the token of user %s: %s", u.StringID(), err.Error())
+			}
+		}
+
 		if !u.IsEnabled() {
 			return ctx
 		}
 
+		grantRoles(ctx, &u)
+		u.applyTwoFactor(nil)
 		return spellbook.ContextWithIdentity(ctx, u)
 	}
 
 	return ctx
 }
 
+// retrieves the user from the encoded key that follows the random part of the token.
+// The random part of legacy tokens is shorter
+func userFromToken(ctx context.Context, token string) (User, error) {
+	u := User{}
+	var err error
+	for _, l := range []int{tokenLen, hashLen} {
+		if len(token) <= l {
+			continue
+		}
+		if err = model.FromEncodedKey(ctx, &u, token[l:]); err == nil {
+			return u, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("invalid token")
+	}
+	return u, err
+}
+
+// grants the user the permissions of its roles and groups.
+// If they can't be resolved the user is authenticated with its own permissions only
+func grantRoles(ctx context.Context, u *User) {
+	roles, err := loadRoles(ctx, u.Roles, u.Groups)
+	if err != nil {
+		log.Errorf(ctx, "error resolving the roles of user %s: %s", u.Username(), err.Error())
+		return
+	}
+	u.effective = rolesPermission(roles)
+	u.twoFactorRole = rolesRequireTwoFactor(roles)
+}
+
 type GSupportAuthenticator struct {
 	flamel.Authenticator
 }
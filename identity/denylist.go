@@ -0,0 +1,58 @@
+package identity
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenDenyList keeps the sessions whose signed access tokens are revoked before they expire.
+// Entries are only needed until the last token of the session expires, so the list stays small
+type TokenDenyList interface {
+	// revokes the tokens of the session until the time, when the last of them expires
+	Deny(ctx context.Context, id string, until time.Time) error
+	Denied(ctx context.Context, id string) (bool, error)
+}
+
+// the time after which the other instances apply a revocation made with the DefaultTokenDenyList
+const TokenDenyListRefresh = 10 * time.Second
+
+// the deny-list of the signed access tokens, shared between instances through the denied_sessions table,
+// as signed access tokens are only issued by the sql managers. Signed access tokens are not issued without a deny-list
+var DefaultTokenDenyList TokenDenyList = NewSqlTokenDenyList(TokenDenyListRefresh)
+
+// MemoryTokenDenyList keeps the revoked sessions in memory. Entries are not shared between instances:
+// a session closed on an instance keeps its access tokens valid on the others until they expire.
+// Use it only with a single instance
+type MemoryTokenDenyList struct {
+	mu     sync.RWMutex
+	denied map[string]time.Time
+}
+
+func NewMemoryTokenDenyList() *MemoryTokenDenyList {
+	return &MemoryTokenDenyList{denied: make(map[string]time.Time)}
+}
+
+// expired entries are pruned on every revocation
+func (list *MemoryTokenDenyList) Deny(ctx context.Context, id string, until time.Time) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now()
+	for k, u := range list.denied {
+		if !now.Before(u) {
+			delete(list.denied, k)
+		}
+	}
+	if until.After(list.denied[id]) {
+		list.denied[id] = until
+	}
+	return nil
+}
+
+func (list *MemoryTokenDenyList) Denied(ctx context.Context, id string) (bool, error) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	until, ok := list.denied[id]
+	return ok && time.Now().Before(until), nil
+}
@@ -0,0 +1,126 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the lifetime of an impersonation. Impersonation sessions can't be refreshed
+var ImpersonationDuration = time.Hour
+
+// returns the user acting on behalf of the user, nil if the user is not impersonated
+func (user User) Impersonator() spellbook.Identity {
+	if user.impersonator == nil {
+		return nil
+	}
+	return *user.impersonator
+}
+
+// Returns a PermissionError if the actor can't impersonate the target.
+// The actor needs PermissionImpersonate and every permission of the target, and can't be impersonating itself
+func checkImpersonation(ctx context.Context, actor spellbook.Identity, target *User) error {
+	if actor == nil || !actor.HasPermission(spellbook.PermissionImpersonate) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionImpersonate))
+	}
+	// impersonations can't be chained
+	if spellbook.ImpersonatorFromContext(ctx) != nil {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionImpersonate))
+	}
+	if actor.Username() == target.Username() {
+		return spellbook.NewFieldError("username", errors.New("users can't impersonate themselves"))
+	}
+	if !target.IsEnabled() {
+		return spellbook.NewFieldError("username", fmt.Errorf("user %s is not enabled", target.Username()))
+	}
+	return checkImpersonable(actor, target)
+}
+
+// users with more permissions than the actor can't be impersonated
+func checkImpersonable(actor spellbook.Identity, target *User) error {
+	for _, name := range target.Permissions() {
+		if !actor.HasPermission(spellbook.Permission(name)) {
+			return spellbook.NewPermissionError(name)
+		}
+	}
+	return nil
+}
+
+// Returns a new session of the target acting as the actor, which expires after ImpersonationDuration.
+// The actor authenticated with a second factor to be granted PermissionImpersonate, so the session counts as
+// authenticated with it. The session must be stored by the caller
+func newImpersonationSession(ctx context.Context, actor spellbook.Identity, target *User) (*Session, error) {
+	session, err := NewSession(ctx, target.Username())
+	if err != nil {
+		return nil, err
+	}
+	session.Impersonator = actor.Username()
+	session.SecondFactor = true
+	session.AccessExpires = session.Created.Add(ImpersonationDuration)
+	session.Expires = session.AccessExpires
+	return session, nil
+}
+
+// Impersonation is a time-limited access token of a user, used by the actor to act on its behalf.
+// Everything the actor does with the token is authorized as the user, and is recorded with both usernames
+type Impersonation struct {
+	Username     string `validate:"required"`
+	Impersonator string
+	token        Token
+}
+
+func (impersonation *Impersonation) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Username string `json:"username"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	impersonation.Username = alias.Username
+	return nil
+}
+
+func (impersonation *Impersonation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username     string    `json:"username"`
+		Impersonator string    `json:"impersonator"`
+		AccessToken  string    `json:"accessToken"`
+		Expires      time.Time `json:"expires"`
+		Session      string    `json:"session"`
+	}{
+		Username:     impersonation.Username,
+		Impersonator: impersonation.Impersonator,
+		AccessToken:  impersonation.token.Value,
+		Expires:      impersonation.token.Expires,
+		Session:      impersonation.token.Session,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (impersonation *Impersonation) Id() string {
+	return impersonation.token.Session
+}
+
+func (impersonation *Impersonation) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, impersonation)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (impersonation *Impersonation) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(impersonation)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,112 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+)
+
+func NewImpersonationController() *spellbook.RestController {
+	return NewImpersonationControllerWithKey("")
+}
+
+func NewImpersonationControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: ImpersonationManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// ImpersonationManager issues the access tokens of the impersonations.
+// POST with the username returns an access token of the user, valid for ImpersonationDuration.
+// Users with PermissionImpersonate can impersonate the users whose permissions they all have.
+// Impersonations end when they expire, or are revoked like any other session
+type ImpersonationManager struct{}
+
+func (manager ImpersonationManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Impersonation{}, nil
+}
+
+func (manager ImpersonationManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager ImpersonationManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager ImpersonationManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager ImpersonationManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionImpersonate) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionImpersonate))
+	}
+
+	impersonation := res.(*Impersonation)
+	if err := spellbook.ValidateStruct(impersonation); err != nil {
+		return err
+	}
+
+	target := User{}
+	if err := model.FromStringID(ctx, &target, impersonation.Username, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve user %s: %s", impersonation.Username, err.Error())
+		return err
+	}
+	grantRoles(ctx, &target)
+
+	if err := checkImpersonation(ctx, current, &target); err != nil {
+		return err
+	}
+
+	session, err := newImpersonationSession(ctx, current, &target)
+	if err != nil {
+		return err
+	}
+	opts := model.CreateOptions{}
+	opts.WithStringId(session.Id())
+	if err := model.CreateWithOptions(ctx, session, &opts); err != nil {
+		return fmt.Errorf("error saving the impersonation of user %s: %s", target.Username(), err.Error())
+	}
+
+	log.Infof(ctx, "user %s started impersonating user %s until %s", current.Username(), target.Username(), session.Expires)
+	impersonation.Impersonator = current.Username()
+	session.toToken(&impersonation.token)
+	return nil
+}
+
+func (manager ImpersonationManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager ImpersonationManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// sets the impersonator of the user of an impersonation session.
+// Fails if the impersonator can't impersonate the user anymore
+func impersonate(ctx context.Context, u *User, session *Session) error {
+	if session.Impersonator == "" {
+		return nil
+	}
+
+	actor := User{}
+	if err := model.FromStringID(ctx, &actor, session.Impersonator, nil); err != nil {
+		return err
+	}
+	grantRoles(ctx, &actor)
+	if !actor.IsEnabled() || !actor.HasPermission(spellbook.PermissionImpersonate) {
+		return spellbook.NewUnauthorizedError(fmt.Sprintf("user %s can't impersonate anymore", actor.Username()))
+	}
+	if err := checkImpersonable(actor, u); err != nil {
+		return err
+	}
+
+	u.impersonator = &actor
+	return nil
+}
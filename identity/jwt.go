@@ -0,0 +1,197 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var errInvalidJWT = errors.New("invalid jwt")
+
+// the header of a json web token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// a json web token split into its parts. The signature is not verified
+type jwt struct {
+	header  jwtHeader
+	payload []byte
+	// the header and the payload, as signed
+	signed    string
+	signature []byte
+}
+
+// splits the compact serialization of a token and decodes its parts
+func parseJWT(raw string) (*jwt, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	token := jwt{signed: parts[0] + "." + parts[1]}
+	if err := json.Unmarshal(h, &token.header); err != nil {
+		return nil, errInvalidJWT
+	}
+	if token.payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errInvalidJWT
+	}
+	if token.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errInvalidJWT
+	}
+	return &token, nil
+}
+
+// returns the hash of an asymmetric algorithm, 0 if the algorithm is not supported
+func jwtHash(alg string) crypto.Hash {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256
+	case "RS384", "ES384":
+		return crypto.SHA384
+	case "RS512", "ES512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// verifies the signature of the token with a public key.
+// Only the asymmetric algorithms are accepted: "none" and the hmac ones are rejected
+func (token *jwt) verifyPublic(key crypto.PublicKey) error {
+	hash := jwtHash(token.header.Alg)
+	if hash == 0 {
+		return fmt.Errorf("unsupported jwt algorithm %q", token.header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(token.signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(token.header.Alg, "RS") {
+			return fmt.Errorf("algorithm %s doesn't match an rsa key", token.header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, token.signature); err != nil {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(token.header.Alg, "ES") {
+			return fmt.Errorf("algorithm %s doesn't match an ec key", token.header.Alg)
+		}
+		// the signature is r and s, each as long as the key
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(token.signature) != 2*size {
+			return errors.New("invalid jwt signature")
+		}
+		r := new(big.Int).SetBytes(token.signature[:size])
+		s := new(big.Int).SetBytes(token.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// a json web key, as published in a jwks document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// returns the signing keys of a jwks document by their id.
+// Keys of unsupported types or meant for encryption are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %s", err.Error())
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the key is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
@@ -0,0 +1,187 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// the algorithms of the access tokens
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmEdDSA = "EdDSA"
+)
+
+// the shortest secret accepted for HS256: as long as the hash
+const jwtMinSecretLen = 32
+
+// JWTKey is a key of a JWTKeySet. HS256 keys sign and verify with the secret,
+// EdDSA keys sign with the private key and verify with the public one. Keys that only verify need no private key
+type JWTKey struct {
+	Id         string
+	Algorithm  string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// Returns an HS256 key. The secret must be at least 32 bytes long
+func NewHS256Key(id string, secret []byte) JWTKey {
+	return JWTKey{Id: id, Algorithm: JWTAlgorithmHS256, Secret: secret}
+}
+
+// Returns an EdDSA key that signs with the private key
+func NewEdDSAKey(id string, private ed25519.PrivateKey) JWTKey {
+	return JWTKey{Id: id, Algorithm: JWTAlgorithmEdDSA, PrivateKey: private, PublicKey: private.Public().(ed25519.PublicKey)}
+}
+
+func (key JWTKey) signature(signed string) ([]byte, error) {
+	switch key.Algorithm {
+	case JWTAlgorithmHS256:
+		if len(key.Secret) < jwtMinSecretLen {
+			return nil, fmt.Errorf("the secret of jwt key %s is shorter than %d bytes", key.Id, jwtMinSecretLen)
+		}
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil), nil
+	case JWTAlgorithmEdDSA:
+		if len(key.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("jwt key %s has no private key", key.Id)
+		}
+		return ed25519.Sign(key.PrivateKey, []byte(signed)), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s of jwt key %s", key.Algorithm, key.Id)
+}
+
+// verifies the signature of the token. The algorithm of the token must be the one of the key
+func (key JWTKey) verify(token *jwt) error {
+	if token.header.Alg != key.Algorithm {
+		return fmt.Errorf("algorithm %s doesn't match jwt key %s", token.header.Alg, key.Id)
+	}
+
+	switch key.Algorithm {
+	case JWTAlgorithmHS256:
+		if len(key.Secret) < jwtMinSecretLen {
+			return errInvalidJWT
+		}
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(token.signed))
+		if !hmac.Equal(mac.Sum(nil), token.signature) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	case JWTAlgorithmEdDSA:
+		if len(key.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(key.PublicKey, []byte(token.signed), token.signature) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s of jwt key %s", key.Algorithm, key.Id)
+}
+
+// JWTKeySet signs the access tokens with one of its keys and verifies them with any of them.
+// Keys are rotated by adding the new key, making it the signing key once every instance knows it,
+// and removing the old key once the tokens it signed have expired
+type JWTKeySet struct {
+	// the issuer of the tokens, checked on verification if not empty
+	Issuer string
+
+	mu      sync.RWMutex
+	signing string
+	keys    map[string]JWTKey
+}
+
+// Returns a key set that signs with the first key
+func NewJWTKeySet(keys ...JWTKey) *JWTKeySet {
+	set := &JWTKeySet{keys: make(map[string]JWTKey)}
+	for _, key := range keys {
+		set.Add(key)
+	}
+	if len(keys) > 0 {
+		set.signing = keys[0].Id
+	}
+	return set
+}
+
+// adds a key, or replaces the key with the same id
+func (set *JWTKeySet) Add(key JWTKey) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.keys[key.Id] = key
+}
+
+// removes a key: the tokens it signed are no longer accepted
+func (set *JWTKeySet) Remove(id string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.keys, id)
+	if set.signing == id {
+		set.signing = ""
+	}
+}
+
+// makes the key sign the new tokens
+func (set *JWTKeySet) SetSigning(id string) error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if _, ok := set.keys[id]; !ok {
+		return fmt.Errorf("unknown jwt key %s", id)
+	}
+	set.signing = id
+	return nil
+}
+
+// returns a token of the claims, signed with the signing key
+func (set *JWTKeySet) sign(claims interface{}) (string, error) {
+	set.mu.RLock()
+	key, ok := set.keys[set.signing]
+	set.mu.RUnlock()
+	if !ok {
+		return "", errors.New("the jwt key set has no signing key")
+	}
+
+	header, err := json.Marshal(jwtHeader{Alg: key.Algorithm, Kid: key.Id, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := key.signature(signed)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifies the signature of the token with the key it names and decodes its claims into dst.
+// The claims themselves are checked by the caller
+func (set *JWTKeySet) verify(raw string, dst interface{}) error {
+	token, err := parseJWT(raw)
+	if err != nil {
+		return err
+	}
+
+	set.mu.RLock()
+	key, ok := set.keys[token.header.Kid]
+	set.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown jwt key %q", token.header.Kid)
+	}
+
+	if err := key.verify(token); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(token.payload, dst); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
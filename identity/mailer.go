@@ -0,0 +1,131 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain text message sent to a user, such as the link to reset the password
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender delivers the mails of the identity flows.
+// Applications plug their own delivery, such as an smtp relay or a mail api
+type MailSender interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// the sender of the password reset and email verification mails.
+// It must be set by the application: without a sender the flows fail
+var DefaultMailSender MailSender
+
+var ErrNoMailSender = errors.New("no mail sender configured")
+
+// sends the mail with the DefaultMailSender
+func sendMail(ctx context.Context, mail Mail) error {
+	if DefaultMailSender == nil {
+		return ErrNoMailSender
+	}
+	return DefaultMailSender.Send(ctx, mail)
+}
+
+// builds the mail that sends the password reset token to the user.
+// Applications replace it to send a link to their own reset page
+var NewPasswordResetMail = func(user User, token string, expires time.Time) Mail {
+	return Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nuse this code to choose a new password: %s\n\nThe code expires on %s. If you didn't ask to reset your password, ignore this mail.\n",
+			user.Username(), token, expires.Format(time.RFC1123)),
+	}
+}
+
+// builds the mail that sends the email verification token to the user.
+// Applications replace it to send a link to their own verification page
+var NewEmailVerificationMail = func(user User, token string, expires time.Time) Mail {
+	return Mail{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nuse this code to verify your email address: %s\n\nThe code expires on %s.\n",
+			user.Username(), token, expires.Format(time.RFC1123)),
+	}
+}
+
+// MemoryMailSender keeps the mails in memory instead of sending them. Meant for tests
+type MemoryMailSender struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func (sender *MemoryMailSender) Send(ctx context.Context, mail Mail) error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.mails = append(sender.mails, mail)
+	return nil
+}
+
+// returns the mails sent so far, in order
+func (sender *MemoryMailSender) Mails() []Mail {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return append([]Mail{}, sender.mails...)
+}
+
+// returns the last mail sent to the address. ok is false if none was sent
+func (sender *MemoryMailSender) Last(to string) (mail Mail, ok bool) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	for i := len(sender.mails) - 1; i >= 0; i-- {
+		if sender.mails[i].To == to {
+			return sender.mails[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+func (sender *MemoryMailSender) Reset() {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.mails = nil
+}
+
+// FileMailSender writes each mail to a file of the directory instead of sending it.
+// Meant for local development
+type FileMailSender struct {
+	Dir string
+}
+
+func (sender FileMailSender) Send(ctx context.Context, mail Mail) error {
+	if err := os.MkdirAll(sender.Dir, 0700); err != nil {
+		return fmt.Errorf("error creating the mail directory %s: %s", sender.Dir, err.Error())
+	}
+
+	suffix, err := randomString(6)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), suffix)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&sb, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	sb.WriteString(mail.Body)
+
+	path := filepath.Join(sender.Dir, name)
+	if err := ioutil.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		return fmt.Errorf("error writing mail %s: %s", path, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package identity
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"decodica.com/spellbook"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the tolerance on the times of the id tokens, for clocks that drift
+const oidcClockSkew = time.Minute
+
+// the keys of a provider are fetched again for an unknown key id at most once per interval
+const oidcKeysRefreshInterval = time.Minute
+
+// OIDCProvider is an OpenID Connect provider the users can log in with, such as Google or a company Keycloak.
+// Users log in with the authorization code flow with PKCE: see OIDCLoginManager
+type OIDCProvider struct {
+	// the name of the provider in the login requests
+	Name     string
+	Issuer   string
+	ClientID string
+	// empty for public clients, which rely on PKCE only
+	ClientSecret string
+	// the scopes requested besides openid. Defaults to email and profile
+	Scopes []string
+	// the addresses the provider can redirect the users back to. No address is accepted if empty
+	RedirectURIs []string
+	// the endpoints of the provider, discovered from the issuer if empty
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+	// the claim the username of the provisioned users is derived from.
+	// Defaults to preferred_username, then to the email
+	UsernameClaim string
+	// the permissions and the roles granted by the claims, keyed by "claim=value", such as "groups=admins"
+	// or "hd=example.com". Claims that are lists match each of their values.
+	// Claims can't enable a user: PermissionEnabled is only granted on provisioning
+	ClaimPermissions map[string][]spellbook.Permission
+	ClaimRoles       map[string][]string
+	// creates the users that log in for the first time
+	Provision bool
+	// links the first login to the user with the same email, if the provider verified it
+	LinkByEmail bool
+	// replaces the permissions and the roles of the user with the ones of its claims on every login.
+	// Otherwise the claims only grant them to the provisioned users
+	SyncPermissions bool
+	// trusts the amr claim of the provider: the users it authenticated with more than one factor
+	// skip the local second factor. The local second factor is always checked otherwise
+	TrustMultiFactor bool
+	// the client of the requests to the provider. Defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	discovered  bool
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// the registry of the providers
+var oidcProviders = struct {
+	sync.RWMutex
+	providers map[string]*OIDCProvider
+}{providers: make(map[string]*OIDCProvider)}
+
+// Registers a provider the users can log in with.
+// Providers should be registered at startup. It panics if the name is empty or already registered,
+// or if the provider can't redirect anywhere
+func RegisterOIDCProvider(provider *OIDCProvider) {
+	if provider.Name == "" || provider.Issuer == "" || provider.ClientID == "" {
+		panic("oidc providers need a name, an issuer and a client id")
+	}
+	if len(provider.RedirectURIs) == 0 {
+		panic(fmt.Sprintf("oidc provider %s needs the addresses it can redirect to", provider.Name))
+	}
+
+	oidcProviders.Lock()
+	defer oidcProviders.Unlock()
+	if _, ok := oidcProviders.providers[provider.Name]; ok {
+		panic(fmt.Sprintf("oidc provider %s is already registered", provider.Name))
+	}
+	oidcProviders.providers[provider.Name] = provider
+}
+
+func oidcProvider(name string) (*OIDCProvider, bool) {
+	oidcProviders.RLock()
+	defer oidcProviders.RUnlock()
+	provider, ok := oidcProviders.providers[name]
+	return provider, ok
+}
+
+func (provider *OIDCProvider) client() *http.Client {
+	if provider.HTTPClient != nil {
+		return provider.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// reports whether the provider can redirect the users to the address
+func (provider *OIDCProvider) allowsRedirect(uri string) bool {
+	for _, allowed := range provider.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// fills the endpoints that are not configured with the ones of the discovery document of the issuer
+func (provider *OIDCProvider) discover(ctx context.Context) error {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.discovered || (provider.AuthorizationEndpoint != "" && provider.TokenEndpoint != "" && provider.JWKSURI != "") {
+		return nil
+	}
+
+	doc := struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}{}
+	uri := strings.TrimSuffix(provider.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(ctx, uri, &doc); err != nil {
+		return err
+	}
+	if doc.Issuer != provider.Issuer {
+		return fmt.Errorf("the discovery document of %s is for issuer %s", provider.Issuer, doc.Issuer)
+	}
+
+	if provider.AuthorizationEndpoint == "" {
+		provider.AuthorizationEndpoint = doc.AuthorizationEndpoint
+	}
+	if provider.TokenEndpoint == "" {
+		provider.TokenEndpoint = doc.TokenEndpoint
+	}
+	if provider.JWKSURI == "" {
+		provider.JWKSURI = doc.JWKSURI
+	}
+	provider.discovered = true
+	return nil
+}
+
+func (provider *OIDCProvider) getJSON(ctx context.Context, uri string, dst interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	data, err := provider.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// sends the request and returns the body of a successful response
+func (provider *OIDCProvider) do(req *http.Request) ([]byte, error) {
+	res, err := provider.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s: %s", req.URL, err.Error())
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the response of %s: %s", req.URL, err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded %d: %s", req.URL, res.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+// returns the address the user is sent to, to log in with the provider
+func (provider *OIDCProvider) authorizationURL(ctx context.Context, state *OIDCState, clearState string) (string, error) {
+	if err := provider.discover(ctx); err != nil {
+		return "", err
+	}
+
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientID)
+	params.Set("redirect_uri", state.RedirectURI)
+	params.Set("scope", strings.Join(append([]string{"openid"}, scopes...), " "))
+	params.Set("state", clearState)
+	params.Set("nonce", state.Nonce)
+	params.Set("code_challenge", pkceChallenge(state.Verifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return provider.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchanges the authorization code for the tokens of the user and returns the id token
+func (provider *OIDCProvider) exchange(ctx context.Context, code string, state *OIDCState) (string, error) {
+	if err := provider.discover(ctx); err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", state.RedirectURI)
+	form.Set("client_id", provider.ClientID)
+	form.Set("code_verifier", state.Verifier)
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+	}
+
+	data, err := provider.do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	res := struct {
+		IdToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return "", fmt.Errorf("invalid token response of %s: %s", provider.Name, err.Error())
+	}
+	if res.IdToken == "" {
+		return "", fmt.Errorf("the token response of %s has no id token", provider.Name)
+	}
+	return res.IdToken, nil
+}
+
+// returns the key that signed a token. The keys are fetched again once if the key is unknown,
+// since providers rotate them
+func (provider *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if err := provider.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	if provider.keys == nil || time.Since(provider.keysFetched) >= oidcKeysRefreshInterval {
+		req, err := http.NewRequest(http.MethodGet, provider.JWKSURI, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := provider.do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		provider.keys = keys
+		provider.keysFetched = time.Now()
+	}
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	// a set with a single key can omit the key id
+	if kid == "" && len(provider.keys) == 1 {
+		for _, key := range provider.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q of provider %s", kid, provider.Name)
+}
+
+// verifies the signature and the claims of the id token issued for the login with the nonce
+func (provider *OIDCProvider) verify(ctx context.Context, raw string, nonce string, now time.Time) (OIDCClaims, error) {
+	token, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := provider.key(ctx, token.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.verifyPublic(key); err != nil {
+		return nil, err
+	}
+
+	claims := OIDCClaims{}
+	if err := json.Unmarshal(token.payload, &claims); err != nil {
+		return nil, errInvalidJWT
+	}
+
+	if claims.String("iss") != provider.Issuer {
+		return nil, fmt.Errorf("the id token is issued by %s", claims.String("iss"))
+	}
+	audience := claims.Values("aud")
+	if !containsString(audience, provider.ClientID) {
+		return nil, errors.New("the id token is not issued for the client")
+	}
+	if azp := claims.String("azp"); len(audience) > 1 && azp != provider.ClientID {
+		return nil, errors.New("the id token is authorized for another party")
+	}
+	exp, ok := claims.time("exp")
+	if !ok || !now.Before(exp.Add(oidcClockSkew)) {
+		return nil, errors.New("the id token is expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(oidcClockSkew).Before(nbf) {
+		return nil, errors.New("the id token is not valid yet")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("the nonce of the id token doesn't match the login")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("the id token has no subject")
+	}
+
+	return claims, nil
+}
+
+// returns the permissions and the roles granted by the claims
+func (provider *OIDCProvider) grants(claims OIDCClaims) (spellbook.PermissionSet, []string) {
+	var permissions spellbook.PermissionSet
+	var roles []string
+	for match, ps := range provider.ClaimPermissions {
+		if claims.matches(match) {
+			permissions = permissions.With(ps...)
+		}
+	}
+	for match, rs := range provider.ClaimRoles {
+		if claims.matches(match) {
+			for _, role := range rs {
+				if !containsString(roles, role) {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	return permissions.Without(spellbook.PermissionEnabled), roles
+}
+
+// OIDCClaims are the claims of a verified id token
+type OIDCClaims map[string]interface{}
+
+// returns the claim if it's a string
+func (claims OIDCClaims) String(name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// returns the values of the claim: the claim itself if it's a single value, its elements if it's a list
+func (claims OIDCClaims) Values(name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case bool, float64:
+		return []string{fmt.Sprint(v)}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+		return values
+	}
+	return nil
+}
+
+// reports whether the provider verified the email of the user
+func (claims OIDCClaims) EmailVerified() bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// reports whether the provider authenticated the user with more than one factor
+func (claims OIDCClaims) MultiFactor() bool {
+	return containsString(claims.Values("amr"), "mfa")
+}
+
+// reports whether the second factor the provider checked replaces the local one, see TrustMultiFactor
+func (provider *OIDCProvider) multiFactor(claims OIDCClaims) bool {
+	return provider.TrustMultiFactor && claims.MultiFactor()
+}
+
+// reports whether the claims match a "claim=value" key
+func (claims OIDCClaims) matches(match string) bool {
+	idx := strings.Index(match, "=")
+	if idx <= 0 {
+		return false
+	}
+	return containsString(claims.Values(match[:idx]), match[idx+1:])
+}
+
+// returns a numeric date claim
+func (claims OIDCClaims) time(name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// returns the code challenge of the verifier with the S256 method (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,340 @@
+package identity
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "spellbook"
+const testRedirectURI = "https://app.example.com/login"
+
+// stubIssuer is an OpenID Connect provider that serves the discovery document, the keys and the token endpoint.
+// The authorization endpoint is not served: authorize plays the user that logs in and comes back with the code
+type stubIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+	// signs the id tokens instead of key, when set
+	signer *rsa.PrivateKey
+	// the nonce of the id tokens instead of the one of the login, when set
+	nonce string
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &stubIssuer{key: key, kid: "key-1", codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (issuer *stubIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "stub",
+		Issuer:       issuer.URL,
+		ClientID:     testClientID,
+		RedirectURIs: []string{testRedirectURI},
+		HTTPClient:   issuer.Client(),
+	}
+}
+
+func (issuer *stubIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer.URL,
+		"authorization_endpoint": issuer.URL + "/authorize",
+		"token_endpoint":         issuer.URL + "/token",
+		"jwks_uri":               issuer.URL + "/jwks",
+	})
+}
+
+func (issuer *stubIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := issuer.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": issuer.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// logs the user in at the authorization url and returns the code the user comes back with
+func (issuer *stubIssuer) authorize(t *testing.T, uri string) string {
+	t.Helper()
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, issuer.URL+"/authorize?") {
+		t.Fatalf("the authorization url %s is not the one of the issuer", uri)
+	}
+
+	params := u.Query()
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURI,
+		"code_challenge_method": "S256",
+	}
+	for name, value := range expected {
+		if params.Get(name) != value {
+			t.Errorf("the %s of the authorization url is %q, expected %q", name, params.Get(name), value)
+		}
+	}
+	for _, name := range []string{"state", "nonce", "code_challenge"} {
+		if params.Get(name) == "" {
+			t.Errorf("the authorization url has no %s", name)
+		}
+	}
+	if scopes := strings.Fields(params.Get("scope")); !containsString(scopes, "openid") {
+		t.Errorf("the scopes %v don't include openid", scopes)
+	}
+
+	code, err := randomString(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.mu.Lock()
+	issuer.codes[code] = params
+	issuer.mu.Unlock()
+	return code
+}
+
+func (issuer *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	issuer.mu.Lock()
+	params, ok := issuer.codes[r.PostForm.Get("code")]
+	// codes are used once
+	delete(issuer.codes, r.PostForm.Get("code"))
+	issuer.mu.Unlock()
+
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("client_id") != params.Get("client_id") ||
+		r.PostForm.Get("redirect_uri") != params.Get("redirect_uri") {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	// PKCE: the verifier must be the one the challenge was derived from
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != params.Get("code_challenge") {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	nonce := params.Get("nonce")
+	if issuer.nonce != "" {
+		nonce = issuer.nonce
+	}
+	now := time.Now()
+	idToken, err := issuer.sign(map[string]interface{}{
+		"iss":   issuer.URL,
+		"sub":   "subject-1",
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+		"email": "user@example.com",
+		"amr":   []string{"pwd", "mfa"},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (issuer *stubIssuer) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: issuer.kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	key := issuer.key
+	if issuer.signer != nil {
+		key = issuer.signer
+	}
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// starts a login with the provider and returns its state and the code of the user
+func startStubLogin(t *testing.T, issuer *stubIssuer, provider *OIDCProvider) (*OIDCState, string) {
+	t.Helper()
+	state, tkn, err := newOIDCState(provider.Name, testRedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := provider.authorizationURL(context.Background(), state, tkn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := url.Parse(uri); u.Query().Get("state") != tkn || u.Query().Get("nonce") != state.Nonce {
+		t.Errorf("the authorization url %s doesn't carry the state and the nonce of the login", uri)
+	}
+	return state, issuer.authorize(t, uri)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newStubIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	state, code := startStubLogin(t, issuer, provider)
+	raw, err := provider.exchange(ctx, code, state)
+	if err != nil {
+		t.Fatalf("the code should be exchanged: %s", err.Error())
+	}
+	claims, err := provider.verify(ctx, raw, state.Nonce, time.Now())
+	if err != nil {
+		t.Fatalf("the id token should be valid: %s", err.Error())
+	}
+	if claims.String("sub") != "subject-1" || claims.String("email") != "user@example.com" {
+		t.Errorf("unexpected claims %v", claims)
+	}
+
+	// the code can't be exchanged twice
+	if _, err := provider.exchange(ctx, code, state); err == nil {
+		t.Error("a used code should be rejected")
+	}
+}
+
+func TestOIDCLoginPKCE(t *testing.T) {
+	issuer := newStubIssuer(t)
+	provider := issuer.provider()
+
+	state, code := startStubLogin(t, issuer, provider)
+	// the code was intercepted and is exchanged by who doesn't know the verifier
+	other := *state
+	other.Verifier = "not-the-verifier"
+	if _, err := provider.exchange(context.Background(), code, &other); err == nil {
+		t.Error("the code should be rejected without the verifier of the login")
+	}
+}
+
+func TestOIDCLoginNonce(t *testing.T) {
+	issuer := newStubIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	// the id token of another login is replayed
+	issuer.nonce = "another-login"
+	state, code := startStubLogin(t, issuer, provider)
+	raw, err := provider.exchange(ctx, code, state)
+	if err != nil {
+		t.Fatalf("the code should be exchanged: %s", err.Error())
+	}
+	if _, err := provider.verify(ctx, raw, state.Nonce, time.Now()); err == nil {
+		t.Error("an id token with the nonce of another login should be rejected")
+	}
+}
+
+func TestOIDCLoginSignature(t *testing.T) {
+	issuer := newStubIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	// the id token is signed with a key the issuer doesn't publish, under the id of the published one
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.signer = signer
+	state, code := startStubLogin(t, issuer, provider)
+	raw, err := provider.exchange(ctx, code, state)
+	if err != nil {
+		t.Fatalf("the code should be exchanged: %s", err.Error())
+	}
+	if _, err := provider.verify(ctx, raw, state.Nonce, time.Now()); err == nil {
+		t.Error("an id token signed with an unknown key should be rejected")
+	}
+
+	// a valid id token whose claims are changed
+	issuer.signer = nil
+	state, code = startStubLogin(t, issuer, provider)
+	raw, err = provider.exchange(ctx, code, state)
+	if err != nil {
+		t.Fatalf("the code should be exchanged: %s", err.Error())
+	}
+	parts := strings.Split(raw, ".")
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":   issuer.URL,
+		"sub":   "admin",
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": state.Nonce,
+	})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	if _, err := provider.verify(ctx, tampered, state.Nonce, time.Now()); err == nil {
+		t.Error("an id token with changed claims should be rejected")
+	}
+	if _, err := provider.verify(ctx, raw, state.Nonce, time.Now()); err != nil {
+		t.Errorf("the id token should be valid: %s", err.Error())
+	}
+}
+
+func TestOIDCProviderRedirect(t *testing.T) {
+	provider := OIDCProvider{RedirectURIs: []string{testRedirectURI}}
+	if !provider.allowsRedirect(testRedirectURI) {
+		t.Errorf("%s should be allowed", testRedirectURI)
+	}
+	if provider.allowsRedirect("https://evil.example.com/login") {
+		t.Error("an address that is not listed should be denied")
+	}
+	if (&OIDCProvider{}).allowsRedirect(testRedirectURI) {
+		t.Error("a provider without redirect uris should deny every address")
+	}
+}
+
+func TestOIDCProviderMultiFactor(t *testing.T) {
+	claims := OIDCClaims{"amr": []interface{}{"pwd", "mfa"}}
+	if (&OIDCProvider{}).multiFactor(claims) {
+		t.Error("the amr claim should be ignored unless the provider is trusted")
+	}
+	if !(&OIDCProvider{TrustMultiFactor: true}).multiFactor(claims) {
+		t.Error("the amr claim of a trusted provider should replace the local second factor")
+	}
+	if (&OIDCProvider{TrustMultiFactor: true}).multiFactor(OIDCClaims{"amr": "pwd"}) {
+		t.Error("a single factor should not replace the local second factor")
+	}
+}
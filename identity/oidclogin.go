@@ -0,0 +1,295 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"encoding/json"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the time a user has to log in with the provider once the login is started
+var OIDCLoginDuration = 10 * time.Minute
+
+// OIDCState is a login with a provider waiting for the user to come back with the authorization code.
+// The state sent to the provider is a random token: only its hash is stored, and it's the id of the login.
+// It's deleted when the code is exchanged
+type OIDCState struct {
+	model.Model `json:"-"`
+	SqlHash     string `model:"-" gorm:"PRIMARY_KEY;column:hash"`
+	Provider    string `gorm:"NOT NULL"`
+	Nonce       string `gorm:"NOT NULL"`
+	// the PKCE code verifier
+	Verifier    string `gorm:"NOT NULL"`
+	RedirectURI string `gorm:"NOT NULL"`
+	Created     time.Time
+	Expires     time.Time
+	// the hash, while the state is not yet stored
+	hash string `model:"-" gorm:"-"`
+}
+
+// Returns a new login with the provider, and the clear state to send to the provider.
+// The state must be stored by the caller
+func newOIDCState(provider string, redirectURI string) (*OIDCState, string, error) {
+	tkn, err := NewRandomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return nil, "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	state := OIDCState{
+		SqlHash:     HashToken(tkn),
+		Provider:    provider,
+		Nonce:       nonce,
+		Verifier:    verifier,
+		RedirectURI: redirectURI,
+		Created:     now,
+		Expires:     now.Add(OIDCLoginDuration),
+	}
+	state.hash = state.SqlHash
+	return &state, tkn, nil
+}
+
+func (state *OIDCState) Id() string {
+	if state.EncodedKey() != "" {
+		return state.StringID()
+	}
+	if state.SqlHash != "" {
+		return state.SqlHash
+	}
+	return state.hash
+}
+
+// OIDCLogin is a login with an OpenID Connect provider.
+// It's started with the provider and the address the provider redirects the user to, and returns the
+// address of the provider the user must be sent to. It's completed, with the code the provider
+// appended to the redirect, at the state it returned, and then returns the tokens of the session
+// or the challenge of the second factor, like a Token
+type OIDCLogin struct {
+	Provider         string `validate:"required"`
+	RedirectURI      string `validate:"required,url=http|https"`
+	Code             string
+	State            string
+	AuthorizationURL string
+	Expires          time.Time
+	token            *Token
+	state            *OIDCState
+}
+
+func (login *OIDCLogin) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Provider    string `json:"provider"`
+		RedirectURI string `json:"redirectUri"`
+		Code        string `json:"code"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	login.Provider = alias.Provider
+	login.RedirectURI = alias.RedirectURI
+	login.Code = alias.Code
+	return nil
+}
+
+func (login *OIDCLogin) MarshalJSON() ([]byte, error) {
+	if login.token != nil {
+		return json.Marshal(login.token)
+	}
+
+	return json.Marshal(&struct {
+		Provider         string    `json:"provider"`
+		State            string    `json:"state"`
+		AuthorizationURL string    `json:"authorizationUrl"`
+		Expires          time.Time `json:"expires"`
+	}{
+		Provider:         login.Provider,
+		State:            login.State,
+		AuthorizationURL: login.AuthorizationURL,
+		Expires:          login.Expires,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (login *OIDCLogin) Id() string {
+	return login.State
+}
+
+func (login *OIDCLogin) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, login)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (login *OIDCLogin) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(login)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// validates the start of the login and returns its provider and its state, which must be stored by the caller
+func startOIDCLogin(ctx context.Context, login *OIDCLogin) (*OIDCProvider, *OIDCState, error) {
+	if err := spellbook.ValidateStruct(login); err != nil {
+		return nil, nil, err
+	}
+
+	provider, ok := oidcProvider(login.Provider)
+	if !ok {
+		return nil, nil, spellbook.NewFieldError("provider", fmt.Errorf("unknown provider %s", login.Provider))
+	}
+	if !provider.allowsRedirect(login.RedirectURI) {
+		return nil, nil, spellbook.NewFieldError("redirectUri", fmt.Errorf("provider %s can't redirect to %s", provider.Name, login.RedirectURI))
+	}
+
+	state, tkn, err := newOIDCState(provider.Name, login.RedirectURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	uri, err := provider.authorizationURL(ctx, state, tkn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting a login with provider %s: %s", provider.Name, err.Error())
+	}
+
+	login.State = tkn
+	login.AuthorizationURL = uri
+	login.Expires = state.Expires
+	return provider, state, nil
+}
+
+// returns the authorization code of the completion of a login
+func oidcCode(bundle []byte) (string, error) {
+	other := OIDCLogin{}
+	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return "", spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+	if other.Code == "" {
+		return "", spellbook.NewFieldError("code", spellbook.ErrMissingField)
+	}
+	return other.Code, nil
+}
+
+// exchanges the code of the login and returns the verified claims of the user.
+// The reason of a failure is logged: the client only learns that the login failed
+func completeOIDCLogin(ctx context.Context, state *OIDCState, code string) (*OIDCProvider, OIDCClaims, error) {
+	provider, ok := oidcProvider(state.Provider)
+	if !ok {
+		return nil, nil, spellbook.NewUnauthorizedError(fmt.Sprintf("unknown provider %s", state.Provider))
+	}
+
+	raw, err := provider.exchange(ctx, code, state)
+	if err != nil {
+		log.Errorf(ctx, "error exchanging the code of provider %s: %s", provider.Name, err.Error())
+		return nil, nil, spellbook.NewUnauthorizedError(fmt.Sprintf("the login with %s failed", provider.Name))
+	}
+
+	claims, err := provider.verify(ctx, raw, state.Nonce, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "invalid id token of provider %s: %s", provider.Name, err.Error())
+		return nil, nil, spellbook.NewUnauthorizedError(fmt.Sprintf("the login with %s failed", provider.Name))
+	}
+	return provider, claims, nil
+}
+
+// returns a new user for the claims of the provider. The username is chosen by the caller
+func newOIDCUser(provider *OIDCProvider, claims OIDCClaims) User {
+	u := User{
+		Name:        claims.String("given_name"),
+		Surname:     claims.String("family_name"),
+		Email:       claims.String("email"),
+		Locale:      claims.String("locale"),
+		OIDCIssuer:  provider.Issuer,
+		OIDCSubject: claims.String("sub"),
+	}
+	if u.Email != "" && claims.EmailVerified() {
+		u.EmailVerified = time.Now().UTC()
+	}
+
+	permissions, roles := provider.grants(claims)
+	u.SetPermissions(permissions.With(spellbook.PermissionEnabled))
+	u.Roles = roles
+	return u
+}
+
+// replaces the permissions and the roles of the user with the ones of the claims, if the provider
+// syncs them. The user keeps its enabled state. It reports whether the user changed
+func syncOIDCUser(provider *OIDCProvider, claims OIDCClaims, u *User) bool {
+	if !provider.SyncPermissions {
+		return false
+	}
+
+	permissions, roles := provider.grants(claims)
+	if u.IsEnabled() {
+		permissions = permissions.With(spellbook.PermissionEnabled)
+	}
+	u.SetPermissions(permissions)
+	u.Roles = roles
+	return true
+}
+
+// returns the first username derived from the claims that doesn't exist yet
+func oidcUsername(provider *OIDCProvider, claims OIDCClaims, exists func(username string) (bool, error)) (string, error) {
+	source := ""
+	if provider.UsernameClaim != "" {
+		source = claims.String(provider.UsernameClaim)
+	}
+	if source == "" {
+		source = claims.String("preferred_username")
+	}
+	if source == "" {
+		source = strings.SplitN(claims.String("email"), "@", 2)[0]
+	}
+
+	// keeps the characters SanitizeUserName accepts, with room for a suffix
+	base := strings.Map(func(c rune) rune {
+		if unicode.IsLetter(c) || unicode.IsNumber(c) || c == '.' || c == '_' {
+			return unicode.ToLower(c)
+		}
+		return -1
+	}, source)
+	for len(base) > UsernameMaxLen-4 {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	for len(base) < UsernameMinLen {
+		base += "_"
+	}
+
+	for i := 1; i < 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+		if SanitizeUserName(username) != username {
+			break
+		}
+		found, err := exists(username)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return username, nil
+		}
+	}
+	return "", spellbook.NewConflictError(fmt.Sprintf("no username is available for %s", source))
+}
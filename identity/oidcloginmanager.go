@@ -0,0 +1,187 @@
+package identity
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+func NewOIDCLoginController() *spellbook.RestController {
+	return NewOIDCLoginControllerWithKey("")
+}
+
+func NewOIDCLoginControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: OIDCLoginManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// OIDCLoginManager logs the users in with the registered OpenID Connect providers.
+// POST starts the login and returns the address of the provider and the state,
+// PUT at the state with the code returned by the provider opens the session.
+// Users are found by their account of the provider, then by verified email if the provider links them,
+// and are created if the provider provisions them
+type OIDCLoginManager struct{}
+
+func (manager OIDCLoginManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &OIDCLogin{}, nil
+}
+
+// returns the login waiting for the code. Expired logins don't exist
+func (manager OIDCLoginManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	state := OIDCState{}
+	if err := model.FromStringID(ctx, &state, HashToken(id), nil); err != nil {
+		return nil, err
+	}
+	if !time.Now().UTC().Before(state.Expires) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return &OIDCLogin{Provider: state.Provider, RedirectURI: state.RedirectURI, State: id, state: &state}, nil
+}
+
+func (manager OIDCLoginManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager OIDCLoginManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager OIDCLoginManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	login := res.(*OIDCLogin)
+	provider, state, err := startOIDCLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(state.Id())
+	if err := model.CreateWithOptions(ctx, state, &opts); err != nil {
+		return fmt.Errorf("error saving a login with provider %s: %s", provider.Name, err.Error())
+	}
+	return nil
+}
+
+// exchanges the code for the id token of the user and opens its session
+func (manager OIDCLoginManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	login := res.(*OIDCLogin)
+	code, err := oidcCode(bundle)
+	if err != nil {
+		return err
+	}
+
+	// the state is spent before the code is exchanged, so that it can't be replayed
+	if err := model.Delete(ctx, login.state, nil); err != nil {
+		return fmt.Errorf("error deleting a login with provider %s: %s", login.Provider, err.Error())
+	}
+
+	provider, claims, err := completeOIDCLogin(ctx, login.state, code)
+	if err != nil {
+		return err
+	}
+
+	u, err := oidcUser(ctx, provider, claims)
+	if err != nil {
+		return err
+	}
+	if !u.IsEnabled() {
+		return spellbook.NewUnauthorizedError(fmt.Sprintf("user %s is not enabled", u.Username()))
+	}
+
+	login.token = &Token{}
+	// the second factor of the user is checked, unless the provider already did and it's trusted to
+	mfa := provider.multiFactor(claims)
+	if u.TOTPEnabled && !mfa {
+		tkn, challenge, err := issueActionToken(ctx, *u, ActionTwoFactorChallenge, TwoFactorChallengeDuration)
+		if err != nil {
+			return err
+		}
+		login.token.Challenge = tkn
+		login.token.Expires = challenge.Expires
+		return nil
+	}
+
+	grantRoles(ctx, u)
+	login.token.EnrollTwoFactor = u.RequiresTwoFactor() && !mfa
+	return openSession(ctx, *u, login.token, mfa)
+}
+
+func (manager OIDCLoginManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// returns the user of the account of the provider, linking or creating it if the provider allows it
+func oidcUser(ctx context.Context, provider *OIDCProvider, claims OIDCClaims) (*User, error) {
+	var users []*User
+	q := model.NewQuery(&User{}).WithField("OIDCIssuer =", provider.Issuer).WithField("OIDCSubject =", claims.String("sub")).Limit(1)
+	if err := q.GetAll(ctx, &users); err != nil {
+		return nil, fmt.Errorf("error retrieving the user of %s: %s", claims.String("sub"), err.Error())
+	}
+	if len(users) == 1 {
+		u := users[0]
+		if syncOIDCUser(provider, claims, u) {
+			if err := model.Update(ctx, u); err != nil {
+				return nil, fmt.Errorf("error updating the permissions of user %s: %s", u.Username(), err.Error())
+			}
+		}
+		return u, nil
+	}
+
+	email := claims.String("email")
+	if provider.LinkByEmail && email != "" && claims.EmailVerified() {
+		users = nil
+		q := model.NewQuery(&User{}).WithField("Email =", email).Limit(1)
+		if err := q.GetAll(ctx, &users); err != nil {
+			return nil, fmt.Errorf("error retrieving the users with email %s: %s", email, err.Error())
+		}
+		// users already linked to another account are not linked again
+		if len(users) == 1 && users[0].OIDCSubject == "" {
+			u := users[0]
+			u.OIDCIssuer = provider.Issuer
+			u.OIDCSubject = claims.String("sub")
+			if u.EmailVerified.IsZero() {
+				u.EmailVerified = time.Now().UTC()
+			}
+			syncOIDCUser(provider, claims, u)
+			if err := model.Update(ctx, u); err != nil {
+				return nil, fmt.Errorf("error linking user %s to provider %s: %s", u.Username(), provider.Name, err.Error())
+			}
+			log.Infof(ctx, "linked user %s to provider %s", u.Username(), provider.Name)
+			return u, nil
+		}
+	}
+
+	if !provider.Provision {
+		return nil, spellbook.NewUnauthorizedError(fmt.Sprintf("no user is linked to this account of %s", provider.Name))
+	}
+
+	u := newOIDCUser(provider, claims)
+	if u.Email != "" {
+		if err := checkEmail(ctx, "", u.Email); err != nil {
+			return nil, err
+		}
+	}
+	username, err := oidcUsername(provider, claims, func(username string) (bool, error) {
+		err := model.FromStringID(ctx, &User{}, username, nil)
+		if err == datastore.ErrNoSuchEntity {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(username)
+	if err := model.CreateWithOptions(ctx, &u, &opts); err != nil {
+		return nil, fmt.Errorf("error creating user %s: %s", username, err.Error())
+	}
+	log.Infof(ctx, "created user %s for provider %s", username, provider.Name)
+	return &u, nil
+}
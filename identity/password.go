@@ -0,0 +1,213 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"decodica.com/spellbook"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+// PasswordHasher hashes the passwords of the users.
+// The hashes are encoded with their salt and parameters, so that they can be verified
+// after the parameters of the hasher change
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// reports whether the encoded hash has been produced by the hasher
+	Recognizes(encoded string) bool
+	Verify(password string, encoded string) (bool, error)
+	// reports whether the encoded hash has been produced with parameters other than the current ones
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher hashes the new passwords
+var DefaultPasswordHasher PasswordHasher = NewArgon2idHasher()
+
+// PasswordHashers are the hashers that can verify the stored passwords, in addition to the default one.
+// Hashes produced by one of them are replaced with a hash of the default hasher on login
+var PasswordHashers = []PasswordHasher{NewArgon2idHasher(), NewBcryptHasher()}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// Returns the hash of the password produced by the default hasher
+func NewPasswordHash(password string) (string, error) {
+	return DefaultPasswordHasher.Hash(password)
+}
+
+// Checks the password against the stored hash.
+// Besides the hashes of the known hashers, verifies the legacy sha-256 hashes salted with Options.Salt.
+// rehash is true if the password matches but the hash should be replaced with a hash of the default hasher
+func VerifyPassword(password string, encoded string) (ok bool, rehash bool, err error) {
+	if DefaultPasswordHasher.Recognizes(encoded) {
+		ok, err = DefaultPasswordHasher.Verify(password, encoded)
+		return ok, ok && DefaultPasswordHasher.NeedsRehash(encoded), err
+	}
+
+	for _, hasher := range PasswordHashers {
+		if hasher.Recognizes(encoded) {
+			ok, err = hasher.Verify(password, encoded)
+			return ok, ok, err
+		}
+	}
+
+	salt := spellbook.Application().Options().Salt
+	ok = subtle.ConstantTimeCompare([]byte(HashPassword(password, salt)), []byte(encoded)) == 1
+	return ok, ok, nil
+}
+
+// a hash checked when the user doesn't exist, so that unknown users take as long as wrong passwords
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// verifies the password against a hash of the default hasher, and discards the result
+func verifyDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = NewPasswordHash("not a password")
+	})
+	_, _, _ = VerifyPassword(password, dummyHash)
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Argon2idHasher hashes the passwords with argon2id.
+// Hashes are encoded as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// returns an argon2id hasher with the parameters recommended by RFC 9106 for memory constrained environments
+func NewArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (hasher Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %s", err.Error())
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, hasher.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		hasher.Memory,
+		hasher.Time,
+		hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (hasher Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (hasher Argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (hasher Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time != hasher.Time ||
+		params.Memory != hasher.Memory ||
+		params.Threads != hasher.Threads ||
+		uint32(len(key)) != hasher.KeyLen ||
+		uint32(len(salt)) != hasher.SaltLen
+}
+
+// decodes the parameters, the salt and the key of an argon2id hash
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	params := Argon2idHasher{}
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	params.KeyLen = uint32(len(key))
+	params.SaltLen = uint32(len(salt))
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes the passwords with bcrypt.
+// Note that bcrypt only uses the first 72 bytes of the password
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() BcryptHasher {
+	return BcryptHasher{Cost: 12}
+}
+
+func (hasher BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (hasher BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (hasher BcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (hasher BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != hasher.Cost
+}
@@ -1,11 +1,39 @@
 package identity
 
 import (
+	"context"
 	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
 )
 
+// returns the permissions granted directly to the user, including the ones of a legacy bitmask
+func (user User) permissions() spellbook.PermissionSet {
+	if user.Permission == 0 {
+		return user.Grants
+	}
+	return user.Grants.Union(spellbook.PermissionSetFromBitmask(user.Permission))
+}
+
+// moves the permissions of the legacy bitmask to the grants. It reports whether there was a bitmask
+func (user *User) migratePermission() bool {
+	if user.Permission == 0 {
+		return false
+	}
+	user.Grants = user.permissions()
+	user.Permission = 0
+	return true
+}
+
+// replaces the permissions granted directly to the user
+func (user *User) SetPermissions(permissions spellbook.PermissionSet) {
+	user.Grants = permissions
+	user.Permission = 0
+}
+
 func (user *User) GrantPermission(permission spellbook.Permission) {
-	user.Permission |= permission
+	user.migratePermission()
+	user.Grants = user.Grants.With(permission)
 }
 
 func (user *User) GrantNamedPermission(name string) {
@@ -20,21 +48,25 @@ func (user *User) GrantNamedPermissions(names []string) {
 }
 
 func (user *User) GrantAll() {
-	for permission := range spellbook.Permissions {
-		user.GrantPermission(permission)
-	}
+	user.SetPermissions(spellbook.RegisteredPermissions())
 }
 
 func (user *User) RemovePermission(permission spellbook.Permission) {
-	user.Permission &= ^permission
+	user.migratePermission()
+	user.Grants = user.Grants.Without(permission)
 }
 
 func (user *User) TogglePermission(permission spellbook.Permission) {
-	user.Permission ^= permission
+	if user.permissions().Has(permission) {
+		user.RemovePermission(permission)
+		return
+	}
+	user.GrantPermission(permission)
 }
 
+// only the permissions granted directly can enable the user
 func (user User) IsEnabled() bool {
-	return user.HasPermission(spellbook.PermissionEnabled)
+	return user.permissions().Has(spellbook.PermissionEnabled)
 }
 
 func (user *User) Ban() {
@@ -45,12 +77,40 @@ func (user *User) Ban() {
 comparison without PermissionEnabled
  **/
 func (user User) ChangedPermission(oldUser User) bool {
-	if oldUser.HasPermission(spellbook.PermissionEnabled) {
-		oldUser.RemovePermission(spellbook.PermissionEnabled)
+	permissions := user.permissions().Without(spellbook.PermissionEnabled)
+	old := oldUser.permissions().Without(spellbook.PermissionEnabled)
+	return !permissions.Equal(old)
+}
+
+// reports whether the roles or the groups of the user differ from the ones of oldUser
+func (user User) ChangedRoles(oldUser User) bool {
+	return !sameNames(user.Roles, oldUser.Roles) || !sameNames(user.Groups, oldUser.Groups)
+}
+
+// Moves the permissions of the users and the roles stored as bitmasks, before the permission registry, to their grants.
+// Bitmasks are otherwise read as they are, and migrated when the user or the role is saved
+func MigratePermissions(ctx context.Context) error {
+	var users []*User
+	if err := model.NewQuery(&User{}).WithField("Permission >", 0).GetAll(ctx, &users); err != nil {
+		return fmt.Errorf("error retrieving users with legacy permissions: %s", err.Error())
 	}
-	if user.HasPermission(spellbook.PermissionEnabled) {
-		user.RemovePermission(spellbook.PermissionEnabled)
+	for _, u := range users {
+		u.migratePermission()
+		if err := model.Update(ctx, u); err != nil {
+			return fmt.Errorf("error migrating the permissions of user %s: %s", u.Username(), err.Error())
+		}
 	}
-	changed := user.Permission != oldUser.Permission
-	return changed
+
+	var roles []*Role
+	if err := model.NewQuery(&Role{}).WithField("Permission >", 0).GetAll(ctx, &roles); err != nil {
+		return fmt.Errorf("error retrieving roles with legacy permissions: %s", err.Error())
+	}
+	for _, role := range roles {
+		role.migratePermission()
+		if err := model.Update(ctx, role); err != nil {
+			return fmt.Errorf("error migrating the permissions of role %s: %s", role.Id(), err.Error())
+		}
+	}
+
+	return nil
 }
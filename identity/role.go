@@ -0,0 +1,265 @@
+package identity
+
+import (
+	"decodica.com/spellbook"
+	"encoding/json"
+	"github.com/decodica/model/v2"
+	"strings"
+)
+
+// Role is a named bundle of permissions, such as "editor" or "media-manager".
+// Roles are granted to users and service accounts directly, or through groups
+type Role struct {
+	model.Model `json:"-"`
+	SqlName     string `model:"-" gorm:"PRIMARY_KEY;column:name"`
+	Description string
+	Grants      spellbook.PermissionSet `gorm:"type:text;column:grants"`
+	// users with the role must authenticate with a second factor
+	RequireTwoFactor bool
+	// Deprecated: the bitmask of the permissions stored before the permission registry, see MigratePermissions
+	Permission int64 `json:"-" gorm:"NOT NULL"`
+	// the name, while the role is not yet stored
+	name string `model:"-" gorm:"-"`
+}
+
+// the name of the role is its id
+func (role *Role) Id() string {
+	if role.EncodedKey() != "" {
+		return role.StringID()
+	}
+	if role.SqlName != "" {
+		return role.SqlName
+	}
+	return role.name
+}
+
+func (role *Role) Permissions() []string {
+	return role.permissions().Names()
+}
+
+// returns the permissions of the role, including the ones of a legacy bitmask
+func (role Role) permissions() spellbook.PermissionSet {
+	if role.Permission == 0 {
+		return role.Grants
+	}
+	return role.Grants.Union(spellbook.PermissionSetFromBitmask(role.Permission))
+}
+
+// moves the permissions of the legacy bitmask to the grants. It reports whether there was a bitmask
+func (role *Role) migratePermission() bool {
+	if role.Permission == 0 {
+		return false
+	}
+	role.Grants = role.permissions()
+	role.Permission = 0
+	return true
+}
+
+// replaces the permissions of the role
+func (role *Role) SetPermissions(permissions spellbook.PermissionSet) {
+	role.Grants = permissions
+	role.Permission = 0
+}
+
+func (role *Role) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Name             string   `json:"name"`
+		Description      string   `json:"description"`
+		Permissions      []string `json:"permissions"`
+		RequireTwoFactor bool     `json:"requireTwoFactor"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	role.name = alias.Name
+	role.Description = alias.Description
+	role.RequireTwoFactor = alias.RequireTwoFactor
+	role.SetPermissions(spellbook.PermissionSetFromNames(alias.Permissions))
+	return nil
+}
+
+func (role *Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Name             string   `json:"name"`
+		Description      string   `json:"description"`
+		Permissions      []string `json:"permissions"`
+		RequireTwoFactor bool     `json:"requireTwoFactor"`
+	}{
+		Name:             role.Id(),
+		Description:      role.Description,
+		Permissions:      role.Permissions(),
+		RequireTwoFactor: role.RequireTwoFactor,
+	})
+}
+
+func (role *Role) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, role)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (role *Role) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(role)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// Group is a named set of users that share the same roles
+type Group struct {
+	model.Model `json:"-"`
+	SqlName     string `model:"-" gorm:"PRIMARY_KEY;column:name"`
+	Description string
+	Roles       []string `gorm:"-"`
+	SqlRoles    string   `model:"-" gorm:"column:roles"`
+	name        string   `model:"-" gorm:"-"`
+}
+
+// the name of the group is its id
+func (group *Group) Id() string {
+	if group.EncodedKey() != "" {
+		return group.StringID()
+	}
+	if group.SqlName != "" {
+		return group.SqlName
+	}
+	return group.name
+}
+
+// gorm hooks: the roles are stored as a comma separated list
+func (group *Group) BeforeSave() error {
+	group.SqlRoles = joinNames(group.Roles)
+	return nil
+}
+
+func (group *Group) AfterFind() error {
+	group.Roles = splitNames(group.SqlRoles)
+	return nil
+}
+
+func (group *Group) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Roles       []string `json:"roles"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	group.name = alias.Name
+	group.Description = alias.Description
+	group.Roles = alias.Roles
+	return nil
+}
+
+func (group *Group) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Roles       []string `json:"roles"`
+	}{
+		Name:        group.Id(),
+		Description: group.Description,
+		Roles:       nonNilNames(group.Roles),
+	})
+}
+
+func (group *Group) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, group)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (group *Group) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(group)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// returns the permissions granted by the roles.
+// Roles can't enable an identity: PermissionEnabled is only granted directly
+func rolesPermission(roles []*Role) spellbook.PermissionSet {
+	var permissions spellbook.PermissionSet
+	for _, role := range roles {
+		permissions = permissions.Union(role.permissions())
+	}
+	return permissions.Without(spellbook.PermissionEnabled)
+}
+
+// reports whether one of the roles requires a second factor
+func rolesRequireTwoFactor(roles []*Role) bool {
+	for _, role := range roles {
+		if role.RequireTwoFactor {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the roles of the identity and of its groups, without duplicates
+func roleNames(roles []string, groups []*Group) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(rs []string) {
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				names = append(names, r)
+			}
+		}
+	}
+	add(roles)
+	for _, group := range groups {
+		add(group.Roles)
+	}
+	return names
+}
+
+// reports whether two lists have the same names, regardless of their order
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, name := range a {
+		count[name]++
+	}
+	for _, name := range b {
+		count[name]--
+		if count[name] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// names of roles and groups are stored as a comma separated list in sql
+func joinNames(names []string) string {
+	return strings.Join(names, ",")
+}
+
+func splitNames(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// lists of names are never sent as null
+func nonNilNames(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
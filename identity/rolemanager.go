@@ -0,0 +1,394 @@
+package identity
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+)
+
+func NewRoleController() *spellbook.RestController {
+	return NewRoleControllerWithKey("")
+}
+
+func NewRoleControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: RoleManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// RoleManager manages the roles.
+// Roles are read with PermissionReadUser and written with PermissionEditPermissions
+type RoleManager struct{}
+
+func (manager RoleManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Role{}, nil
+}
+
+func (manager RoleManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	role := Role{}
+	if err := model.FromStringID(ctx, &role, id, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve role %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (manager RoleManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager RoleManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var roles []*Role
+	q := model.NewQuery(&Role{})
+
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q, err = spellbook.PaginateQuery(q, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &roles)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]spellbook.Resource, len(roles))
+	for i := range roles {
+		resources[i] = roles[i]
+	}
+
+	next, err := spellbook.NextQueryCursor(ctx, q, &roles, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager RoleManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager RoleManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	role := res.(*Role)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{role.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	err := model.FromStringID(ctx, &Role{}, role.name, nil)
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("role %s already exists", role.name))
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(role.name)
+	if err := model.CreateWithOptions(ctx, role, &opts); err != nil {
+		return fmt.Errorf("error creating role %s: %s", role.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates the description and the permissions of the role
+func (manager RoleManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*Role)
+	role := res.(*Role)
+	role.Description = other.Description
+	role.RequireTwoFactor = other.RequireTwoFactor
+	role.SetPermissions(other.Grants)
+
+	return model.Update(ctx, role)
+}
+
+// deletes the role. Users and groups that still reference it are no longer granted its permissions
+func (manager RoleManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	role := res.(*Role)
+	// the datastore can't query the users and the groups in a transaction:
+	// a role assigned while it's deleted grants nothing, see loadRoles
+	if err := checkRoleUnassigned(ctx, role.Id()); err != nil {
+		return err
+	}
+
+	if err := model.Delete(ctx, role, nil); err != nil {
+		return fmt.Errorf("error deleting role %s: %s", role.Id(), err.Error())
+	}
+
+	return nil
+}
+
+// returns a ConflictError if the role is assigned to a user or a group
+func checkRoleUnassigned(ctx context.Context, name string) error {
+	users, err := model.NewQuery(&User{}).WithField("Roles =", name).Count(ctx)
+	if err != nil {
+		return fmt.Errorf("error retrieving the users with role %s: %s", name, err.Error())
+	}
+	if users > 0 {
+		return spellbook.NewConflictError(fmt.Sprintf("role %s is assigned to %d users", name, users))
+	}
+
+	groups, err := model.NewQuery(&Group{}).WithField("Roles =", name).Count(ctx)
+	if err != nil {
+		return fmt.Errorf("error retrieving the groups with role %s: %s", name, err.Error())
+	}
+	if groups > 0 {
+		return spellbook.NewConflictError(fmt.Sprintf("role %s is assigned to %d groups", name, groups))
+	}
+	return nil
+}
+
+func NewGroupController() *spellbook.RestController {
+	return NewGroupControllerWithKey("")
+}
+
+func NewGroupControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: GroupManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// GroupManager manages the groups. Users join a group when the group is added to their groups.
+// Groups are read with PermissionReadUser and written with PermissionEditPermissions
+type GroupManager struct{}
+
+func (manager GroupManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Group{}, nil
+}
+
+func (manager GroupManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	group := Group{}
+	if err := model.FromStringID(ctx, &group, id, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve group %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (manager GroupManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager GroupManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var groups []*Group
+	q := model.NewQuery(&Group{})
+
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q, err = spellbook.PaginateQuery(q, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &groups)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]spellbook.Resource, len(groups))
+	for i := range groups {
+		resources[i] = groups[i]
+	}
+
+	next, err := spellbook.NextQueryCursor(ctx, q, &groups, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager GroupManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager GroupManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	group := res.(*Group)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{group.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	if err := checkRoles(ctx, group.Roles); err != nil {
+		return err
+	}
+
+	err := model.FromStringID(ctx, &Group{}, group.name, nil)
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("group %s already exists", group.name))
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	opts := model.CreateOptions{}
+	opts.WithStringId(group.name)
+	if err := model.CreateWithOptions(ctx, group, &opts); err != nil {
+		return fmt.Errorf("error creating group %s: %s", group.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates the description and the roles of the group
+func (manager GroupManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*Group)
+	if err := checkRoles(ctx, other.Roles); err != nil {
+		return err
+	}
+
+	group := res.(*Group)
+	group.Description = other.Description
+	group.Roles = other.Roles
+
+	return model.Update(ctx, group)
+}
+
+// deletes the group. Its members are no longer granted its roles
+func (manager GroupManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	group := res.(*Group)
+	if err := model.Delete(ctx, group, nil); err != nil {
+		return fmt.Errorf("error deleting group %s: %s", group.Id(), err.Error())
+	}
+
+	return nil
+}
+
+// returns a FieldError if one of the roles doesn't exist
+func checkRoles(ctx context.Context, roles []string) error {
+	for _, name := range roles {
+		err := model.FromStringID(ctx, &Role{}, name, nil)
+		if err == datastore.ErrNoSuchEntity {
+			return spellbook.NewFieldError("roles", fmt.Errorf("role %s doesn't exist", name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns a FieldError if one of the groups doesn't exist
+func checkGroups(ctx context.Context, groups []string) error {
+	for _, name := range groups {
+		err := model.FromStringID(ctx, &Group{}, name, nil)
+		if err == datastore.ErrNoSuchEntity {
+			return spellbook.NewFieldError("groups", fmt.Errorf("group %s doesn't exist", name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the permissions granted by the roles, and by the roles of the groups.
+// Roles and groups that no longer exist grant nothing
+func resolveRoles(ctx context.Context, roles []string, groups []string) (spellbook.PermissionSet, error) {
+	rs, err := loadRoles(ctx, roles, groups)
+	if err != nil {
+		return nil, err
+	}
+	return rolesPermission(rs), nil
+}
+
+// returns the roles, and the roles of the groups, that still exist
+func loadRoles(ctx context.Context, roles []string, groups []string) ([]*Role, error) {
+	var gs []*Group
+	for _, name := range groups {
+		group := Group{}
+		err := model.FromStringID(ctx, &group, name, nil)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		gs = append(gs, &group)
+	}
+
+	var rs []*Role
+	for _, name := range roleNames(roles, gs) {
+		role := Role{}
+		err := model.FromStringID(ctx, &role, name, nil)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, &role)
+	}
+
+	return rs, nil
+}
@@ -5,37 +5,54 @@ import (
 	"decodica.com/spellbook"
 	"encoding/json"
 	"github.com/decodica/model/v2"
+	"net"
+	"strings"
 	"time"
 )
 
 const SAIdentifier = "SA:"
 
 func IsServiceAccountToken(tkn string) bool {
-	return tkn[:3] == SAIdentifier
+	return strings.HasPrefix(tkn, SAIdentifier)
 }
 
 type ServiceAccount struct {
 	model.Model    `json:"-"`
-	Label          string `gorm:"PRIMARY_KEY;"`
+	Label          string `gorm:"PRIMARY_KEY;" validate:"required,datastorekey"`
 	Description    string
-	Token          string               `gorm:"-"`
-	SqlToken       sql.NullString       `gorm:"UNIQUE_INDEX:idx_serviceaccount_token;column:token"`
-	IPRestrictions string               // comma-separated strings for ip restrictions
-	Permission     spellbook.Permission `gorm:"NOT NULL"`
-	Created        time.Time
+	Token          string                  `gorm:"-"`
+	SqlToken       sql.NullString          `gorm:"UNIQUE_INDEX:idx_serviceaccount_token;column:token"`
+	IPRestrictions string                  `validate:"iplist"` // comma-separated addresses and networks the account can be used from
+	Grants         spellbook.PermissionSet `gorm:"type:text;column:grants"`
+	// Deprecated: the bitmask of the permissions stored before the permission registry, see MigrateSqlPermissions
+	Permission int64 `json:"-" gorm:"NOT NULL"`
+	Created    time.Time
+	Roles      []string `gorm:"-"`
+	SqlRoles   string   `gorm:"column:roles"`
+	// the permissions granted by the roles, computed on authentication
+	effective spellbook.PermissionSet `gorm:"-"`
+}
+
+// gorm hooks: the roles are stored as a comma separated list
+func (sa *ServiceAccount) BeforeSave() error {
+	sa.SqlRoles = joinNames(sa.Roles)
+	return nil
 }
 
+func (sa *ServiceAccount) AfterFind() error {
+	sa.Roles = splitNames(sa.SqlRoles)
+	return nil
+}
+
+// stores the hash of the token. The clear token is only kept in Token,
+// so that it's sent to the client that generated it: it can't be read afterwards
 func (sa *ServiceAccount) setToken(tkn string) {
 	sa.Token = tkn
 	sa.SqlToken.Valid = tkn != ""
-	sa.SqlToken.String = tkn
-}
-
-func (sa *ServiceAccount) getToken() string {
+	sa.SqlToken.String = ""
 	if sa.SqlToken.Valid {
-		return sa.SqlToken.String
+		sa.SqlToken.String = HashToken(tkn)
 	}
-	return sa.Token
 }
 
 func (sa *ServiceAccount) UnmarshalJSON(data []byte) error {
@@ -45,6 +62,7 @@ func (sa *ServiceAccount) UnmarshalJSON(data []byte) error {
 		Description    string   `json:"description"`
 		IPRestrictions string   `json:"ipRestrictions"`
 		Permissions    []string `json:"permissions"`
+		Roles          []string `json:"roles"`
 	}{}
 
 	err := json.Unmarshal(data, &alias)
@@ -56,6 +74,7 @@ func (sa *ServiceAccount) UnmarshalJSON(data []byte) error {
 	sa.Description = alias.Description
 	sa.IPRestrictions = alias.IPRestrictions
 	sa.GrantNamedPermissions(alias.Permissions)
+	sa.Roles = alias.Roles
 	return nil
 }
 
@@ -63,9 +82,10 @@ func (sa *ServiceAccount) MarshalJSON() ([]byte, error) {
 	type Alias struct {
 		Label          string   `json:"label"`
 		Description    string   `json:"description"`
-		Token          string   `json:"token"`
+		Token          string   `json:"token,omitempty"`
 		IPRestrictions string   `json:"ipRestrictions"`
 		Permissions    []string `json:"permissions"`
+		Roles          []string `json:"roles"`
 	}
 
 	return json.Marshal(&struct {
@@ -76,25 +96,45 @@ func (sa *ServiceAccount) MarshalJSON() ([]byte, error) {
 		Alias{
 			Label:          sa.Label,
 			Description:    sa.Description,
-			Token:          sa.getToken(),
+			Token:          sa.Token,
 			IPRestrictions: sa.IPRestrictions,
 			Permissions:    sa.Permissions(),
+			Roles:          nonNilNames(sa.Roles),
 		},
 	})
 }
 
 func (sa ServiceAccount) Permissions() []string {
-	var perms []string
-	for permission, description := range spellbook.Permissions {
-		if sa.HasPermission(permission) {
-			perms = append(perms, description)
-		}
+	return sa.permissions().Union(sa.effective).Names()
+}
+
+// returns the permissions granted directly to the account, including the ones of a legacy bitmask
+func (sa ServiceAccount) permissions() spellbook.PermissionSet {
+	if sa.Permission == 0 {
+		return sa.Grants
 	}
-	return perms
+	return sa.Grants.Union(spellbook.PermissionSetFromBitmask(sa.Permission))
 }
 
+// moves the permissions of the legacy bitmask to the grants. It reports whether there was a bitmask
+func (sa *ServiceAccount) migratePermission() bool {
+	if sa.Permission == 0 {
+		return false
+	}
+	sa.Grants = sa.permissions()
+	sa.Permission = 0
+	return true
+}
+
+// replaces the permissions granted directly to the account
+func (sa *ServiceAccount) SetPermissions(permissions spellbook.PermissionSet) {
+	sa.Grants = permissions
+	sa.Permission = 0
+}
+
+// reports whether the permission is granted to the account, directly or by its roles
 func (sa ServiceAccount) HasPermission(permission spellbook.Permission) bool {
-	return sa.Permission&permission != 0
+	return sa.permissions().Has(permission) || sa.effective.Has(permission)
 }
 
 func (sa *ServiceAccount) GrantNamedPermissions(names []string) {
@@ -109,11 +149,23 @@ func (sa *ServiceAccount) GrantNamedPermission(name string) {
 }
 
 func (sa *ServiceAccount) GrantPermission(permission spellbook.Permission) {
-	sa.Permission |= permission
+	sa.migratePermission()
+	sa.Grants = sa.Grants.With(permission)
+}
+
+// reports whether the account can be used from the address.
+// An account without restrictions can be used from any address, malformed restrictions deny every address
+func (sa ServiceAccount) AllowsIP(ip net.IP) bool {
+	list, err := spellbook.ParseIPList(sa.IPRestrictions)
+	if err != nil {
+		return false
+	}
+	return len(list) == 0 || list.Contains(ip)
 }
 
+// only the permissions granted directly can enable the account
 func (sa *ServiceAccount) IsEnabled() bool {
-	return sa.HasPermission(spellbook.PermissionEnabled)
+	return sa.permissions().Has(spellbook.PermissionEnabled)
 }
 
 /**
@@ -0,0 +1,170 @@
+package identity
+
+import (
+	"decodica.com/spellbook"
+	"encoding/json"
+	"time"
+)
+
+// the overlap of a rotation that doesn't specify one
+var DefaultKeyRotationOverlap = 24 * time.Hour
+
+// the last use of a key is recorded at most once per interval, unless the key is used from a new address
+const keyTouchInterval = time.Minute
+
+// ServiceAccountKey is a named token of a service account.
+// The key grants the permissions it shares with its account, and stops working when it expires.
+// Only the hash of the token is stored
+type ServiceAccountKey struct {
+	KeyId   string                  `gorm:"PRIMARY_KEY;column:id"`
+	Account string                  `gorm:"NOT NULL;INDEX:idx_service_account_keys_account" validate:"required"`
+	Name    string                  `gorm:"NOT NULL" validate:"required,singleline"`
+	Token   string                  `gorm:"NOT NULL;UNIQUE_INDEX:idx_service_account_keys_token"`
+	Grants  spellbook.PermissionSet `gorm:"type:text;column:grants"`
+	// Deprecated: the bitmask of the permissions stored before the permission registry, see MigrateSqlPermissions
+	Permission int64 `gorm:"NOT NULL"`
+	// the zero time never expires
+	Expires    time.Time
+	Created    time.Time
+	LastUsed   time.Time
+	LastUsedIP string
+	// the clear token, only known when the key is created
+	token string `gorm:"-"`
+	// the key replaced by this one, and for how long the replaced key keeps working
+	rotates string        `gorm:"-"`
+	overlap time.Duration `gorm:"-"`
+}
+
+func (key *ServiceAccountKey) setToken(tkn string) {
+	key.token = tkn
+	key.Token = HashToken(tkn)
+}
+
+// reports whether the key is expired
+func (key *ServiceAccountKey) expired(now time.Time) bool {
+	return !key.Expires.IsZero() && !now.Before(key.Expires)
+}
+
+// reports whether the use must be recorded
+func (key *ServiceAccountKey) touch(now time.Time, ip string) bool {
+	if now.Sub(key.LastUsed) < keyTouchInterval && ip == key.LastUsedIP {
+		return false
+	}
+	key.LastUsed = now
+	key.LastUsedIP = ip
+	return true
+}
+
+func (key *ServiceAccountKey) Permissions() []string {
+	return key.permissions().Names()
+}
+
+// returns the permissions of the key, including the ones of a legacy bitmask
+func (key ServiceAccountKey) permissions() spellbook.PermissionSet {
+	if key.Permission == 0 {
+		return key.Grants
+	}
+	return key.Grants.Union(spellbook.PermissionSetFromBitmask(key.Permission))
+}
+
+// moves the permissions of the legacy bitmask to the grants. It reports whether there was a bitmask
+func (key *ServiceAccountKey) migratePermission() bool {
+	if key.Permission == 0 {
+		return false
+	}
+	key.Grants = key.permissions()
+	key.Permission = 0
+	return true
+}
+
+// replaces the permissions of the key
+func (key *ServiceAccountKey) SetPermissions(permissions spellbook.PermissionSet) {
+	key.Grants = permissions
+	key.Permission = 0
+}
+
+func (key *ServiceAccountKey) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Account     string     `json:"account"`
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expires     *time.Time `json:"expires"`
+		Rotates     string     `json:"rotates"`
+		// seconds
+		Overlap *int64 `json:"overlap"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	key.Account = alias.Account
+	key.Name = alias.Name
+	key.SetPermissions(spellbook.PermissionSetFromNames(alias.Permissions))
+	key.Expires = time.Time{}
+	if alias.Expires != nil {
+		key.Expires = alias.Expires.UTC()
+	}
+	key.rotates = alias.Rotates
+	key.overlap = DefaultKeyRotationOverlap
+	if alias.Overlap != nil {
+		key.overlap = time.Duration(*alias.Overlap) * time.Second
+	}
+	return nil
+}
+
+func (key *ServiceAccountKey) MarshalJSON() ([]byte, error) {
+	var expires, lastUsed *time.Time
+	if !key.Expires.IsZero() {
+		expires = &key.Expires
+	}
+	if !key.LastUsed.IsZero() {
+		lastUsed = &key.LastUsed
+	}
+
+	return json.Marshal(&struct {
+		Id          string     `json:"id"`
+		Account     string     `json:"account"`
+		Name        string     `json:"name"`
+		Token       string     `json:"token,omitempty"`
+		Permissions []string   `json:"permissions"`
+		Expires     *time.Time `json:"expires,omitempty"`
+		Created     time.Time  `json:"created"`
+		LastUsed    *time.Time `json:"lastUsed,omitempty"`
+		LastUsedIP  string     `json:"lastUsedIp,omitempty"`
+	}{
+		Id:          key.KeyId,
+		Account:     key.Account,
+		Name:        key.Name,
+		Token:       key.token,
+		Permissions: key.Permissions(),
+		Expires:     expires,
+		Created:     key.Created,
+		LastUsed:    lastUsed,
+		LastUsedIP:  key.LastUsedIP,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (key *ServiceAccountKey) Id() string {
+	return key.KeyId
+}
+
+func (key *ServiceAccountKey) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, key)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (key *ServiceAccountKey) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(key)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
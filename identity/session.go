@@ -0,0 +1,217 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/flamel"
+	"decodica.com/spellbook"
+	"encoding/json"
+	"github.com/decodica/model/v2"
+	"strings"
+	"time"
+)
+
+// lifetimes of the tokens issued on login and on refresh
+var (
+	AccessTokenDuration  = time.Hour
+	RefreshTokenDuration = 30 * 24 * time.Hour
+	// the lifetime of the tokens issued before sessions. Their issue time is unknown:
+	// they expire LegacyTokenDuration after their first use since the expiry is recorded
+	LegacyTokenDuration = RefreshTokenDuration
+)
+
+// separates the id of the session from the secret part of its tokens
+const sessionTokenSeparator = "."
+
+// the last use of a session is recorded at most once per interval, to spare a write per request
+const sessionTouchInterval = time.Minute
+
+const keySession = "__pSession__"
+
+// Session is a login of a user from a client.
+// A user can have many sessions, each with its own access and refresh token.
+// Tokens are <session id>.<secret>: only their hashes are stored
+type Session struct {
+	model.Model   `json:"-"`
+	SqlId         string `model:"-" gorm:"PRIMARY_KEY;column:id"`
+	Username      string `gorm:"NOT NULL;INDEX:idx_sessions_username"`
+	AccessToken   string `gorm:"NOT NULL"`
+	RefreshToken  string `gorm:"NOT NULL"`
+	UserAgent     string
+	IP            string
+	Created       time.Time
+	LastUsed      time.Time
+	AccessExpires time.Time
+	Expires       time.Time
+	// whether the user has been authenticated with a second factor
+	SecondFactor bool
+	// the user acting on behalf of the user of the session, if the session is an impersonation
+	Impersonator string
+	// the clear tokens, only known when they are issued
+	accessToken  string `model:"-" gorm:"-"`
+	refreshToken string `model:"-" gorm:"-"`
+}
+
+// Returns a new session of the user, with the client of the request.
+// The session must be stored by the caller
+func NewSession(ctx context.Context, username string) (*Session, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		SqlId:    id,
+		Username: username,
+		Created:  now,
+		LastUsed: now,
+	}
+	session.IP, session.UserAgent = clientFromContext(ctx)
+
+	if err := session.issue(now); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// returns the address and the user agent of the client of the request
+func clientFromContext(ctx context.Context) (string, string) {
+	ip := ""
+	if addr := spellbook.ClientIP(ctx); addr != nil {
+		ip = addr.String()
+	}
+	ins := flamel.InputsFromContext(ctx)
+	ua := ""
+	if v, ok := ins[flamel.KeyRequestUserAgent]; ok {
+		ua = v.Value()
+	}
+	return ip, ua
+}
+
+// generates new access and refresh tokens, replacing the previous ones
+func (session *Session) issue(now time.Time) error {
+	access, err := NewRandomToken()
+	if err != nil {
+		return err
+	}
+	refresh, err := NewRandomToken()
+	if err != nil {
+		return err
+	}
+
+	session.accessToken = session.Id() + sessionTokenSeparator + access
+	session.refreshToken = session.Id() + sessionTokenSeparator + refresh
+	session.AccessToken = HashToken(session.accessToken)
+	session.RefreshToken = HashToken(session.refreshToken)
+	session.AccessExpires = now.Add(AccessTokenDuration)
+	session.Expires = now.Add(RefreshTokenDuration)
+	return nil
+}
+
+// returns the id of the session the token belongs to.
+// ok is false if the token is not a session token, such as service account and legacy tokens
+func sessionIdFromToken(token string) (string, bool) {
+	if IsServiceAccountToken(token) {
+		return "", false
+	}
+	idx := strings.Index(token, sessionTokenSeparator)
+	if idx <= 0 {
+		return "", false
+	}
+	return token[:idx], true
+}
+
+// reports whether the token is the unexpired access token of the session
+func (session *Session) validAccess(token string, now time.Time) bool {
+	ok, _ := MatchToken(token, session.AccessToken)
+	return ok && now.Before(session.AccessExpires) && now.Before(session.Expires)
+}
+
+// reports whether the token is the unexpired refresh token of the session
+func (session *Session) validRefresh(token string, now time.Time) bool {
+	ok, _ := MatchToken(token, session.RefreshToken)
+	return ok && now.Before(session.Expires)
+}
+
+// reports whether the last use must be recorded
+func (session *Session) touch(now time.Time) bool {
+	if now.Sub(session.LastUsed) < sessionTouchInterval {
+		return false
+	}
+	session.LastUsed = now
+	return true
+}
+
+// copies the clear tokens of the session into the token resource
+func (session *Session) toToken(token *Token) {
+	token.Value = session.accessToken
+	token.RefreshToken = session.refreshToken
+	token.Expires = session.AccessExpires
+	token.Session = session.Id()
+}
+
+func contextWithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, keySession, session)
+}
+
+// Returns the session the request has been authenticated with, if any
+func SessionFromContext(ctx context.Context) *Session {
+	if s := ctx.Value(keySession); s != nil {
+		return s.(*Session)
+	}
+	return nil
+}
+
+// reports whether the session belongs to the current identity
+func ownSession(ctx context.Context, session *Session) bool {
+	current := spellbook.IdentityFromContext(ctx)
+	return current != nil && current.Username() == session.Username
+}
+
+func (session *Session) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Id           string    `json:"id"`
+		Username     string    `json:"username"`
+		UserAgent    string    `json:"userAgent"`
+		IP           string    `json:"ip"`
+		Created      time.Time `json:"created"`
+		LastUsed     time.Time `json:"lastUsed"`
+		Expires      time.Time `json:"expires"`
+		SecondFactor bool      `json:"secondFactor"`
+		Impersonator string    `json:"impersonator,omitempty"`
+	}{
+		Id:           session.Id(),
+		Username:     session.Username,
+		UserAgent:    session.UserAgent,
+		IP:           session.IP,
+		Created:      session.Created,
+		LastUsed:     session.LastUsed,
+		Expires:      session.Expires,
+		SecondFactor: session.SecondFactor,
+		Impersonator: session.Impersonator,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (session *Session) Id() string {
+	if session.EncodedKey() == "" {
+		return session.SqlId
+	}
+	return session.StringID()
+}
+
+func (session *Session) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	// sessions are created on login
+	return spellbook.NewUnsupportedError()
+}
+
+func (session *Session) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(session)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,251 @@
+package identity
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"decodica.com/spellbook"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+func NewSessionController() *spellbook.RestController {
+	return NewSessionControllerWithKey("")
+}
+
+func NewSessionControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SessionManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// SessionManager lists and revokes the sessions of the current user.
+// Users with PermissionReadUser and PermissionWriteUser can read and revoke the sessions of every user
+type SessionManager struct{}
+
+func (manager SessionManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Session{}, nil
+}
+
+func (manager SessionManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	session := Session{}
+	if err := model.FromStringID(ctx, &session, id, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve session %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	if !ownSession(ctx, &session) && !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	return &session, nil
+}
+
+func (manager SessionManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+// lists the sessions of the current user
+func (manager SessionManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	var sessions []*Session
+	q := model.NewQuery(&Session{}).WithField("Username =", current.Username())
+
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q, err = spellbook.PaginateQuery(q, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &sessions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resources := make([]spellbook.Resource, len(sessions))
+	for i := range sessions {
+		resources[i] = sessions[i]
+	}
+
+	next, err := spellbook.NextQueryCursor(ctx, q, &sessions, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager SessionManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	q := model.NewQuery(&Session{}).WithField("Username =", current.Username())
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
+}
+
+func (manager SessionManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SessionManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	// sessions are opened by the token controller
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SessionManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// revokes the session
+func (manager SessionManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	current := spellbook.IdentityFromContext(ctx)
+	session := res.(*Session)
+	if current == nil || (!ownSession(ctx, session) && !current.HasPermission(spellbook.PermissionWriteUser)) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+
+	if err := model.Delete(ctx, session, nil); err != nil {
+		return fmt.Errorf("error revoking session %s: %s", session.Id(), err.Error())
+	}
+
+	return nil
+}
+
+func NewRefreshController() *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: RefreshManager{}}
+	return spellbook.NewRestController(handler)
+}
+
+// RefreshManager exchanges a refresh token for new access and refresh tokens of the same session.
+// The exchanged refresh token can't be used again: the session is locked while it's refreshed,
+// and a refresh of a session that is already being refreshed is rejected
+type RefreshManager struct{}
+
+// the lease of the lock of a session that is refreshed
+const refreshLease = 30 * time.Second
+
+func (manager RefreshManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Token{}, nil
+}
+
+func (manager RefreshManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager RefreshManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager RefreshManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager RefreshManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	token := res.(*Token)
+	if token.RefreshToken == "" {
+		return spellbook.NewFieldError("refreshToken", spellbook.ErrMissingField)
+	}
+
+	id, ok := sessionIdFromToken(token.RefreshToken)
+	if !ok {
+		return spellbook.NewUnauthorizedError("invalid refresh token")
+	}
+
+	// the session is read and rotated under its lock, so that a refresh token can't be exchanged twice
+	unlock, ok, err := spellbook.DefaultLocker.Lock(ctx, "refresh:"+id, refreshLease)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return spellbook.NewUnauthorizedError("the session is being refreshed")
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	session := Session{}
+	if err := model.FromStringID(ctx, &session, id, nil); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return spellbook.NewUnauthorizedError("invalid refresh token")
+		}
+		return err
+	}
+
+	if !session.validRefresh(token.RefreshToken, now) {
+		return spellbook.NewUnauthorizedError("invalid or expired refresh token")
+	}
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, session.Username, nil); err != nil || !u.IsEnabled() {
+		return spellbook.NewUnauthorizedError("the user of the session is not enabled")
+	}
+
+	if err := session.issue(now); err != nil {
+		return err
+	}
+	session.LastUsed = now
+	if err := model.Update(ctx, &session); err != nil {
+		return fmt.Errorf("error refreshing session %s: %s", session.Id(), err.Error())
+	}
+
+	session.toToken(token)
+	return nil
+}
+
+func (manager RefreshManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager RefreshManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// retrieves the user of the session the access token belongs to.
+// Fails if the session doesn't exist or the token is expired
+func userFromSession(ctx context.Context, token string) (User, *Session, error) {
+	u := User{}
+	id, _ := sessionIdFromToken(token)
+	session := Session{}
+	if err := model.FromStringID(ctx, &session, id, nil); err != nil {
+		return u, nil, err
+	}
+
+	now := time.Now().UTC()
+	if !session.validAccess(token, now) {
+		return u, nil, spellbook.NewUnauthorizedError("invalid or expired token")
+	}
+
+	if err := model.FromStringID(ctx, &u, session.Username, nil); err != nil {
+		return u, nil, err
+	}
+
+	if session.touch(now) {
+		if err := model.Update(ctx, &session); err != nil {
+			log.Errorf(ctx, "error recording the use of session %s: %s", id, err.Error())
+		}
+	}
+
+	return u, &session, nil
+}
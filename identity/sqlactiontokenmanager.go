@@ -0,0 +1,307 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"strings"
+	"time"
+)
+
+func NewSqlPasswordResetController() *spellbook.RestController {
+	return NewSqlPasswordResetControllerWithKey("")
+}
+
+func NewSqlPasswordResetControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlPasswordResetManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlPasswordResetManager resets forgotten passwords.
+// POST mails a reset token to the user named by username or email,
+// PUT to the token sets the new password and closes every session of the user
+type SqlPasswordResetManager struct{}
+
+func (manager SqlPasswordResetManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &PasswordReset{}, nil
+}
+
+// returns the reset of the token. Fails with gorm.ErrRecordNotFound if the token is invalid or expired
+func (manager SqlPasswordResetManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	token, err := sqlActionTokenFromId(sql.FromContext(ctx), id, ActionPasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordReset{Username: token.Username, token: token}, nil
+}
+
+func (manager SqlPasswordResetManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlPasswordResetManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// mails a reset token to the user. The request succeeds even if the user doesn't exist,
+// so that it can't be used to find out the registered users
+func (manager SqlPasswordResetManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	reset := res.(*PasswordReset)
+	if reset.Username == "" && reset.Email == "" {
+		return spellbook.NewFieldError("username", spellbook.ErrMissingField)
+	}
+
+	if DefaultMailSender == nil {
+		return ErrNoMailSender
+	}
+
+	db := sql.FromContext(ctx)
+	u := User{}
+	var err error
+	if reset.Username != "" {
+		err = db.Where("username = ?", SanitizeUserName(reset.Username)).First(&u).Error
+	} else {
+		err = db.Where("email = ?", strings.TrimSpace(reset.Email)).First(&u).Error
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		log.Infof(ctx, "password reset requested for an unknown user")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !u.IsEnabled() || u.Email == "" {
+		log.Infof(ctx, "password reset requested for user %s, which can't receive it", u.Username())
+		return nil
+	}
+
+	tkn, token, err := sqlIssueActionToken(db, u, ActionPasswordReset, PasswordResetTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(ctx, NewPasswordResetMail(u, tkn, token.Expires))
+}
+
+// sets the new password. The token can't be used again, and every session of the user is closed
+func (manager SqlPasswordResetManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	reset := res.(*PasswordReset)
+
+	other := PasswordReset{}
+	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	meta := struct {
+		Password string `json:"password" validate:"required,len=8:"`
+	}{other.Password}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	hash, err := NewPasswordHash(other.Password)
+	if err != nil {
+		return fmt.Errorf("error hashing the password of user %s: %s", reset.token.Username, err.Error())
+	}
+
+	db := sql.FromContext(ctx)
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := sqlSpendActionToken(tx, reset.token); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	u := User{}
+	if err := tx.Where("username = ?", reset.token.Username).First(&u).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	u.Password = hash
+	u.setToken("")
+	// the token has been received at the address of the user
+	if reset.token.Email == u.Email {
+		u.EmailVerified = time.Now().UTC()
+	}
+
+	fields := map[string]interface{}{"password": u.Password, "token": u.SqlToken, "email_verified": u.EmailVerified}
+	if err := tx.Model(&u).Updates(fields).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error updating the password of user %s: %s", u.Username(), err.Error())
+	}
+
+	if err := sqlRevokeSessions(ctx, tx, u.Username()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("username = ?", u.Username()).Delete(&Session{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error closing the sessions of user %s: %s", u.Username(), err.Error())
+	}
+
+	return tx.Commit().Error
+}
+
+func (manager SqlPasswordResetManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func NewSqlEmailVerificationController() *spellbook.RestController {
+	return NewSqlEmailVerificationControllerWithKey("")
+}
+
+func NewSqlEmailVerificationControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlEmailVerificationManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlEmailVerificationManager verifies the emails of the users.
+// POST mails a verification token to the email of the current user, or of the named user with PermissionWriteUser.
+// PUT to the token marks the email as verified
+type SqlEmailVerificationManager struct{}
+
+func (manager SqlEmailVerificationManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &EmailVerification{}, nil
+}
+
+// returns the verification of the token. Fails with gorm.ErrRecordNotFound if the token is invalid or expired
+func (manager SqlEmailVerificationManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	token, err := sqlActionTokenFromId(sql.FromContext(ctx), id, ActionEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailVerification{Username: token.Username, Email: token.Email, token: token}, nil
+}
+
+func (manager SqlEmailVerificationManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlEmailVerificationManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// mails a verification token to the email of the user
+func (manager SqlEmailVerificationManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	verification := res.(*EmailVerification)
+	username, err := verificationUsername(ctx, verification)
+	if err != nil {
+		return err
+	}
+
+	if DefaultMailSender == nil {
+		return ErrNoMailSender
+	}
+
+	db := sql.FromContext(ctx)
+	u := User{}
+	if err := db.Where("username = ?", username).First(&u).Error; err != nil {
+		return err
+	}
+
+	if err := checkVerifiable(u); err != nil {
+		return err
+	}
+
+	tkn, token, err := sqlIssueActionToken(db, u, ActionEmailVerification, EmailVerificationTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	verification.Username = u.Username()
+	verification.Email = u.Email
+	return sendMail(ctx, NewEmailVerificationMail(u, tkn, token.Expires))
+}
+
+// marks the email as verified, if it's still the email the token has been sent to
+func (manager SqlEmailVerificationManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	verification := res.(*EmailVerification)
+
+	db := sql.FromContext(ctx)
+	if err := sqlSpendActionToken(db, verification.token); err != nil {
+		return err
+	}
+
+	// the email is verified only if it didn't change after the token was sent
+	result := db.Model(&User{}).
+		Where("username = ? AND email = ?", verification.token.Username, verification.token.Email).
+		Update("email_verified", time.Now().UTC())
+	if result.Error != nil {
+		return fmt.Errorf("error verifying the email of user %s: %s", verification.token.Username, result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return spellbook.NewConflictError(fmt.Sprintf("the email of user %s changed after the token was sent", verification.token.Username))
+	}
+
+	verification.Verified = true
+	return nil
+}
+
+func (manager SqlEmailVerificationManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// stores a new token of the user for the action, replacing the previous ones, and returns its clear value
+func sqlIssueActionToken(db *gorm.DB, u User, action string, duration time.Duration) (string, *ActionToken, error) {
+	token, tkn, err := newActionToken(u, action, duration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return "", nil, tx.Error
+	}
+
+	if err := tx.Where("username = ? AND action = ?", u.Username(), action).Delete(&ActionToken{}).Error; err != nil {
+		tx.Rollback()
+		return "", nil, fmt.Errorf("error deleting the %s tokens of user %s: %s", action, u.Username(), err.Error())
+	}
+
+	if err := tx.Create(token).Error; err != nil {
+		tx.Rollback()
+		return "", nil, fmt.Errorf("error saving the %s token of user %s: %s", action, u.Username(), err.Error())
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return "", nil, err
+	}
+
+	return tkn, token, nil
+}
+
+// returns the stored token. Tokens of other actions and expired tokens don't exist
+func sqlActionTokenFromId(db *gorm.DB, id string, action string) (*ActionToken, error) {
+	token := ActionToken{}
+	if err := db.Where("hash = ?", HashToken(id)).First(&token).Error; err != nil {
+		return nil, err
+	}
+	if !token.valid(action, time.Now().UTC()) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &token, nil
+}
+
+// deletes the token. Fails with gorm.ErrRecordNotFound if it has already been used by a concurrent request
+func sqlSpendActionToken(db *gorm.DB, token *ActionToken) error {
+	result := db.Where("hash = ?", token.Id()).Delete(&ActionToken{})
+	if result.Error != nil {
+		return fmt.Errorf("error deleting the %s token of user %s: %s", token.Action, token.Username, result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package identity
 
 import (
 	"context"
+	dsql "database/sql"
 	"decodica.com/flamel"
 	"decodica.com/spellbook"
 	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
+	"time"
 )
 
 type SqlAuthenticator struct {
@@ -20,18 +25,54 @@ func (authenticator SqlAuthenticator) Authenticate(ctx context.Context) context.
 		db := sql.FromContext(ctx)
 		var u spellbook.Identity
 		if IsServiceAccountToken(token) {
-			sa := ServiceAccount{}
-			err := db.Where("token = ?", token).First(&sa).Error
+			sa, err := sqlServiceAccountFromToken(ctx, db, token, spellbook.ClientIP(ctx))
 			if err != nil {
+				if _, ok := err.(spellbook.UnauthorizedError); ok {
+					log.Warningf(ctx, "%s", err.Error())
+				}
 				return ctx
 			}
 			u = sa
+		} else if DefaultJWTKeys != nil && isJWT(token) {
+			// signed access tokens carry the user and its permissions
+			us, session, err := userFromAccessToken(ctx, token)
+			if err != nil {
+				log.Debugf(ctx, "invalid access token: %s", err.Error())
+				return ctx
+			}
+			ctx = contextWithSession(ctx, session)
+			u = us
+		} else if _, ok := sessionIdFromToken(token); ok {
+			us, session, err := sqlUserFromSession(ctx, db, token)
+			if err != nil {
+				return ctx
+			}
+			sqlGrantRoles(ctx, db, &us)
+			us.applyTwoFactor(session)
+			if err := sqlImpersonate(ctx, db, &us, session); err != nil {
+				log.Warningf(ctx, "invalid impersonation of user %s: %s", us.Username(), err.Error())
+				return ctx
+			}
+			ctx = contextWithSession(ctx, session)
+			u = us
 		} else {
+			// tokens issued before sessions: they are accepted until they expire or the user logs out
 			us := User{}
-			err := db.Where("token = ?", token).First(&us).Error
-			if err != nil {
+			if err := sqlFromToken(ctx, db, &us, token, &us.SqlToken); err != nil {
 				return ctx
 			}
+			expired, started := us.legacyTokenExpired(time.Now().UTC())
+			if expired {
+				log.Debugf(ctx, "the token of user %s expired on %s", us.Username(), us.TokenExpires)
+				return ctx
+			}
+			if started {
+				if err := db.Model(&us).Update("token_expires", us.TokenExpires).Error; err != nil {
+					log.Errorf(ctx, "error recording the expiry of the token of user %s: %s", us.Username(), err.Error())
+				}
+			}
+			sqlGrantRoles(ctx, db, &us)
+			us.applyTwoFactor(nil)
 			u = us
 		}
 
@@ -45,6 +86,124 @@ func (authenticator SqlAuthenticator) Authenticate(ctx context.Context) context.
 	return ctx
 }
 
+// grants the user the permissions of its roles and groups.
+// If they can't be resolved the user is authenticated with its own permissions only
+func sqlGrantRoles(ctx context.Context, db *gorm.DB, u *User) {
+	roles, err := sqlLoadRoles(db, u.Roles, u.Groups)
+	if err != nil {
+		log.Errorf(ctx, "error resolving the roles of user %s: %s", u.Username(), err.Error())
+		return
+	}
+	u.effective = rolesPermission(roles)
+	u.twoFactorRole = rolesRequireTwoFactor(roles)
+}
+
+// retrieves the user or the service account with the given token into dst.
+// stored is the token column of dst: legacy plaintext tokens are replaced with their hash
+func sqlFromToken(ctx context.Context, db *gorm.DB, dst interface{}, token string, stored *dsql.NullString) error {
+	err := db.Where("token = ?", HashToken(token)).First(dst).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = db.Where("token = ?", token).First(dst).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	ok, legacy := MatchToken(token, stored.String)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	if legacy {
+		if err := db.Model(dst).Update("token", HashToken(token)).Error; err != nil {
+			log.Errorf(ctx, "error hashing legacy token: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Replaces the plaintext tokens of users and service accounts stored before tokens were hashed.
+// Tokens are otherwise migrated on their first use
+func MigrateSqlTokens(ctx context.Context) error {
+	db := sql.FromContext(ctx)
+	legacy := db.Where("token IS NOT NULL AND token NOT LIKE ?", tokenHashPrefix+"%")
+
+	var users []*User
+	if err := legacy.Find(&users).Error; err != nil {
+		return fmt.Errorf("error retrieving legacy user tokens: %s", err.Error())
+	}
+	for _, u := range users {
+		if err := db.Model(u).Update("token", HashToken(u.SqlToken.String)).Error; err != nil {
+			return fmt.Errorf("error hashing the token of user %s: %s", u.Username(), err.Error())
+		}
+	}
+
+	var sas []*ServiceAccount
+	if err := legacy.Find(&sas).Error; err != nil {
+		return fmt.Errorf("error retrieving legacy service account tokens: %s", err.Error())
+	}
+	for _, sa := range sas {
+		if err := db.Model(sa).Update("token", HashToken(sa.SqlToken.String)).Error; err != nil {
+			return fmt.Errorf("error hashing the token of service account %s: %s", sa.Label, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Moves the permissions of users, service accounts, keys and roles stored as bitmasks, before the permission registry,
+// to the grants column. Bitmasks are otherwise read as they are, and migrated when the record is saved
+func MigrateSqlPermissions(ctx context.Context) error {
+	db := sql.FromContext(ctx)
+	legacy := db.Where("permission <> 0")
+
+	var users []*User
+	if err := legacy.Find(&users).Error; err != nil {
+		return fmt.Errorf("error retrieving users with legacy permissions: %s", err.Error())
+	}
+	for _, u := range users {
+		u.migratePermission()
+		if err := db.Model(u).Updates(map[string]interface{}{"grants": u.Grants, "permission": 0}).Error; err != nil {
+			return fmt.Errorf("error migrating the permissions of user %s: %s", u.Username(), err.Error())
+		}
+	}
+
+	var sas []*ServiceAccount
+	if err := legacy.Find(&sas).Error; err != nil {
+		return fmt.Errorf("error retrieving service accounts with legacy permissions: %s", err.Error())
+	}
+	for _, sa := range sas {
+		sa.migratePermission()
+		if err := db.Model(sa).Updates(map[string]interface{}{"grants": sa.Grants, "permission": 0}).Error; err != nil {
+			return fmt.Errorf("error migrating the permissions of service account %s: %s", sa.Label, err.Error())
+		}
+	}
+
+	var keys []*ServiceAccountKey
+	if err := legacy.Find(&keys).Error; err != nil {
+		return fmt.Errorf("error retrieving service account keys with legacy permissions: %s", err.Error())
+	}
+	for _, key := range keys {
+		key.migratePermission()
+		if err := db.Model(key).Updates(map[string]interface{}{"grants": key.Grants, "permission": 0}).Error; err != nil {
+			return fmt.Errorf("error migrating the permissions of service account key %s: %s", key.KeyId, err.Error())
+		}
+	}
+
+	var roles []*Role
+	if err := legacy.Find(&roles).Error; err != nil {
+		return fmt.Errorf("error retrieving roles with legacy permissions: %s", err.Error())
+	}
+	for _, role := range roles {
+		role.migratePermission()
+		if err := db.Model(role).Updates(map[string]interface{}{"grants": role.Grants, "permission": 0}).Error; err != nil {
+			return fmt.Errorf("error migrating the permissions of role %s: %s", role.Id(), err.Error())
+		}
+	}
+
+	return nil
+}
+
 type SqlGSupportAuthenticator struct {
 	flamel.Authenticator
 }
@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook/sql"
+	"google.golang.org/appengine/log"
+	"sync"
+	"time"
+)
+
+// DeniedSession is a session whose signed access tokens are revoked until Expires
+type DeniedSession struct {
+	Id      string    `gorm:"PRIMARY_KEY;column:id"`
+	Expires time.Time `gorm:"NOT NULL;INDEX:idx_denied_sessions_expires"`
+}
+
+// SqlTokenDenyList keeps the revoked sessions in the denied_sessions table, so that they are shared between instances.
+// Each instance keeps a copy of the table, loaded again at most once per Refresh, so that checking a token
+// doesn't cost a query: revocations made by other instances apply within Refresh
+type SqlTokenDenyList struct {
+	Refresh time.Duration
+
+	mu     sync.RWMutex
+	denied map[string]time.Time
+	loaded time.Time
+}
+
+func NewSqlTokenDenyList(refresh time.Duration) *SqlTokenDenyList {
+	return &SqlTokenDenyList{Refresh: refresh}
+}
+
+// the revocation is stored with an upsert that keeps the latest expiration, and expired entries are deleted
+func (list *SqlTokenDenyList) Deny(ctx context.Context, id string, until time.Time) error {
+	db := sql.FromContext(ctx)
+	err := db.Exec(`INSERT INTO denied_sessions (id, expires) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET expires = GREATEST(denied_sessions.expires, EXCLUDED.expires)`, id, until).Error
+	if err != nil {
+		return err
+	}
+
+	if err := db.Where("expires <= ?", time.Now().UTC()).Delete(&DeniedSession{}).Error; err != nil {
+		log.Errorf(ctx, "error pruning the denied sessions: %s", err.Error())
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if list.denied != nil && until.After(list.denied[id]) {
+		list.denied[id] = until
+	}
+	return nil
+}
+
+// Fails only if the table has never been loaded: afterwards a failed reload is logged and the last copy is used
+func (list *SqlTokenDenyList) Denied(ctx context.Context, id string) (bool, error) {
+	now := time.Now()
+	list.mu.RLock()
+	stale := list.denied == nil || now.Sub(list.loaded) >= list.Refresh
+	list.mu.RUnlock()
+
+	if stale {
+		if err := list.load(ctx, now); err != nil {
+			list.mu.RLock()
+			loaded := list.denied != nil
+			list.mu.RUnlock()
+			if !loaded {
+				return false, err
+			}
+			log.Errorf(ctx, "error loading the denied sessions: %s", err.Error())
+		}
+	}
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	until, ok := list.denied[id]
+	return ok && now.Before(until), nil
+}
+
+func (list *SqlTokenDenyList) load(ctx context.Context, now time.Time) error {
+	var sessions []*DeniedSession
+	db := sql.FromContext(ctx)
+	if err := db.Where("expires > ?", now.UTC()).Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	denied := make(map[string]time.Time, len(sessions))
+	for _, s := range sessions {
+		denied[s.Id] = s.Expires
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.denied = denied
+	list.loaded = now
+	return nil
+}
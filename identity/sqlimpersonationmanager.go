@@ -0,0 +1,112 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+)
+
+func NewSqlImpersonationController() *spellbook.RestController {
+	return NewSqlImpersonationControllerWithKey("")
+}
+
+func NewSqlImpersonationControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlImpersonationManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// SqlImpersonationManager issues the access tokens of the impersonations.
+// POST with the username returns an access token of the user, valid for ImpersonationDuration.
+// Users with PermissionImpersonate can impersonate the users whose permissions they all have.
+// Impersonations end when they expire, or are revoked like any other session
+type SqlImpersonationManager struct{}
+
+func (manager SqlImpersonationManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Impersonation{}, nil
+}
+
+func (manager SqlImpersonationManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlImpersonationManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlImpersonationManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlImpersonationManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionImpersonate) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionImpersonate))
+	}
+
+	impersonation := res.(*Impersonation)
+	if err := spellbook.ValidateStruct(impersonation); err != nil {
+		return err
+	}
+
+	target := User{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("username = ?", impersonation.Username).First(&target).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve user %s: %s", impersonation.Username, err.Error())
+		return err
+	}
+	sqlGrantRoles(ctx, db, &target)
+
+	if err := checkImpersonation(ctx, current, &target); err != nil {
+		return err
+	}
+
+	session, err := newImpersonationSession(ctx, current, &target)
+	if err != nil {
+		return err
+	}
+	if err := db.Create(session).Error; err != nil {
+		return fmt.Errorf("error saving the impersonation of user %s: %s", target.Username(), err.Error())
+	}
+
+	log.Infof(ctx, "user %s started impersonating user %s until %s", current.Username(), target.Username(), session.Expires)
+	impersonation.Impersonator = current.Username()
+	session.toToken(&impersonation.token)
+	return signAccessToken(target, session, &impersonation.token)
+}
+
+func (manager SqlImpersonationManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SqlImpersonationManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// sets the impersonator of the user of an impersonation session.
+// Fails if the impersonator can't impersonate the user anymore
+func sqlImpersonate(ctx context.Context, db *gorm.DB, u *User, session *Session) error {
+	if session.Impersonator == "" {
+		return nil
+	}
+
+	actor := User{}
+	if err := db.Where("username = ?", session.Impersonator).First(&actor).Error; err != nil {
+		return err
+	}
+	sqlGrantRoles(ctx, db, &actor)
+	if !actor.IsEnabled() || !actor.HasPermission(spellbook.PermissionImpersonate) {
+		return spellbook.NewUnauthorizedError(fmt.Sprintf("user %s can't impersonate anymore", actor.Username()))
+	}
+	if err := checkImpersonable(actor, u); err != nil {
+		return err
+	}
+
+	u.impersonator = &actor
+	return nil
+}
@@ -0,0 +1,200 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+func NewSqlOIDCLoginController() *spellbook.RestController {
+	return NewSqlOIDCLoginControllerWithKey("")
+}
+
+func NewSqlOIDCLoginControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlOIDCLoginManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlOIDCLoginManager logs the users in with the registered OpenID Connect providers.
+// POST starts the login and returns the address of the provider and the state,
+// PUT at the state with the code returned by the provider opens the session.
+// Users are found by their account of the provider, then by verified email if the provider links them,
+// and are created if the provider provisions them
+type SqlOIDCLoginManager struct{}
+
+func (manager SqlOIDCLoginManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &OIDCLogin{}, nil
+}
+
+// returns the login waiting for the code. Expired logins don't exist
+func (manager SqlOIDCLoginManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	state := OIDCState{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("hash = ?", HashToken(id)).First(&state).Error; err != nil {
+		return nil, err
+	}
+	if !time.Now().UTC().Before(state.Expires) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &OIDCLogin{Provider: state.Provider, RedirectURI: state.RedirectURI, State: id, state: &state}, nil
+}
+
+func (manager SqlOIDCLoginManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlOIDCLoginManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlOIDCLoginManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	login := res.(*OIDCLogin)
+	provider, state, err := startOIDCLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	db := sql.FromContext(ctx)
+	if err := db.Create(state).Error; err != nil {
+		return fmt.Errorf("error saving a login with provider %s: %s", provider.Name, err.Error())
+	}
+	return nil
+}
+
+// exchanges the code for the id token of the user and opens its session
+func (manager SqlOIDCLoginManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	login := res.(*OIDCLogin)
+	code, err := oidcCode(bundle)
+	if err != nil {
+		return err
+	}
+
+	// the state is spent before the code is exchanged, so that it can't be replayed by concurrent requests
+	db := sql.FromContext(ctx)
+	result := db.Where("hash = ?", login.state.Id()).Delete(&OIDCState{})
+	if result.Error != nil {
+		return fmt.Errorf("error deleting a login with provider %s: %s", login.Provider, result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	provider, claims, err := completeOIDCLogin(ctx, login.state, code)
+	if err != nil {
+		return err
+	}
+
+	u, err := sqlOIDCUser(ctx, db, provider, claims)
+	if err != nil {
+		return err
+	}
+	if !u.IsEnabled() {
+		return spellbook.NewUnauthorizedError(fmt.Sprintf("user %s is not enabled", u.Username()))
+	}
+
+	login.token = &Token{}
+	// the second factor of the user is checked, unless the provider already did and it's trusted to
+	mfa := provider.multiFactor(claims)
+	if u.TOTPEnabled && !mfa {
+		tkn, challenge, err := sqlIssueActionToken(db, *u, ActionTwoFactorChallenge, TwoFactorChallengeDuration)
+		if err != nil {
+			return err
+		}
+		login.token.Challenge = tkn
+		login.token.Expires = challenge.Expires
+		return nil
+	}
+
+	sqlGrantRoles(ctx, db, u)
+	login.token.EnrollTwoFactor = u.RequiresTwoFactor() && !mfa
+	return sqlOpenSession(ctx, db, *u, login.token, mfa)
+}
+
+func (manager SqlOIDCLoginManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// returns the user of the account of the provider, linking or creating it if the provider allows it
+func sqlOIDCUser(ctx context.Context, db *gorm.DB, provider *OIDCProvider, claims OIDCClaims) (*User, error) {
+	u := User{}
+	err := db.Where("oidc_issuer = ? AND oidc_subject = ?", provider.Issuer, claims.String("sub")).First(&u).Error
+	if err == nil {
+		if syncOIDCUser(provider, claims, &u) {
+			if err := sqlSaveOIDCUser(db, &u); err != nil {
+				return nil, fmt.Errorf("error updating the permissions of user %s: %s", u.Username(), err.Error())
+			}
+		}
+		return &u, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("error retrieving the user of %s: %s", claims.String("sub"), err.Error())
+	}
+
+	email := claims.String("email")
+	if provider.LinkByEmail && email != "" && claims.EmailVerified() {
+		// users already linked to another account are not linked again
+		u := User{}
+		err := db.Where("email = ? AND (oidc_subject IS NULL OR oidc_subject = '')", email).First(&u).Error
+		if err == nil {
+			u.OIDCIssuer = provider.Issuer
+			u.OIDCSubject = claims.String("sub")
+			if u.EmailVerified.IsZero() {
+				u.EmailVerified = time.Now().UTC()
+			}
+			syncOIDCUser(provider, claims, &u)
+			if err := sqlSaveOIDCUser(db, &u); err != nil {
+				return nil, fmt.Errorf("error linking user %s to provider %s: %s", u.Username(), provider.Name, err.Error())
+			}
+			log.Infof(ctx, "linked user %s to provider %s", u.Username(), provider.Name)
+			return &u, nil
+		}
+		if !gorm.IsRecordNotFoundError(err) {
+			return nil, fmt.Errorf("error retrieving the users with email %s: %s", email, err.Error())
+		}
+	}
+
+	if !provider.Provision {
+		return nil, spellbook.NewUnauthorizedError(fmt.Sprintf("no user is linked to this account of %s", provider.Name))
+	}
+
+	u = newOIDCUser(provider, claims)
+	if u.Email != "" {
+		if err := sqlCheckEmail(db, "", u.Email); err != nil {
+			return nil, err
+		}
+	}
+	username, err := oidcUsername(provider, claims, func(username string) (bool, error) {
+		var count int
+		err := db.Model(&User{}).Where("username = ?", username).Count(&count).Error
+		return count > 0, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u.SqlUsername = username
+	if err := db.Create(&u).Error; err != nil {
+		return nil, fmt.Errorf("error creating user %s: %s", username, err.Error())
+	}
+	log.Infof(ctx, "created user %s for provider %s", username, provider.Name)
+	return &u, nil
+}
+
+// stores the link to the provider, and the permissions and the roles it syncs
+func sqlSaveOIDCUser(db *gorm.DB, u *User) error {
+	fields := map[string]interface{}{
+		"oidc_issuer":    u.OIDCIssuer,
+		"oidc_subject":   u.OIDCSubject,
+		"email_verified": u.EmailVerified,
+		"grants":         u.Grants,
+		"permission":     u.Permission,
+		"roles":          joinNames(u.Roles),
+	}
+	return db.Model(u).Updates(fields).Error
+}
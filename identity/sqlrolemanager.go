@@ -0,0 +1,471 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+)
+
+// fields that can be used to filter and order roles
+var roleColumns = sql.Columns{
+	"name":        "name",
+	"description": "description",
+}
+
+// fields that can be used to filter and order groups
+var groupColumns = sql.Columns{
+	"name":        "name",
+	"description": "description",
+}
+
+func NewSqlRoleController() *spellbook.RestController {
+	return NewSqlRoleControllerWithKey("")
+}
+
+func NewSqlRoleControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlRoleManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlRoleManager manages the roles.
+// Roles are read with PermissionReadUser and written with PermissionEditPermissions
+type SqlRoleManager struct{}
+
+func (manager SqlRoleManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Role{}, nil
+}
+
+func (manager SqlRoleManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	role := Role{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("name = ?", id).First(&role).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve role %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (manager SqlRoleManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlRoleManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var roles []*Role
+	db := sql.FromContext(ctx)
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, roleColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &Role{}, opts, roleColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&roles); res.Error != nil {
+		log.Errorf(ctx, "error retrieving roles: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(roles) > opts.Size {
+		roles = roles[:opts.Size]
+		next, err = sql.NewCursor(db, roles[len(roles)-1], opts, roleColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(roles))
+	for i := range roles {
+		resources[i] = roles[i]
+	}
+	return resources, next, nil
+}
+
+func (manager SqlRoleManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	db := sql.FromContext(ctx).Model(&Role{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, roleColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting roles: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlRoleManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlRoleManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	role := res.(*Role)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{role.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	db := sql.FromContext(ctx)
+	err := db.Where("name = ?", role.name).First(&Role{}).Error
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("role %s already exists", role.name))
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	role.SqlName = role.name
+	if err := db.Create(role).Error; err != nil {
+		return fmt.Errorf("error creating role %s: %s", role.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates the description and the permissions of the role
+func (manager SqlRoleManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*Role)
+	role := res.(*Role)
+	role.Description = other.Description
+	role.RequireTwoFactor = other.RequireTwoFactor
+	role.SetPermissions(other.Grants)
+
+	db := sql.FromContext(ctx)
+	return db.Save(role).Error
+}
+
+// deletes the role. Users and groups that still reference it are no longer granted its permissions
+func (manager SqlRoleManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	role := res.(*Role)
+
+	// the role is locked, so that it can't be assigned while it's deleted
+	tx := sql.FromContext(ctx).Begin()
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&Role{}, "name = ?", role.Id()).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := sqlCheckRoleUnassigned(tx, role.Id()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Delete(role).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting role %s: %s", role.Id(), err.Error())
+	}
+
+	return tx.Commit().Error
+}
+
+// returns a ConflictError if the role is assigned to a user, a group or a service account
+func sqlCheckRoleUnassigned(db *gorm.DB, name string) error {
+	holders := []struct {
+		model interface{}
+		kind  string
+	}{
+		{&User{}, "users"},
+		{&Group{}, "groups"},
+		{&ServiceAccount{}, "service accounts"},
+	}
+
+	for _, holder := range holders {
+		count := 0
+		if err := db.Model(holder.model).Where("? = ANY(string_to_array(roles, ','))", name).Count(&count).Error; err != nil {
+			return fmt.Errorf("error retrieving the %s with role %s: %s", holder.kind, name, err.Error())
+		}
+		if count > 0 {
+			return spellbook.NewConflictError(fmt.Sprintf("role %s is assigned to %d %s", name, count, holder.kind))
+		}
+	}
+	return nil
+}
+
+func NewSqlGroupController() *spellbook.RestController {
+	return NewSqlGroupControllerWithKey("")
+}
+
+func NewSqlGroupControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlGroupManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlGroupManager manages the groups. Users join a group when the group is added to their groups.
+// Groups are read with PermissionReadUser and written with PermissionEditPermissions
+type SqlGroupManager struct{}
+
+func (manager SqlGroupManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Group{}, nil
+}
+
+func (manager SqlGroupManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	group := Group{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("name = ?", id).First(&group).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve group %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (manager SqlGroupManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlGroupManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var groups []*Group
+	db := sql.FromContext(ctx)
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, groupColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &Group{}, opts, groupColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&groups); res.Error != nil {
+		log.Errorf(ctx, "error retrieving groups: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(groups) > opts.Size {
+		groups = groups[:opts.Size]
+		next, err = sql.NewCursor(db, groups[len(groups)-1], opts, groupColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(groups))
+	for i := range groups {
+		resources[i] = groups[i]
+	}
+	return resources, next, nil
+}
+
+func (manager SqlGroupManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	db := sql.FromContext(ctx).Model(&Group{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, groupColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting groups: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlGroupManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlGroupManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	group := res.(*Group)
+	meta := struct {
+		Name string `json:"name" validate:"required,slug"`
+	}{group.name}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	db := sql.FromContext(ctx)
+	if err := sqlCheckNames(db, &Role{}, "roles", group.Roles); err != nil {
+		return err
+	}
+
+	err := db.Where("name = ?", group.name).First(&Group{}).Error
+	if err == nil {
+		return spellbook.NewConflictError(fmt.Sprintf("group %s already exists", group.name))
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	group.SqlName = group.name
+	if err := db.Create(group).Error; err != nil {
+		return fmt.Errorf("error creating group %s: %s", group.name, err.Error())
+	}
+
+	return nil
+}
+
+// updates the description and the roles of the group
+func (manager SqlGroupManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*Group)
+	db := sql.FromContext(ctx)
+	if err := sqlCheckNames(db, &Role{}, "roles", other.Roles); err != nil {
+		return err
+	}
+
+	group := res.(*Group)
+	group.Description = other.Description
+	group.Roles = other.Roles
+
+	return db.Save(group).Error
+}
+
+// deletes the group. Its members are no longer granted its roles
+func (manager SqlGroupManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionEditPermissions) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	group := res.(*Group)
+
+	db := sql.FromContext(ctx)
+	if err := db.Delete(group).Error; err != nil {
+		return fmt.Errorf("error deleting group %s: %s", group.Id(), err.Error())
+	}
+
+	return nil
+}
+
+// returns a FieldError if one of the names isn't the name of a stored role or group
+func sqlCheckNames(db *gorm.DB, model interface{}, field string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var found []string
+	if err := db.Model(model).Where("name IN (?)", names).Pluck("name", &found).Error; err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool, len(found))
+	for _, name := range found {
+		exists[name] = true
+	}
+	for _, name := range names {
+		if !exists[name] {
+			return spellbook.NewFieldError(field, fmt.Errorf("%s doesn't exist", name))
+		}
+	}
+	return nil
+}
+
+// returns the permissions granted by the roles, and by the roles of the groups.
+// Roles and groups that no longer exist grant nothing
+func sqlResolveRoles(db *gorm.DB, roles []string, groups []string) (spellbook.PermissionSet, error) {
+	rs, err := sqlLoadRoles(db, roles, groups)
+	if err != nil {
+		return nil, err
+	}
+	return rolesPermission(rs), nil
+}
+
+// returns the roles, and the roles of the groups, that still exist
+func sqlLoadRoles(db *gorm.DB, roles []string, groups []string) ([]*Role, error) {
+	var gs []*Group
+	if len(groups) > 0 {
+		if err := db.Where("name IN (?)", groups).Find(&gs).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	names := roleNames(roles, gs)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var rs []*Role
+	if err := db.Where("name IN (?)", names).Find(&rs).Error; err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
@@ -0,0 +1,497 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"net"
+	"strings"
+	"time"
+)
+
+// fields that can be used to filter and order service account keys
+var serviceAccountKeyColumns = sql.Columns{
+	"account":  "account",
+	"name":     "name",
+	"created":  "created",
+	"expires":  "expires",
+	"lastUsed": "last_used",
+}
+
+func NewSqlServiceAccountKeyController() *spellbook.RestController {
+	return NewSqlServiceAccountKeyControllerWithKey("")
+}
+
+func NewSqlServiceAccountKeyControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlServiceAccountKeyManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	return c
+}
+
+// SqlServiceAccountKeyManager manages the keys of the service accounts.
+// A key is rotated by creating a key that "rotates" the old one:
+// the new key inherits the name and the permissions of the old key, unless given,
+// and the old key expires after the "overlap" seconds, so that clients can switch to the new key without downtime.
+// Keys are created with PermissionWriteUser, but only PermissionEditPermissions can issue keys that grant permissions:
+// without it new keys grant nothing
+type SqlServiceAccountKeyManager struct{}
+
+func (manager SqlServiceAccountKeyManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &ServiceAccountKey{}, nil
+}
+
+func (manager SqlServiceAccountKeyManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	key := ServiceAccountKey{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("id = ?", id).First(&key).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve service account key %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (manager SqlServiceAccountKeyManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlServiceAccountKeyManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	var keys []*ServiceAccountKey
+	db := sql.FromContext(ctx)
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, serviceAccountKeyColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &ServiceAccountKey{}, opts, serviceAccountKeyColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&keys); res.Error != nil {
+		log.Errorf(ctx, "error retrieving service account keys: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(keys) > opts.Size {
+		keys = keys[:opts.Size]
+		next, err = sql.NewCursor(db, keys[len(keys)-1], opts, serviceAccountKeyColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(keys))
+	for i := range keys {
+		resources[i] = keys[i]
+	}
+	return resources, next, nil
+}
+
+func (manager SqlServiceAccountKeyManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	db := sql.FromContext(ctx).Model(&ServiceAccountKey{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, serviceAccountKeyColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting service account keys: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlServiceAccountKeyManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlServiceAccountKeyManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionWriteUser) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+
+	key := res.(*ServiceAccountKey)
+	db := sql.FromContext(ctx)
+	now := time.Now().UTC()
+
+	var rotated *ServiceAccountKey
+	if key.rotates != "" {
+		rotated = &ServiceAccountKey{}
+		if err := db.Where("id = ?", key.rotates).First(rotated).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return spellbook.NewFieldError("rotates", fmt.Errorf("key %s doesn't exist", key.rotates))
+			}
+			return err
+		}
+
+		if key.overlap < 0 {
+			return spellbook.NewFieldError("overlap", errors.New("overlap can't be negative"))
+		}
+
+		if key.Account == "" {
+			key.Account = rotated.Account
+		}
+		if key.Account != rotated.Account {
+			return spellbook.NewFieldError("rotates", fmt.Errorf("key %s belongs to another account", key.rotates))
+		}
+		if key.Name == "" {
+			key.Name = rotated.Name
+		}
+		if key.Grants.IsEmpty() {
+			key.SetPermissions(rotated.permissions())
+		}
+
+		// the old key keeps working during the overlap, but never longer than it would have
+		expires := now.Add(key.overlap)
+		if rotated.Expires.IsZero() || expires.Before(rotated.Expires) {
+			rotated.Expires = expires
+		}
+	}
+
+	if err := spellbook.ValidateStruct(key); err != nil {
+		return err
+	}
+
+	sa := ServiceAccount{}
+	if err := db.Where("label = ?", key.Account).First(&sa).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return spellbook.NewFieldError("account", fmt.Errorf("service account %s doesn't exist", key.Account))
+		}
+		return err
+	}
+
+	sqlGrantServiceAccountRoles(ctx, db, &sa)
+
+	// the token of the key carries its permissions, inherited ones included
+	editor := current.HasPermission(spellbook.PermissionEditPermissions)
+	if !editor && !key.Grants.IsEmpty() {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	// keys without permissions grant every permission of the account, if issued by an editor of the permissions
+	if editor && key.Grants.IsEmpty() {
+		key.SetPermissions(sa.permissions().Union(sa.effective))
+	}
+
+	if err := validateKey(key, sa, now); err != nil {
+		return err
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	key.KeyId = id
+	key.Created = now
+	key.setToken(ServiceAccountTokenGenerator{}.GenerateToken())
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Create(key).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error creating key %s of service account %s: %s", key.Name, key.Account, err.Error())
+	}
+
+	if rotated != nil {
+		if err := tx.Model(rotated).Update("expires", rotated.Expires).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error rotating key %s: %s", rotated.KeyId, err.Error())
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// checks that the key grants a subset of the permissions of the account, roles included, and that it doesn't expire in the past
+func validateKey(key *ServiceAccountKey, sa ServiceAccount, now time.Time) error {
+	if !sa.permissions().Union(sa.effective).Contains(key.permissions()) {
+		return spellbook.NewFieldError("permissions", fmt.Errorf("the key can't have permissions that account %s doesn't have", sa.Label))
+	}
+
+	if !key.Expires.IsZero() && !key.Expires.After(now) {
+		return spellbook.NewFieldError("expires", errors.New("the key can't expire in the past"))
+	}
+
+	return nil
+}
+
+// updates the name, the permissions and the expiry of the key
+func (manager SqlServiceAccountKeyManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionWriteUser) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+
+	o, _ := manager.NewResource(ctx)
+	if err := o.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	other := o.(*ServiceAccountKey)
+	key := res.(*ServiceAccountKey)
+
+	if !current.HasPermission(spellbook.PermissionEditPermissions) && !key.permissions().Equal(other.Grants) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+
+	key.Name = other.Name
+	key.SetPermissions(other.Grants)
+	key.Expires = other.Expires
+
+	if err := spellbook.ValidateStruct(key); err != nil {
+		return err
+	}
+
+	db := sql.FromContext(ctx)
+	sa := ServiceAccount{}
+	if err := db.Where("label = ?", key.Account).First(&sa).Error; err != nil {
+		return err
+	}
+	sqlGrantServiceAccountRoles(ctx, db, &sa)
+
+	if err := validateKey(key, sa, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return db.Save(key).Error
+}
+
+// revokes the key
+func (manager SqlServiceAccountKeyManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil || !current.HasPermission(spellbook.PermissionWriteUser) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+
+	key := res.(*ServiceAccountKey)
+
+	db := sql.FromContext(ctx)
+	if err := db.Delete(key).Error; err != nil {
+		return fmt.Errorf("error deleting service account key %s: %s", key.KeyId, err.Error())
+	}
+
+	return nil
+}
+
+// retrieves the service account of the token, if it can be used from the address.
+// The token is either one of the keys of the account, in which case the account is granted the permissions of the key,
+// or the token of the account issued before keys, which is migrated to a key on its first use.
+// The use is recorded only once every check passed
+func sqlServiceAccountFromToken(ctx context.Context, db *gorm.DB, token string, ip net.IP) (ServiceAccount, error) {
+	sa := ServiceAccount{}
+	key := ServiceAccountKey{}
+	err := db.Where("token = ?", HashToken(token)).First(&key).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return sa, err
+	}
+	legacy := err != nil
+	now := time.Now().UTC()
+
+	if legacy {
+		// tokens stored before they were hashed are still in plaintext, see MigrateSqlTokens
+		if err := db.Where("token = ? OR token = ?", HashToken(token), token).First(&sa).Error; err != nil {
+			return sa, err
+		}
+		if ok, _ := MatchToken(token, sa.SqlToken.String); !ok {
+			return sa, gorm.ErrRecordNotFound
+		}
+		sqlGrantServiceAccountRoles(ctx, db, &sa)
+	} else {
+		if ok, _ := MatchToken(token, key.Token); !ok || key.expired(now) {
+			return sa, spellbook.NewUnauthorizedError("invalid or expired key")
+		}
+
+		if err := db.Where("label = ?", key.Account).First(&sa).Error; err != nil {
+			return sa, err
+		}
+		// the key restricts the roles of the account too
+		sqlGrantServiceAccountRoles(ctx, db, &sa)
+		sa.SetPermissions(sa.permissions().Intersect(key.permissions()))
+		sa.effective = sa.effective.Intersect(key.permissions())
+	}
+
+	if !sa.AllowsIP(ip) {
+		return sa, spellbook.NewUnauthorizedError(fmt.Sprintf("service account %s can't be used from %s", sa.Label, ip))
+	}
+
+	if legacy {
+		if err := sqlMigrateServiceAccountToken(db, &sa, sa.SqlToken.String, now, ip.String()); err != nil {
+			log.Errorf(ctx, "error migrating the token of service account %s to a key: %s", sa.Label, err.Error())
+		}
+	} else if key.touch(now, ip.String()) {
+		err := db.Model(&key).Updates(map[string]interface{}{"last_used": key.LastUsed, "last_used_ip": key.LastUsedIP}).Error
+		if err != nil {
+			log.Errorf(ctx, "error recording the use of key %s: %s", key.KeyId, err.Error())
+		}
+	}
+
+	return sa, nil
+}
+
+// the name of the keys that hold the token of an account, see sqlMigrateServiceAccountToken
+const serviceAccountTokenKeyName = "account token"
+
+// replaces the token of the account issued before keys with a key that has the same token.
+// The key grants the permissions the account has, roles included: they must be resolved.
+// stored is the token column of the account, which is hashed if it's a legacy plaintext token.
+// The account token is removed in the same transaction: if another migration removed it first, nothing is done
+func sqlMigrateServiceAccountToken(db *gorm.DB, sa *ServiceAccount, stored string, now time.Time, ip string) error {
+	id, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	hash := stored
+	if !strings.HasPrefix(stored, tokenHashPrefix) {
+		hash = HashToken(stored)
+	}
+
+	key := ServiceAccountKey{
+		KeyId:      id,
+		Account:    sa.Label,
+		Name:       serviceAccountTokenKeyName,
+		Token:      hash,
+		Created:    now,
+		LastUsed:   now,
+		LastUsedIP: ip,
+	}
+	key.SetPermissions(sa.permissions().Union(sa.effective))
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	res := tx.Model(&ServiceAccount{}).Where("label = ? AND token = ?", sa.Label, stored).Update("token", gorm.Expr("NULL"))
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	if err := tx.Create(&key).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error creating the key of service account %s: %s", sa.Label, err.Error())
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	sa.SqlToken.Valid = false
+	sa.SqlToken.String = ""
+	return nil
+}
+
+// deletes the token of the account, and its key, and replaces it with the given token, if any.
+// The clear token is kept in the Token of the account, so that it's sent to the client
+func sqlResetServiceAccountToken(ctx context.Context, db *gorm.DB, sa *ServiceAccount, tkn string) error {
+	// the key grants the permissions of the roles too
+	owner := *sa
+	sqlGrantServiceAccountRoles(ctx, db, &owner)
+	now := time.Now().UTC()
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Where("account = ? AND name = ?", sa.Label, serviceAccountTokenKeyName).Delete(&ServiceAccountKey{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting the token of service account %s: %s", sa.Label, err.Error())
+	}
+	sa.setToken("")
+	if err := tx.Model(sa).Update("token", gorm.Expr("NULL")).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting the token of service account %s: %s", sa.Label, err.Error())
+	}
+
+	if tkn != "" {
+		id, err := randomString(16)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		key := ServiceAccountKey{KeyId: id, Account: sa.Label, Name: serviceAccountTokenKeyName, Created: now}
+		key.SetPermissions(owner.permissions().Union(owner.effective))
+		key.setToken(tkn)
+		if err := tx.Create(&key).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error creating the token of service account %s: %s", sa.Label, err.Error())
+		}
+		sa.Token = tkn
+	}
+
+	return tx.Commit().Error
+}
+
+// Replaces the tokens of the service accounts issued before keys with keys, named "account token".
+// Tokens are otherwise migrated on their first use
+func MigrateSqlServiceAccountTokens(ctx context.Context) error {
+	db := sql.FromContext(ctx)
+
+	var sas []*ServiceAccount
+	if err := db.Where("token IS NOT NULL").Find(&sas).Error; err != nil {
+		return fmt.Errorf("error retrieving the service account tokens: %s", err.Error())
+	}
+
+	now := time.Now().UTC()
+	for _, sa := range sas {
+		permissions, err := sqlResolveRoles(db, sa.Roles, nil)
+		if err != nil {
+			return fmt.Errorf("error resolving the roles of service account %s: %s", sa.Label, err.Error())
+		}
+		sa.effective = permissions
+		// the key is not used yet
+		if err := sqlMigrateServiceAccountToken(db, sa, sa.SqlToken.String, now, ""); err != nil {
+			return fmt.Errorf("error migrating the token of service account %s: %s", sa.Label, err.Error())
+		}
+	}
+	return nil
+}
+
+// grants the service account the permissions of its roles.
+// If they can't be resolved the account is authenticated with its own permissions only
+func sqlGrantServiceAccountRoles(ctx context.Context, db *gorm.DB, sa *ServiceAccount) {
+	permission, err := sqlResolveRoles(db, sa.Roles, nil)
+	if err != nil {
+		log.Errorf(ctx, "error resolving the roles of service account %s: %s", sa.Label, err.Error())
+		return
+	}
+	sa.effective = permission
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"google.golang.org/appengine/log"
-	"strings"
 	"time"
 )
 
@@ -15,6 +14,15 @@ type SqlServiceAccountManager struct {
 	tg TokenGenerator
 }
 
+// fields that can be used to filter and order service accounts
+var serviceAccountColumns = sql.Columns{
+	"label":           "label",
+	"description":     "description",
+	"ip_restrictions": "ip_restrictions",
+	"permission":      "permission",
+	"created":         "created",
+}
+
 func NewDefaultSqlServiceAccountManager() SqlServiceAccountManager {
 	return SqlServiceAccountManager{ServiceAccountTokenGenerator{}}
 }
@@ -41,15 +49,13 @@ func (manager SqlServiceAccountManager) FromId(ctx context.Context, id string) (
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
 	}
 
-	sa, ok := current.(ServiceAccount)
-	if ok && id == sa.Id() {
-		return &sa, nil
-	}
-
-	if !current.HasPermission(spellbook.PermissionReadUser) {
+	// an account can read itself. It's read again because the authenticated account only has the permissions of its key
+	self, ok := current.(ServiceAccount)
+	if !(ok && id == self.Id()) && !current.HasPermission(spellbook.PermissionReadUser) {
 		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
 	}
 
+	sa := ServiceAccount{}
 	db := sql.FromContext(ctx)
 	if err := db.Where("label =  ?", id).First(&sa).Error; err != nil {
 		log.Errorf(ctx, "could not retrieve service account %s: %s", id, err.Error())
@@ -60,36 +66,52 @@ func (manager SqlServiceAccountManager) FromId(ctx context.Context, id string) (
 }
 
 func (manager SqlServiceAccountManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlServiceAccountManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 
 	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
 	}
 
 	var sas []*ServiceAccount
 	db := sql.FromContext(ctx)
-	db = db.Offset(opts.Page * opts.Size)
 
-	db = db.Where(sql.FiltersToCondition(opts.Filters, nil))
+	where, args, err := sql.FiltersToCondition(opts.Filters, serviceAccountColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
 
-	if opts.Order != "" {
-		dir := " asc"
-		if opts.Descending {
-			dir = " desc"
-		}
-		db = db.Order(fmt.Sprintf("%q %s", strings.ToLower(opts.Order), dir))
+	db, err = sql.Paginate(db, &ServiceAccount{}, opts, serviceAccountColumns)
+	if err != nil {
+		return nil, "", err
 	}
 
-	db = db.Limit(opts.Size + 1)
 	if res := db.Find(&sas); res.Error != nil {
 		log.Errorf(ctx, "error retrieving content: %s", res.Error.Error())
-		return nil, res.Error
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(sas) > opts.Size {
+		sas = sas[:opts.Size]
+		next, err = sql.NewCursor(db, sas[len(sas)-1], opts, serviceAccountColumns)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	resources := make([]spellbook.Resource, len(sas))
 	for i := range sas {
 		resources[i] = sas[i]
 	}
-	return resources, nil
+	return resources, next, nil
 }
 
 func (manager SqlServiceAccountManager) Patch(ctx context.Context, resource spellbook.Resource, fields map[string]interface{}) error {
@@ -98,14 +120,12 @@ func (manager SqlServiceAccountManager) Patch(ctx context.Context, resource spel
 	db := sql.FromContext(ctx)
 	for k, v := range fields {
 		if k == "token" {
-			// delete a token
-			if v == nil {
-				sa.setToken("")
-			} else {
-				tkn := manager.tg.GenerateToken()
-				sa.setToken(tkn)
+			// the token of the account is a key of the account: a new token replaces it, a null one deletes it
+			tkn := ""
+			if v != nil {
+				tkn = manager.tg.GenerateToken()
 			}
-			return db.Save(sa).Error
+			return sqlResetServiceAccountToken(ctx, db, sa, tkn)
 		}
 	}
 	return spellbook.NewFieldError("", errors.New("specified field can't be patched"))
@@ -128,17 +148,22 @@ func (manager SqlServiceAccountManager) Create(ctx context.Context, res spellboo
 
 	sa := res.(*ServiceAccount)
 
-	uf := spellbook.NewRawField("label", true, sa.Label)
-	uf.AddValidator(spellbook.DatastoreKeyNameValidator{})
-
-	// validate the username. Accepted values for the username are implementation dependent
-	if err := uf.Validate(); err != nil {
-		msg := fmt.Sprintf("invalid label %s for service account", sa.Id())
-		return spellbook.NewFieldError("label", errors.New(msg))
+	// accepted values for the label are implementation dependent
+	if err := spellbook.ValidateStruct(sa); err != nil {
+		return err
 	}
 
 	db := sql.FromContext(ctx)
 
+	if len(sa.Roles) > 0 {
+		if !current.HasPermission(spellbook.PermissionEditPermissions) {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
+		if err := sqlCheckNames(db, &Role{}, "roles", sa.Roles); err != nil {
+			return err
+		}
+	}
+
 	sa.Created = time.Now().UTC()
 	if err := db.Create(sa).Error; err != nil {
 		return fmt.Errorf("error creating service account %s: %s", sa.Label, err)
@@ -161,15 +186,32 @@ func (manager SqlServiceAccountManager) Update(ctx context.Context, res spellboo
 	other := o.(*ServiceAccount)
 	sa := res.(*ServiceAccount)
 
-	if !current.HasPermission(spellbook.PermissionEditPermissions) && sa.Permission != other.Permission {
+	if !current.HasPermission(spellbook.PermissionEditPermissions) && !sa.permissions().Equal(other.Grants) {
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
 	}
 
-	sa.Permission = other.Permission
-	sa.Description = other.Description
-	sa.IPRestrictions = other.IPRestrictions
+	// the restrictions are the only validated field that can be updated
+	meta := struct {
+		IPRestrictions string `json:"ipRestrictions" validate:"iplist"`
+	}{other.IPRestrictions}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
 
 	db := sql.FromContext(ctx)
+	if !sameNames(sa.Roles, other.Roles) {
+		if !current.HasPermission(spellbook.PermissionEditPermissions) {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
+		if err := sqlCheckNames(db, &Role{}, "roles", other.Roles); err != nil {
+			return err
+		}
+	}
+
+	sa.SetPermissions(other.Grants)
+	sa.Roles = other.Roles
+	sa.Description = other.Description
+	sa.IPRestrictions = other.IPRestrictions
 
 	return db.Save(sa).Error
 }
@@ -187,5 +229,9 @@ func (manager SqlServiceAccountManager) Delete(ctx context.Context, res spellboo
 		return fmt.Errorf("error deleting service account %s: %s", sa.Label, err.Error())
 	}
 
+	if err := db.Where("account = ?", sa.Label).Delete(&ServiceAccountKey{}).Error; err != nil {
+		return fmt.Errorf("error deleting the keys of service account %s: %s", sa.Label, err.Error())
+	}
+
 	return nil
 }
@@ -0,0 +1,298 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+// fields that can be used to filter and order sessions
+var sessionColumns = sql.Columns{
+	"userAgent": "user_agent",
+	"ip":        "ip",
+	"created":   "created",
+	"lastUsed":  "last_used",
+	"expires":   "expires",
+}
+
+func NewSqlSessionController() *spellbook.RestController {
+	return NewSqlSessionControllerWithKey("")
+}
+
+func NewSqlSessionControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlSessionManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// SqlSessionManager lists and revokes the sessions of the current user.
+// Users with PermissionReadUser and PermissionWriteUser can read and revoke the sessions of every user
+type SqlSessionManager struct{}
+
+func (manager SqlSessionManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Session{}, nil
+}
+
+func (manager SqlSessionManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	session := Session{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("id = ?", id).First(&session).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve session %s: %s", id, err.Error())
+		return nil, err
+	}
+
+	if !ownSession(ctx, &session) && !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	return &session, nil
+}
+
+func (manager SqlSessionManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+// lists the sessions of the current user
+func (manager SqlSessionManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	var sessions []*Session
+	db := sql.FromContext(ctx).Where("username = ?", current.Username())
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, sessionColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	db, err = sql.Paginate(db, &Session{}, opts, sessionColumns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res := db.Find(&sessions); res.Error != nil {
+		log.Errorf(ctx, "error retrieving sessions: %s", res.Error.Error())
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(sessions) > opts.Size {
+		sessions = sessions[:opts.Size]
+		next, err = sql.NewCursor(db, sessions[len(sessions)-1], opts, sessionColumns)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	resources := make([]spellbook.Resource, len(sessions))
+	for i := range sessions {
+		resources[i] = sessions[i]
+	}
+	return resources, next, nil
+}
+
+func (manager SqlSessionManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	db := sql.FromContext(ctx).Model(&Session{}).Where("username = ?", current.Username())
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, sessionColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting sessions: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
+}
+
+func (manager SqlSessionManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlSessionManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	// sessions are opened by the token controller
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SqlSessionManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// revokes the session
+func (manager SqlSessionManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	current := spellbook.IdentityFromContext(ctx)
+	session := res.(*Session)
+	if current == nil || (!ownSession(ctx, session) && !current.HasPermission(spellbook.PermissionWriteUser)) {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionWriteUser))
+	}
+
+	db := sql.FromContext(ctx)
+	if err := db.Delete(session).Error; err != nil {
+		return fmt.Errorf("error revoking session %s: %s", session.Id(), err.Error())
+	}
+
+	return revokeAccessTokens(ctx, session.Id())
+}
+
+func NewSqlRefreshController() *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlRefreshManager{}}
+	return spellbook.NewRestController(handler)
+}
+
+// SqlRefreshManager exchanges a refresh token for new access and refresh tokens of the same session.
+// The exchanged refresh token can't be used again
+type SqlRefreshManager struct{}
+
+func (manager SqlRefreshManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &Token{}, nil
+}
+
+func (manager SqlRefreshManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlRefreshManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlRefreshManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlRefreshManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	token := res.(*Token)
+	if token.RefreshToken == "" {
+		return spellbook.NewFieldError("refreshToken", spellbook.ErrMissingField)
+	}
+
+	id, ok := sessionIdFromToken(token.RefreshToken)
+	if !ok {
+		return spellbook.NewUnauthorizedError("invalid refresh token")
+	}
+
+	db := sql.FromContext(ctx)
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// the session is locked, so that a refresh token can't be exchanged twice
+	session := Session{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).First(&session).Error; err != nil {
+		tx.Rollback()
+		if gorm.IsRecordNotFoundError(err) {
+			return spellbook.NewUnauthorizedError("invalid refresh token")
+		}
+		return err
+	}
+
+	now := time.Now().UTC()
+	if !session.validRefresh(token.RefreshToken, now) {
+		tx.Rollback()
+		return spellbook.NewUnauthorizedError("invalid or expired refresh token")
+	}
+
+	u := User{}
+	if err := tx.Where("username = ?", session.Username).First(&u).Error; err != nil || !u.IsEnabled() {
+		tx.Rollback()
+		return spellbook.NewUnauthorizedError("the user of the session is not enabled")
+	}
+
+	if err := session.issue(now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	session.LastUsed = now
+	if err := tx.Save(&session).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error refreshing session %s: %s", session.Id(), err.Error())
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	session.toToken(token)
+	if DefaultJWTKeys != nil {
+		sqlGrantRoles(ctx, db, &u)
+		return signAccessToken(u, &session, token)
+	}
+	return nil
+}
+
+func (manager SqlRefreshManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	return spellbook.NewUnsupportedError()
+}
+
+func (manager SqlRefreshManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	return spellbook.NewUnsupportedError()
+}
+
+// retrieves the user of the session the access token belongs to.
+// Fails if the session doesn't exist or the token is expired
+func sqlUserFromSession(ctx context.Context, db *gorm.DB, token string) (User, *Session, error) {
+	u := User{}
+	id, _ := sessionIdFromToken(token)
+	session := Session{}
+	if err := db.Where("id = ?", id).First(&session).Error; err != nil {
+		return u, nil, err
+	}
+
+	now := time.Now().UTC()
+	if !session.validAccess(token, now) {
+		return u, nil, spellbook.NewUnauthorizedError("invalid or expired token")
+	}
+
+	if err := db.Where("username = ?", session.Username).First(&u).Error; err != nil {
+		return u, nil, err
+	}
+
+	if session.touch(now) {
+		if err := db.Model(&session).Update("last_used", session.LastUsed).Error; err != nil {
+			log.Errorf(ctx, "error recording the use of session %s: %s", id, err.Error())
+		}
+	}
+
+	return u, &session, nil
+}
+
+// revokes the signed access tokens of every session of the user, before the sessions are closed
+func sqlRevokeSessions(ctx context.Context, db *gorm.DB, username string) error {
+	if DefaultJWTKeys == nil {
+		return nil
+	}
+
+	var ids []string
+	if err := db.Model(&Session{}).Where("username = ?", username).Pluck("id", &ids).Error; err != nil {
+		return fmt.Errorf("error retrieving the sessions of user %s: %s", username, err.Error())
+	}
+	return revokeAccessTokens(ctx, ids...)
+}
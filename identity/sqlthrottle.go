@@ -0,0 +1,60 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook/sql"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// SqlLoginAttemptStore keeps the counters of the failed logins in the login_attempts table,
+// so that they are shared between instances
+type SqlLoginAttemptStore struct{}
+
+// the counter is locked while it's read and incremented with an upsert, so that concurrent attempts are all counted
+func (store SqlLoginAttemptStore) Reserve(ctx context.Context, key string, now time.Time, window time.Duration) (LoginAttempts, error) {
+	db := sql.FromContext(ctx)
+	tx := db.Begin()
+	if tx.Error != nil {
+		return LoginAttempts{}, tx.Error
+	}
+
+	previous := LoginAttempts{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where(`"key" = ?`, key).First(&previous).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		return LoginAttempts{}, err
+	}
+
+	reserved := LoginAttempts{}
+	err = tx.Raw(`INSERT INTO login_attempts ("key", failures, last_failure) VALUES (?, 1, ?)
+		ON CONFLICT ("key") DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure <= ? THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+		RETURNING "key", failures, last_failure`, key, now, now.Add(-window)).Scan(&reserved).Error
+	if err != nil {
+		tx.Rollback()
+		return LoginAttempts{}, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return LoginAttempts{}, err
+	}
+
+	// the failures are the ones the attempt was counted on, even if a concurrent first attempt inserted the row
+	previous.Key = key
+	previous.Failures = reserved.Failures - 1
+	return previous, nil
+}
+
+func (store SqlLoginAttemptStore) Release(ctx context.Context, key string, reserved time.Time, previous time.Time) error {
+	db := sql.FromContext(ctx)
+	return db.Exec(`UPDATE login_attempts SET failures = GREATEST(failures - 1, 0),
+		last_failure = CASE WHEN last_failure = ? THEN ? ELSE last_failure END
+		WHERE "key" = ?`, reserved, previous, key).Error
+}
+
+func (store SqlLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	db := sql.FromContext(ctx)
+	return db.Where(`"key" = ?`, key).Delete(&LoginAttempts{}).Error
+}
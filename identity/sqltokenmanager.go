@@ -5,8 +5,9 @@ import (
 	"decodica.com/spellbook"
 	"decodica.com/spellbook/sql"
 	"fmt"
-	"github.com/decodica/model/v2"
 	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+	"time"
 )
 
 func NewSqlTokenController() *spellbook.RestController {
@@ -22,16 +23,27 @@ func NewSqlTokenControllerWithKey(key string) *spellbook.RestController {
 	return c
 }
 
+// NewLegacySqlTokenController returns the controller of the logins of the clients written before sessions:
+// the response is the bare access token, instead of the object with the refresh token and the expiration
+func NewLegacySqlTokenController() *spellbook.RestController {
+	manager := NewDefaultSqlTokenManager()
+	manager.LegacyResponse = true
+	handler := spellbook.BaseRestHandler{Manager: manager}
+	return spellbook.NewRestController(handler)
+}
+
 type SqlTokenManager struct {
 	UserManager spellbook.Manager
+	// the session is returned as the bare access token, see NewLegacySqlTokenController
+	LegacyResponse bool
 }
 
 func NewDefaultSqlTokenManager() SqlTokenManager {
-	return SqlTokenManager{DefaultSqlUserManager}
+	return SqlTokenManager{UserManager: DefaultSqlUserManager}
 }
 
 func (manager SqlTokenManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
-	return &Token{}, nil
+	return &Token{legacy: manager.LegacyResponse}, nil
 }
 
 func (manager SqlTokenManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
@@ -60,45 +72,160 @@ func (manager SqlTokenManager) Create(ctx context.Context, res spellbook.Resourc
 
 	token := res.(*Token)
 
-	// checks the provided credentials. If correct creates a token, saves the user and returns the token
-	nick := spellbook.NewRawField("username", true, token.Username)
-	if _, err := nick.Value(); err != nil {
-		return spellbook.NewFieldError("username", err)
+	// the second step of the login of the users with a second factor
+	if token.Challenge != "" {
+		return manager.completeChallenge(ctx, token)
 	}
 
-	password := spellbook.NewRawField("password", true, token.Password)
-	password.AddValidator(spellbook.LenValidator{MinLen: 8})
-	if _, err := password.Value(); err != nil {
-		return spellbook.NewFieldError("password", err)
+	// checks the provided credentials. If correct opens a session and returns its tokens
+	if err := spellbook.ValidateStruct(token); err != nil {
+		return err
+	}
+
+	ip := clientAddress(ctx)
+	attempt, err := checkLogin(ctx, token.Username, ip)
+	if err != nil {
+		return err
 	}
 
 	u := &User{}
 	db := sql.FromContext(ctx)
-	err := db.Where("username = ?", token.Username).First(u).Error
+	err = db.Where("username = ?", token.Username).First(u).Error
+
+	// unknown users take as long as wrong passwords, and fail the same way
+	if gorm.IsRecordNotFoundError(err) {
+		verifyDummyPassword(token.Password)
+		return failLogin()
+	}
 
 	if err != nil {
 		return err
 	}
 
-	salt := spellbook.Application().Options().Salt
-	hp := HashPassword(token.Password, salt)
-	if u.Password != hp {
-		return gorm.ErrRecordNotFound
+	ok, rehash, err := VerifyPassword(token.Password, u.Password)
+	if err != nil {
+		return fmt.Errorf("error verifying the password of user %s: %s", token.Username, err.Error())
+	}
+	if !ok {
+		return failLogin()
+	}
+	attempt.Succeed(ctx)
+
+	// the hash is outdated: replace it while the clear password is known
+	if rehash {
+		if u.Password, err = NewPasswordHash(token.Password); err != nil {
+			return fmt.Errorf("error hashing the password of user %s: %s", token.Username, err.Error())
+		}
+		if err := db.Model(u).Update("password", u.Password).Error; err != nil {
+			return fmt.Errorf("error updating the password of user %s: %s", u.Username(), err.Error())
+		}
+	}
+
+	// the session is opened once the second factor is checked
+	if u.TOTPEnabled {
+		tkn, challenge, err := sqlIssueActionToken(db, *u, ActionTwoFactorChallenge, TwoFactorChallengeDuration)
+		if err != nil {
+			return err
+		}
+		token.Challenge = tkn
+		token.Expires = challenge.Expires
+		return nil
+	}
+
+	sqlGrantRoles(ctx, db, u)
+	token.EnrollTwoFactor = u.RequiresTwoFactor()
+	return sqlOpenSession(ctx, db, *u, token, false)
+}
+
+// checks the code sent for the challenge and opens the session.
+// The challenge is revoked after too many wrong codes
+func (manager SqlTokenManager) completeChallenge(ctx context.Context, token *Token) error {
+	if token.Code == "" && token.RecoveryCode == "" {
+		return spellbook.NewFieldError("code", spellbook.ErrMissingField)
+	}
+
+	db := sql.FromContext(ctx)
+	challenge, err := sqlActionTokenFromId(db, token.Challenge, ActionTwoFactorChallenge)
+	if gorm.IsRecordNotFoundError(err) {
+		return spellbook.NewUnauthorizedError("invalid or expired challenge")
+	}
+	if err != nil {
+		return err
 	}
 
-	tv, err := u.GenerateToken()
+	ip := clientAddress(ctx)
+	attempt, err := checkLogin(ctx, challenge.Username, ip)
 	if err != nil {
-		return fmt.Errorf("error generating token for user %s: %s", u.Username(), err.Error())
+		return err
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// the user is locked, so that a code can't be used by concurrent requests
+	u := User{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", challenge.Username).First(&u).Error; err != nil || !u.IsEnabled() {
+		tx.Rollback()
+		return spellbook.NewUnauthorizedError("the user of the challenge is not enabled")
 	}
 
-	u.setToken(tv)
-	err = db.Save(&u).Error
+	if !u.verifySecondFactor(token.Code, token.RecoveryCode, time.Now().UTC()) {
+		tx.Rollback()
+		challenge.Attempts++
+		if challenge.Attempts >= twoFactorMaxAttempts {
+			err = db.Where("hash = ?", challenge.Id()).Delete(&ActionToken{}).Error
+		} else {
+			err = db.Model(challenge).Update("attempts", gorm.Expr("attempts + 1")).Error
+		}
+		if err != nil {
+			log.Errorf(ctx, "error recording a wrong code for user %s: %s", u.Username(), err.Error())
+		}
+		return spellbook.NewUnauthorizedError("invalid code")
+	}
+
+	if err := sqlSpendActionToken(tx, challenge); err != nil {
+		tx.Rollback()
+		if gorm.IsRecordNotFoundError(err) {
+			return spellbook.NewUnauthorizedError("invalid or expired challenge")
+		}
+		return err
+	}
+
+	// records the used code
+	fields := map[string]interface{}{"totp_last_step": u.TOTPLastStep, "recovery_codes": joinNames(u.RecoveryCodes)}
+	if err := tx.Model(&u).Updates(fields).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error updating the second factor of user %s: %s", u.Username(), err.Error())
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	attempt.Succeed(ctx)
+
+	token.Challenge = ""
+	return sqlOpenSession(ctx, db, u, token, true)
+}
+
+// opens a session of the user and copies its tokens into the token resource
+func sqlOpenSession(ctx context.Context, db *gorm.DB, u User, token *Token, secondFactor bool) error {
+	session, err := NewSession(ctx, u.Username())
 	if err != nil {
-		return fmt.Errorf("error updating user token: %s", err.Error())
+		return fmt.Errorf("error opening a session for user %s: %s", u.Username(), err.Error())
 	}
+	session.SecondFactor = secondFactor
 
-	token.Value = u.Token
+	if err := db.Create(session).Error; err != nil {
+		return fmt.Errorf("error saving the session of user %s: %s", u.Username(), err.Error())
+	}
 
+	session.toToken(token)
+	if DefaultJWTKeys != nil {
+		sqlGrantRoles(ctx, db, &u)
+		return signAccessToken(u, session, token)
+	}
 	return nil
 }
 
@@ -114,8 +241,18 @@ func (manager SqlTokenManager) Delete(ctx context.Context, res spellbook.Resourc
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
 	}
 
+	db := sql.FromContext(ctx)
+
+	// logs out of the current session only
+	if session := SessionFromContext(ctx); session != nil {
+		if err := db.Delete(session).Error; err != nil {
+			return err
+		}
+		return revokeAccessTokens(ctx, session.Id())
+	}
+
 	user.setToken("")
-	err := model.Update(ctx, &user)
+	err := db.Model(&user).Update("token", user.SqlToken).Error
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,172 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"decodica.com/spellbook/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/appengine/log"
+)
+
+func NewSqlTwoFactorController() *spellbook.RestController {
+	return NewSqlTwoFactorControllerWithKey("")
+}
+
+func NewSqlTwoFactorControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: SqlTwoFactorManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// SqlTwoFactorManager enrolls and resets the second factor of the users. The id is the username.
+// POST starts the enrollment of the current user and returns the secret,
+// PUT confirms it with a code and returns the recovery codes, DELETE removes the second factor.
+// Users with PermissionEditPermissions can reset the second factor of every user
+type SqlTwoFactorManager struct{}
+
+func (manager SqlTwoFactorManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &TwoFactor{}, nil
+}
+
+func (manager SqlTwoFactorManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+	if id != current.Username() && !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	u := User{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("username = ?", id).First(&u).Error; err != nil {
+		log.Errorf(ctx, "could not retrieve user %s: %s", id, err.Error())
+		return nil, err
+	}
+	sqlGrantRoles(ctx, db, &u)
+
+	return twoFactorOf(&u), nil
+}
+
+func (manager SqlTwoFactorManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager SqlTwoFactorManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// starts the enrollment of the current user. The second factor is enabled once a code confirms it
+func (manager SqlTwoFactorManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	// the second factor of an impersonated user is only changed by the user
+	current, ok := spellbook.IdentityFromContext(ctx).(User)
+	if !ok || current.Impersonator() != nil {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	u := User{}
+	db := sql.FromContext(ctx)
+	if err := db.Where("username = ?", current.Username()).First(&u).Error; err != nil {
+		return err
+	}
+
+	if u.TOTPEnabled {
+		return spellbook.NewConflictError(fmt.Sprintf("user %s already has a second factor", u.Username()))
+	}
+
+	if err := u.enrollTwoFactor(); err != nil {
+		return err
+	}
+	if err := sqlSaveTwoFactor(db, &u); err != nil {
+		return fmt.Errorf("error enrolling the second factor of user %s: %s", u.Username(), err.Error())
+	}
+	sqlGrantRoles(ctx, db, &u)
+
+	tf := res.(*TwoFactor)
+	*tf = *twoFactorOf(&u)
+	tf.Secret = u.TOTPSecret
+	tf.URI = TOTPURI(u.TOTPSecret, u.Username())
+	return nil
+}
+
+// confirms the enrollment with a code of the secret. The session of the request counts as authenticated with the second factor
+func (manager SqlTwoFactorManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	tf := res.(*TwoFactor)
+	if current := spellbook.IdentityFromContext(ctx); current == nil || current.Username() != tf.Username || spellbook.ImpersonatorFromContext(ctx) != nil {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	other := TwoFactor{}
+	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	u := tf.user
+	step, err := checkEnrollment(u, other.Code)
+	if err != nil {
+		return err
+	}
+
+	codes, err := u.enableTwoFactor(step)
+	if err != nil {
+		return err
+	}
+	db := sql.FromContext(ctx)
+	if err := sqlSaveTwoFactor(db, u); err != nil {
+		return fmt.Errorf("error enabling the second factor of user %s: %s", u.Username(), err.Error())
+	}
+
+	if session := SessionFromContext(ctx); session != nil {
+		session.SecondFactor = true
+		if err := db.Model(session).Update("second_factor", true).Error; err != nil {
+			log.Errorf(ctx, "error updating session %s: %s", session.Id(), err.Error())
+		}
+	}
+
+	*tf = *twoFactorOf(u)
+	tf.RecoveryCodes = codes
+	return nil
+}
+
+// removes the second factor. Users reset the second factor of others with PermissionEditPermissions,
+// which also closes their sessions
+func (manager SqlTwoFactorManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	tf := res.(*TwoFactor)
+	current := spellbook.IdentityFromContext(ctx)
+	own, err := checkTwoFactorReset(ctx, current, tf)
+	if err != nil {
+		return err
+	}
+
+	u := tf.user
+	u.resetTwoFactor()
+	db := sql.FromContext(ctx)
+	if err := sqlSaveTwoFactor(db, u); err != nil {
+		return fmt.Errorf("error resetting the second factor of user %s: %s", u.Username(), err.Error())
+	}
+
+	if own {
+		return nil
+	}
+	if err := sqlRevokeSessions(ctx, db, u.Username()); err != nil {
+		return err
+	}
+	if err := db.Where("username = ?", u.Username()).Delete(&Session{}).Error; err != nil {
+		return fmt.Errorf("error closing the sessions of user %s: %s", u.Username(), err.Error())
+	}
+	return nil
+}
+
+// stores the second factor of the user only
+func sqlSaveTwoFactor(db *gorm.DB, u *User) error {
+	fields := map[string]interface{}{
+		"totp_secret":    u.TOTPSecret,
+		"totp_enabled":   u.TOTPEnabled,
+		"totp_last_step": u.TOTPLastStep,
+		"recovery_codes": joinNames(u.RecoveryCodes),
+	}
+	return db.Model(u).Updates(fields).Error
+}
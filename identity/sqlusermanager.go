@@ -5,16 +5,28 @@ import (
 	"decodica.com/spellbook"
 	"decodica.com/spellbook/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"google.golang.org/appengine/log"
-	"strings"
 )
 
 type SqlUserManager struct{}
 
 var DefaultSqlUserManager = SqlUserManager{}
 
+// fields that can be used to filter and order users.
+// Credentials and tokens are deliberately left out
+var userColumns = sql.Columns{
+	"username":       "username",
+	"name":           "name",
+	"surname":        "surname",
+	"email":          "email",
+	"locale":         "locale",
+	"permission":     "permission",
+	"last_login":     "last_login",
+	"email_verified": "email_verified",
+}
+
 func NewSqlUserController() *spellbook.RestController {
 	return NewSqlUserControllerWithKey("")
 }
@@ -57,36 +69,76 @@ func (manager SqlUserManager) FromId(ctx context.Context, id string) (spellbook.
 }
 
 func (manager SqlUserManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager SqlUserManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 
 	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
 	}
 
 	var users []*User
 	db := sql.FromContext(ctx)
-	db = db.Offset(opts.Page * opts.Size)
 
-	db = db.Where(sql.FiltersToCondition(opts.Filters, nil))
+	where, args, err := sql.FiltersToCondition(opts.Filters, userColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
 
-	if opts.Order != "" {
-		dir := " asc"
-		if opts.Descending {
-			dir = " desc"
-		}
-		db = db.Order(fmt.Sprintf("%q %s", strings.ToLower(opts.Order), dir))
+	db, err = sql.Paginate(db, &User{}, opts, userColumns)
+	if err != nil {
+		return nil, "", err
 	}
 
-	db = db.Limit(opts.Size + 1)
 	if res := db.Find(&users); res.Error != nil {
 		log.Errorf(ctx, "error retrieving content: %s", res.Error.Error())
-		return nil, res.Error
+		return nil, "", res.Error
+	}
+
+	// the extra result only tells that there are more results
+	next := ""
+	if len(users) > opts.Size {
+		users = users[:opts.Size]
+		next, err = sql.NewCursor(db, users[len(users)-1], opts, userColumns)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	resources := make([]spellbook.Resource, len(users))
 	for i := range users {
 		resources[i] = users[i]
 	}
-	return resources, nil
+	return resources, next, nil
+}
+
+func (manager SqlUserManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	db := sql.FromContext(ctx).Model(&User{})
+
+	where, args, err := sql.FiltersToCondition(opts.Filters, userColumns)
+	if err != nil {
+		return 0, err
+	}
+	if where != "" {
+		db = db.Where(where, args...)
+	}
+
+	total := 0
+	if err := db.Count(&total).Error; err != nil {
+		log.Errorf(ctx, "error counting users: %s", err.Error())
+		return 0, err
+	}
+	return total, nil
 }
 
 func (manager SqlUserManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -107,8 +159,9 @@ func (manager SqlUserManager) Create(ctx context.Context, res spellbook.Resource
 	user := res.(*User)
 
 	meta := struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string `json:"username" validate:"required,datastorekey"`
+		Password string `json:"password" validate:"required,len=8:"`
+		Email    string `json:"email" validate:"email"`
 	}{}
 
 	err := json.Unmarshal(bundle, &meta)
@@ -116,24 +169,12 @@ func (manager SqlUserManager) Create(ctx context.Context, res spellbook.Resource
 		return spellbook.NewFieldError("json", fmt.Errorf("invalid json: %s", string(bundle)))
 	}
 
+	meta.Username = SanitizeUserName(meta.Username)
 	username := meta.Username
-	username = SanitizeUserName(username)
-
-	uf := spellbook.NewRawField("username", true, username)
-	uf.AddValidator(spellbook.DatastoreKeyNameValidator{})
 
-	// validate the username. Accepted values for the username are implementation dependent
-	if err := uf.Validate(); err != nil {
-		msg := fmt.Sprintf("invalid username %s", user.Username())
-		return spellbook.NewFieldError("username", errors.New(msg))
-	}
-
-	pf := spellbook.NewRawField("password", true, meta.Password)
-	pf.AddValidator(spellbook.LenValidator{MinLen: 8})
-
-	if err := pf.Validate(); err != nil {
-		msg := fmt.Sprintf("invalid password %s for username %s", meta.Password, username)
-		return spellbook.NewFieldError("password", errors.New(msg))
+	// accepted values for the username are implementation dependent
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
 	}
 
 	if !current.HasPermission(spellbook.PermissionEditPermissions) {
@@ -141,13 +182,31 @@ func (manager SqlUserManager) Create(ctx context.Context, res spellbook.Resource
 		if !((len(user.Permissions()) == 1 && user.IsEnabled()) || (len(user.Permissions()) == 0 && !user.IsEnabled())) {
 			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
 		}
+		// nor grant roles
+		if len(user.Roles) > 0 || len(user.Groups) > 0 {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
 	}
 
-	salt := spellbook.Application().Options().Salt
-	user.Password = HashPassword(meta.Password, salt)
-	user.SqlUsername = username
-
 	db := sql.FromContext(ctx)
+	if user.Email != "" {
+		if err := sqlCheckEmail(db, username, user.Email); err != nil {
+			return err
+		}
+	}
+	if err := sqlCheckNames(db, &Role{}, "roles", user.Roles); err != nil {
+		return err
+	}
+	if err := sqlCheckNames(db, &Group{}, "groups", user.Groups); err != nil {
+		return err
+	}
+
+	hash, err := NewPasswordHash(meta.Password)
+	if err != nil {
+		return fmt.Errorf("error hashing the password of user %s: %s", username, err.Error())
+	}
+	user.Password = hash
+	user.SqlUsername = username
 
 	if err := db.Create(user).Error; err != nil {
 		return fmt.Errorf("error creating user %s: %s", user.Name, err)
@@ -173,38 +232,63 @@ func (manager SqlUserManager) Update(ctx context.Context, res spellbook.Resource
 
 	tkn, _ := TokenManager{}.NewResource(ctx)
 	token := tkn.(*Token)
-	if err := token.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err == nil {
-		if token.Password != "" {
-			pf := spellbook.NewRawField("password", true, token.Password)
-			pf.AddValidator(spellbook.LenValidator{MinLen: 8})
-
-			if err := pf.Validate(); err != nil {
-				msg := fmt.Sprintf("invalid password %s for username %s", token.Password, other.Username())
-				return spellbook.NewFieldError("user", errors.New(msg))
-			}
-			salt := spellbook.Application().Options().Salt
-			user.Password = HashPassword(token.Password, salt)
+	// the password is changed only if a new one is sent
+	_ = token.FromRepresentation(spellbook.RepresentationTypeJSON, bundle)
+
+	// password and email are optional, but must be valid if given
+	meta := struct {
+		Password string `json:"password" validate:"len=8:"`
+		Email    string `json:"email" validate:"email"`
+	}{token.Password, other.Email}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	if token.Password != "" {
+		hash, err := NewPasswordHash(token.Password)
+		if err != nil {
+			return fmt.Errorf("error hashing the password of user %s: %s", user.Username(), err.Error())
 		}
+		user.Password = hash
 	}
 
-	if other.Email != "" {
-		ef := spellbook.NewRawField("email", true, other.Email)
-		if err := ef.Validate(); err != nil {
-			msg := fmt.Sprintf("invalid email address: %s", other.Email)
-			return spellbook.NewFieldError("user", errors.New(msg))
+	db := sql.FromContext(ctx)
+	if other.Email != "" && other.Email != user.Email {
+		if err := sqlCheckEmail(db, user.Username(), other.Email); err != nil {
+			return err
 		}
-		user.Email = other.Email
+		user.setEmail(other.Email)
 	}
 
 	if !current.HasPermission(spellbook.PermissionEditPermissions) && other.ChangedPermission(*user) {
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
 	}
 
+	if other.ChangedRoles(*user) {
+		if !current.HasPermission(spellbook.PermissionEditPermissions) {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
+		if err := sqlCheckNames(db, &Role{}, "roles", other.Roles); err != nil {
+			return err
+		}
+		if err := sqlCheckNames(db, &Group{}, "groups", other.Groups); err != nil {
+			return err
+		}
+	}
+
+	enabled := user.IsEnabled()
 	user.Name = other.Name
 	user.Surname = other.Surname
-	user.Permission = other.Permission
-
-	db := sql.FromContext(ctx)
+	user.SetPermissions(other.Grants)
+	user.Roles = other.Roles
+	user.Groups = other.Groups
+
+	// the signed access tokens of a disabled user are not accepted anymore
+	if enabled && !user.IsEnabled() {
+		if err := sqlRevokeSessions(ctx, db, user.Username()); err != nil {
+			return err
+		}
+	}
 
 	return db.Save(user).Error
 }
@@ -218,9 +302,24 @@ func (manager SqlUserManager) Delete(ctx context.Context, res spellbook.Resource
 	user := res.(*User)
 
 	db := sql.FromContext(ctx)
+	if err := sqlRevokeSessions(ctx, db, user.Username()); err != nil {
+		return err
+	}
 	if err := db.Delete(&user).Error; err != nil {
 		return fmt.Errorf("error deleting user %s: %s", user.Name, err.Error())
 	}
 
 	return nil
 }
+
+// returns a ConflictError if the email belongs to another user
+func sqlCheckEmail(db *gorm.DB, username string, email string) error {
+	count := 0
+	if err := db.Model(&User{}).Where("email = ? AND username <> ?", email, username).Count(&count).Error; err != nil {
+		return fmt.Errorf("error retrieving the users with email %s: %s", email, err.Error())
+	}
+	if count > 0 {
+		return spellbook.NewConflictError(fmt.Sprintf("email %s is already in use", email))
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"google.golang.org/appengine/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttempts counts the consecutive failed logins of a username or of an address
+type LoginAttempts struct {
+	Key         string `gorm:"PRIMARY_KEY;column:key"`
+	Failures    int    `gorm:"NOT NULL"`
+	LastFailure time.Time
+}
+
+// LoginAttemptStore keeps the counters of the failed logins.
+// An attempt is counted as failed when it starts, so that concurrent attempts see each other
+type LoginAttemptStore interface {
+	// atomically counts an attempt as failed at now, and returns the counter as it was before it.
+	// A counter whose last failure is older than the window starts again from zero
+	Reserve(ctx context.Context, key string, now time.Time, window time.Duration) (LoginAttempts, error)
+	// takes back an attempt reserved at the time, that didn't fail. The last failure goes back to the previous one,
+	// unless another attempt was reserved since
+	Release(ctx context.Context, key string, reserved time.Time, previous time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginThrottle slows down password guessing.
+// Each failed login of a username or from an address doubles the time the next login must wait,
+// once the free attempts are spent, up to MaxDelay: after that the username or the address is
+// locked for MaxDelay after every failure.
+// Unknown usernames are counted like the existing ones, so that the throttle doesn't tell them apart
+type LoginThrottle struct {
+	Store LoginAttemptStore
+	// failures of a username allowed before the backoff starts
+	FreeAttempts int
+	// failures from an address allowed before the backoff starts. Many users can share an address
+	IPFreeAttempts int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	// failures older than the window are forgotten
+	Window time.Duration
+}
+
+// the throttle of the token managers. Set it to nil to disable throttling,
+// or replace its store with a SqlLoginAttemptStore to share the counters between instances
+var DefaultLoginThrottle = &LoginThrottle{
+	Store:          NewMemoryLoginAttemptStore(),
+	FreeAttempts:   5,
+	IPFreeAttempts: 50,
+	BaseDelay:      time.Second,
+	MaxDelay:       15 * time.Minute,
+	Window:         24 * time.Hour,
+}
+
+// keys of the counters
+func usernameAttemptKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// returns the address of the client, empty if unknown
+func clientAddress(ctx context.Context) string {
+	if ip := spellbook.ClientIP(ctx); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// returns the time the counter must wait before the next attempt
+func (throttle *LoginThrottle) wait(attempts LoginAttempts, free int, now time.Time) time.Duration {
+	over := attempts.Failures - free
+	if over <= 0 || now.Sub(attempts.LastFailure) >= throttle.Window {
+		return 0
+	}
+
+	delay := throttle.BaseDelay
+	for i := 1; i < over && delay < throttle.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > throttle.MaxDelay {
+		delay = throttle.MaxDelay
+	}
+	return attempts.LastFailure.Add(delay).Sub(now)
+}
+
+// LoginAttempt is a login reserved by LoginThrottle.Check.
+// It's counted as failed unless it succeeds
+type LoginAttempt struct {
+	throttle *LoginThrottle
+	username string
+	reserved time.Time
+	// the counters before the attempt, by key
+	previous map[string]LoginAttempts
+}
+
+// reserves an attempt of the username from the address, counted as failed until it succeeds.
+// The decision is taken on the counters as they were before the attempt, so that concurrent attempts
+// can't all pass before their failures are counted.
+// Returns a RateLimitedError, and doesn't count the attempt, if the username or the address must wait before trying again.
+// Errors of the store are logged, and don't block the login
+func (throttle *LoginThrottle) Check(ctx context.Context, username string, ip string) (*LoginAttempt, error) {
+	// truncated to the precision of the sql store, that compares it when the attempt is released
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	attempt := &LoginAttempt{throttle: throttle, username: username, reserved: now, previous: make(map[string]LoginAttempts)}
+	var wait time.Duration
+	reserve := func(key string, free int) {
+		previous, err := throttle.Store.Reserve(ctx, key, now, throttle.Window)
+		if err != nil {
+			log.Errorf(ctx, "error counting a login of %s: %s", key, err.Error())
+			return
+		}
+		attempt.previous[key] = previous
+		if w := throttle.wait(previous, free, now); w > wait {
+			wait = w
+		}
+	}
+
+	reserve(usernameAttemptKey(username), throttle.FreeAttempts)
+	if ip != "" {
+		reserve(ipAttemptKey(ip), throttle.IPFreeAttempts)
+	}
+
+	if wait > 0 {
+		attempt.release(ctx, "")
+		return nil, spellbook.NewRateLimitedError("too many failed logins", wait)
+	}
+	return attempt, nil
+}
+
+// forgets the failed logins of the username, and takes back the attempt from the address.
+// The failures of the address are kept: a valid login must not reset the guesses of other usernames
+func (attempt *LoginAttempt) Succeed(ctx context.Context) {
+	if attempt == nil {
+		return
+	}
+	key := usernameAttemptKey(attempt.username)
+	if err := attempt.throttle.Store.Reset(ctx, key); err != nil {
+		log.Errorf(ctx, "error resetting the failed logins of %s: %s", key, err.Error())
+	}
+	attempt.release(ctx, key)
+}
+
+// takes back the attempt from the counters, but the one of the key
+func (attempt *LoginAttempt) release(ctx context.Context, except string) {
+	for key, previous := range attempt.previous {
+		if key == except {
+			continue
+		}
+		if err := attempt.throttle.Store.Release(ctx, key, attempt.reserved, previous.LastFailure); err != nil {
+			log.Errorf(ctx, "error releasing a login of %s: %s", key, err.Error())
+		}
+	}
+}
+
+// the counters are pruned when the memory store grows beyond this size
+const memoryAttemptStorePrune = 10000
+
+// MemoryLoginAttemptStore keeps the counters in memory. Counters are not shared between instances
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempts
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]LoginAttempts)}
+}
+
+func (store *MemoryLoginAttemptStore) Reserve(ctx context.Context, key string, now time.Time, window time.Duration) (LoginAttempts, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(store.attempts) >= memoryAttemptStorePrune {
+		for k, a := range store.attempts {
+			if now.Sub(a.LastFailure) >= window {
+				delete(store.attempts, k)
+			}
+		}
+	}
+
+	previous := store.attempts[key]
+	previous.Key = key
+	if now.Sub(previous.LastFailure) >= window {
+		previous.Failures = 0
+	}
+	store.attempts[key] = LoginAttempts{Key: key, Failures: previous.Failures + 1, LastFailure: now}
+	return previous, nil
+}
+
+func (store *MemoryLoginAttemptStore) Release(ctx context.Context, key string, reserved time.Time, previous time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	attempts, ok := store.attempts[key]
+	if !ok {
+		return nil
+	}
+	if attempts.Failures > 0 {
+		attempts.Failures--
+	}
+	if attempts.LastFailure.Equal(reserved) {
+		attempts.LastFailure = previous
+	}
+	store.attempts[key] = attempts
+	return nil
+}
+
+func (store *MemoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.attempts, key)
+	return nil
+}
+
+// reserves an attempt with the DefaultLoginThrottle, if any. The attempt is nil without a throttle
+func checkLogin(ctx context.Context, username string, ip string) (*LoginAttempt, error) {
+	if DefaultLoginThrottle == nil {
+		return nil, nil
+	}
+	return DefaultLoginThrottle.Check(ctx, username, ip)
+}
+
+// returns the error of a failed login, whose attempt stays counted: unknown users and wrong passwords look the same
+func failLogin() error {
+	return spellbook.NewUnauthorizedError("invalid username or password")
+}
@@ -3,18 +3,38 @@ package identity
 import (
 	"decodica.com/spellbook"
 	"encoding/json"
+	"time"
 )
 
+// Token holds the credentials sent on login and on refresh,
+// and the tokens of the session they open
 type Token struct {
-	Value    string
-	Username string
-	Password string
+	// the access token
+	Value        string
+	Username     string `validate:"required"`
+	Password     string `validate:"required,len=8:"`
+	RefreshToken string
+	// expiration of the access token
+	Expires time.Time
+	Session string
+	// the challenge issued to the users with a second factor, sent back with the code
+	Challenge    string
+	Code         string
+	RecoveryCode string
+	// the user must enroll a second factor: until then its session is only enabled
+	EnrollTwoFactor bool
+	// the session is returned as the bare access token, the response of the logins before sessions
+	legacy bool
 }
 
 func (token *Token) UnmarshalJSON(data []byte) error {
 	alias := struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refreshToken"`
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
 	}{}
 
 	if err := json.Unmarshal(data, &alias); err != nil {
@@ -23,11 +43,42 @@ func (token *Token) UnmarshalJSON(data []byte) error {
 
 	token.Username = alias.Username
 	token.Password = alias.Password
+	token.RefreshToken = alias.RefreshToken
+	token.Challenge = alias.Challenge
+	token.Code = alias.Code
+	token.RecoveryCode = alias.RecoveryCode
 	return nil
 }
 
 func (token *Token) MarshalJSON() ([]byte, error) {
-	return json.Marshal(token.Value)
+	// the password has been accepted, the second factor is missing
+	if token.Value == "" && token.Challenge != "" {
+		return json.Marshal(&struct {
+			Challenge string    `json:"challenge"`
+			Expires   time.Time `json:"expires"`
+		}{
+			Challenge: token.Challenge,
+			Expires:   token.Expires,
+		})
+	}
+
+	if token.legacy {
+		return json.Marshal(token.Value)
+	}
+
+	return json.Marshal(&struct {
+		AccessToken     string    `json:"accessToken"`
+		RefreshToken    string    `json:"refreshToken"`
+		Expires         time.Time `json:"expires"`
+		Session         string    `json:"session"`
+		EnrollTwoFactor bool      `json:"enrollTwoFactor,omitempty"`
+	}{
+		AccessToken:     token.Value,
+		RefreshToken:    token.RefreshToken,
+		Expires:         token.Expires,
+		Session:         token.Session,
+		EnrollTwoFactor: token.EnrollTwoFactor,
+	})
 }
 
 /**
@@ -1,12 +1,13 @@
 package identity
 
 import (
-	"crypto/sha1"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"strings"
-	"time"
 )
 
 const letterBytes = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -35,24 +36,59 @@ func RandomString(size int, src rand.Source) string {
 	return sb.String()
 }
 
+// length of the tokens generated by NewRandomToken
+const tokenLen = 43
+
+// prefix of the stored token hashes. Stored tokens without the prefix are legacy plaintext tokens
+const tokenHashPrefix = "sha256:"
+
+// Returns a url safe token of 256 random bits, read from crypto/rand
+func NewRandomToken() (string, error) {
+	return randomString(32)
+}
+
+// returns n random bytes read from crypto/rand, url safe encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating token: %s", err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns the hash of the token that is stored in place of the token.
+// Tokens have 256 bits of entropy: a fast hash is enough to protect them
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Compares in constant time the token sent by the client with the stored one.
+// legacy is true if the stored token is a plaintext token, which should be replaced with its hash
+func MatchToken(token string, stored string) (ok bool, legacy bool) {
+	if strings.HasPrefix(stored, tokenHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(stored)) == 1, false
+	}
+	ok = stored != "" && subtle.ConstantTimeCompare([]byte(token), []byte(stored)) == 1
+	return ok, ok
+}
+
 type TokenGenerator interface {
 	GenerateToken() string
 }
 
 type DefaultTokenGenerator struct {
+	// Deprecated: tokens are read from crypto/rand
 	Seed int64
 }
 
+// Returns a token of 256 random bits. Panics if the system random generator fails
 func (tg DefaultTokenGenerator) GenerateToken() string {
-	const l = 16
-	now := time.Now().UTC().Unix()
-	src := rand.NewSource(tg.Seed)
-	rs := RandomString(l, src)
-	s := fmt.Sprintf("%s%s%d", rs, tokenSeparator, now)
-	hasher := sha1.New()
-	hasher.Write([]byte(s))
-	hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-	return hash
+	tkn, err := NewRandomToken()
+	if err != nil {
+		panic(err)
+	}
+	return tkn
 }
 
 // generator used to create service account tokens
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/decodica/model/v2"
 	"google.golang.org/appengine/log"
+	"time"
 )
 
 func NewTokenController() *spellbook.RestController {
@@ -22,10 +23,20 @@ func NewTokenControllerWithKey(key string) *spellbook.RestController {
 	return c
 }
 
-type TokenManager struct{}
+// NewLegacyTokenController returns the controller of the logins of the clients written before sessions:
+// the response is the bare access token, instead of the object with the refresh token and the expiration
+func NewLegacyTokenController() *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: TokenManager{LegacyResponse: true}}
+	return spellbook.NewRestController(handler)
+}
+
+type TokenManager struct {
+	// the session is returned as the bare access token, see NewLegacyTokenController
+	LegacyResponse bool
+}
 
 func (manager TokenManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
-	return &Token{}, nil
+	return &Token{legacy: manager.LegacyResponse}, nil
 }
 
 func (manager TokenManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
@@ -62,47 +73,161 @@ func (manager TokenManager) Create(ctx context.Context, res spellbook.Resource,
 
 	token := res.(*Token)
 
-	// checks the provided credentials. If correct creates a token, saves the user and returns the token
-	nick := spellbook.NewRawField("username", true, token.Username)
-	if _, err := nick.Value(); err != nil {
-		return spellbook.NewFieldError("username", err)
+	// the second step of the login of the users with a second factor
+	if token.Challenge != "" {
+		return manager.completeChallenge(ctx, token)
 	}
 
-	password := spellbook.NewRawField("password", true, token.Password)
-	password.AddValidator(spellbook.LenValidator{MinLen: 8})
-	if _, err := password.Value(); err != nil {
-		return spellbook.NewFieldError("password", err)
+	// checks the provided credentials. If correct opens a session and returns its tokens
+	if err := spellbook.ValidateStruct(token); err != nil {
+		return err
+	}
+
+	ip := clientAddress(ctx)
+	attempt, err := checkLogin(ctx, token.Username, ip)
+	if err != nil {
+		return err
 	}
 
 	u := User{}
-	err := model.FromStringID(ctx, &u, token.Username, nil)
+	err = model.FromStringID(ctx, &u, token.Username, nil)
 
+	// unknown users take as long as wrong passwords, and fail the same way
 	if err == datastore.ErrNoSuchEntity {
+		verifyDummyPassword(token.Password)
+		return failLogin()
+	}
+
+	if err != nil {
 		return err
 	}
 
+	ok, rehash, err := VerifyPassword(token.Password, u.Password)
+	if err != nil {
+		return fmt.Errorf("error verifying the password of user %s: %s", token.Username, err.Error())
+	}
+	if !ok {
+		return failLogin()
+	}
+	attempt.Succeed(ctx)
+
+	// the hash is outdated: replace it while the clear password is known
+	if rehash {
+		if u.Password, err = NewPasswordHash(token.Password); err != nil {
+			return fmt.Errorf("error hashing the password of user %s: %s", token.Username, err.Error())
+		}
+		if err := model.Update(ctx, &u); err != nil {
+			return fmt.Errorf("error updating the password of user %s: %s", u.StringID(), err.Error())
+		}
+	}
+
+	// the session is opened once the second factor is checked
+	if u.TOTPEnabled {
+		tkn, challenge, err := issueActionToken(ctx, u, ActionTwoFactorChallenge, TwoFactorChallengeDuration)
+		if err != nil {
+			return err
+		}
+		token.Challenge = tkn
+		token.Expires = challenge.Expires
+		return nil
+	}
+
+	grantRoles(ctx, &u)
+	token.EnrollTwoFactor = u.RequiresTwoFactor()
+	return openSession(ctx, u, token, false)
+}
+
+// the lease of the lock of the second factor of a user
+const secondFactorLease = 30 * time.Second
+
+// checks the code sent for the challenge and opens the session.
+// The challenge is revoked after too many wrong codes.
+// The challenge is read, checked and deleted, and the used code recorded, under the lock of the second factor of the user,
+// so that a code can't be used twice by concurrent requests, nor a challenge completed twice
+func (manager TokenManager) completeChallenge(ctx context.Context, token *Token) error {
+	if token.Code == "" && token.RecoveryCode == "" {
+		return spellbook.NewFieldError("code", spellbook.ErrMissingField)
+	}
+
+	// the challenge is read once to know the user to lock, then again under the lock
+	challenge, err := loadChallenge(ctx, token.Challenge)
 	if err != nil {
 		return err
 	}
+	unlock, ok, err := spellbook.DefaultLocker.Lock(ctx, "second-factor:"+challenge.Username, secondFactorLease)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return spellbook.NewUnauthorizedError("another code of the user is being checked")
+	}
+	defer unlock()
 
-	salt := spellbook.Application().Options().Salt
-	hp := HashPassword(token.Password, salt)
-	if u.Password != hp {
-		return datastore.ErrNoSuchEntity
+	if challenge, err = loadChallenge(ctx, token.Challenge); err != nil {
+		return err
 	}
 
-	u.Token, err = u.GenerateToken()
+	ip := clientAddress(ctx)
+	attempt, err := checkLogin(ctx, challenge.Username, ip)
 	if err != nil {
-		return fmt.Errorf("error generating token for user %s: %s", u.StringID(), err.Error())
+		return err
 	}
 
-	err = model.Update(ctx, &u)
+	u := User{}
+	if err := model.FromStringID(ctx, &u, challenge.Username, nil); err != nil || !u.IsEnabled() {
+		return spellbook.NewUnauthorizedError("the user of the challenge is not enabled")
+	}
+
+	if !u.verifySecondFactor(token.Code, token.RecoveryCode, time.Now().UTC()) {
+		challenge.Attempts++
+		if challenge.Attempts >= twoFactorMaxAttempts {
+			err = model.Delete(ctx, challenge, nil)
+		} else {
+			err = model.Update(ctx, challenge)
+		}
+		if err != nil {
+			log.Errorf(ctx, "error recording a wrong code for user %s: %s", u.Username(), err.Error())
+		}
+		return spellbook.NewUnauthorizedError("invalid code")
+	}
+
+	if err := model.Delete(ctx, challenge, nil); err != nil {
+		return fmt.Errorf("error deleting the challenge of user %s: %s", u.Username(), err.Error())
+	}
+
+	// records the used code
+	if err := model.Update(ctx, &u); err != nil {
+		return fmt.Errorf("error updating the second factor of user %s: %s", u.Username(), err.Error())
+	}
+	attempt.Succeed(ctx)
+
+	token.Challenge = ""
+	return openSession(ctx, u, token, true)
+}
+
+func loadChallenge(ctx context.Context, id string) (*ActionToken, error) {
+	challenge, err := actionTokenFromId(ctx, id, ActionTwoFactorChallenge)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, spellbook.NewUnauthorizedError("invalid or expired challenge")
+	}
+	return challenge, err
+}
+
+// opens a session of the user and copies its tokens into the token resource
+func openSession(ctx context.Context, u User, token *Token, secondFactor bool) error {
+	session, err := NewSession(ctx, u.StringID())
 	if err != nil {
-		return fmt.Errorf("error updating user token: %s", err.Error())
+		return fmt.Errorf("error opening a session for user %s: %s", u.StringID(), err.Error())
 	}
+	session.SecondFactor = secondFactor
 
-	token.Value = u.Token
+	opts := model.CreateOptions{}
+	opts.WithStringId(session.Id())
+	if err := model.CreateWithOptions(ctx, session, &opts); err != nil {
+		return fmt.Errorf("error saving the session of user %s: %s", u.StringID(), err.Error())
+	}
 
+	session.toToken(token)
 	return nil
 }
 
@@ -118,7 +243,12 @@ func (manager TokenManager) Delete(ctx context.Context, res spellbook.Resource)
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
 	}
 
-	user.Token = ""
+	// logs out of the current session only
+	if session := SessionFromContext(ctx); session != nil {
+		return model.Delete(ctx, session, nil)
+	}
+
+	user.setToken("")
 	err := model.Update(ctx, &user)
 	if err != nil {
 		return err
@@ -0,0 +1,136 @@
+package identity
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parameters of the time based one-time passwords (RFC 6238).
+// They are the defaults of the authenticator apps, which often ignore other values
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes of the previous and of the next period are accepted, to tolerate clock drift
+	totpSkew = 1
+	// bytes of the secret: 160 bits, as recommended by RFC 4226 for HMAC-SHA1
+	totpSecretLen = 20
+)
+
+// the issuer shown by the authenticator apps next to the account
+var TOTPIssuer = "spellbook"
+
+// number of recovery codes generated on enrollment
+const recoveryCodeCount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a new random TOTP secret, base32 encoded
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLen)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating the totp secret: %s", err.Error())
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// Returns the code of the secret for the period of t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, totpStep(t))
+}
+
+// returns the number of the period of t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// the HOTP code of the counter (RFC 4226)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %s", err.Error())
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// Checks the code against the periods around now. Periods up to last are rejected, so that a code can't be replayed.
+// It returns the period of the code, to be stored as the new last
+func ValidateTOTP(secret string, code string, now time.Time, last int64) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for s := current - totpSkew; s <= current+totpSkew; s++ {
+		if s <= last {
+			continue
+		}
+		expected, err := totpCode(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the otpauth uri of the secret, to be shown as a qr code to the authenticator apps
+func TOTPURI(secret string, account string) string {
+	label := url.PathEscape(TOTPIssuer) + ":" + url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// returns new recovery codes, formatted as xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := crand.Read(b); err != nil {
+			return nil, fmt.Errorf("error generating the recovery codes: %s", err.Error())
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// recovery codes are compared regardless of case and separators
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,185 @@
+package identity
+
+import (
+	"crypto/subtle"
+	"decodica.com/spellbook"
+	"encoding/json"
+	"time"
+)
+
+// users granted one of these permissions, directly or by their roles, must authenticate with a second factor.
+// Roles can require it too, see Role.RequireTwoFactor
+var TwoFactorPermissions = spellbook.NewPermissionSet(spellbook.PermissionEditPermissions, spellbook.PermissionImpersonate)
+
+// lifetime of the challenge issued on login to the users with a second factor
+var TwoFactorChallengeDuration = 5 * time.Minute
+
+// wrong codes accepted for a challenge before it's revoked
+const twoFactorMaxAttempts = 5
+
+// the action of the challenge tokens
+const ActionTwoFactorChallenge = "two-factor-challenge"
+
+// reports whether the permissions or the roles of the user require a second factor.
+// The roles are only known once the user is authenticated
+func (user User) RequiresTwoFactor() bool {
+	if user.twoFactorRole {
+		return true
+	}
+	return !user.permissions().Union(user.effective).Intersect(TwoFactorPermissions).IsEmpty()
+}
+
+// restricts the user authenticated without the second factor it requires.
+// session is the session of the request, nil for legacy tokens
+func (user *User) applyTwoFactor(session *Session) {
+	if session != nil && session.SecondFactor {
+		return
+	}
+	if user.TOTPEnabled || user.RequiresTwoFactor() {
+		user.restricted = true
+	}
+}
+
+// checks the totp code or the recovery code. A recovery code is removed when used,
+// and the period of a totp code is recorded so that the code can't be used again.
+// The caller must store the user
+func (user *User) verifySecondFactor(code string, recoveryCode string, now time.Time) bool {
+	if !user.TOTPEnabled {
+		return false
+	}
+
+	if code != "" {
+		step, ok := ValidateTOTP(user.TOTPSecret, code, now, user.TOTPLastStep)
+		if ok {
+			user.TOTPLastStep = step
+		}
+		return ok
+	}
+
+	if recoveryCode == "" {
+		return false
+	}
+	hash := HashToken(normalizeRecoveryCode(recoveryCode))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// starts a new enrollment, replacing the previous second factor
+func (user *User) enrollTwoFactor() error {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+	user.resetTwoFactor()
+	user.TOTPSecret = secret
+	return nil
+}
+
+// enables the second factor and returns the new recovery codes
+func (user *User) enableTwoFactor(step int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = HashToken(normalizeRecoveryCode(code))
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// removes the second factor
+func (user *User) resetTwoFactor() {
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+// TwoFactor is the second factor of a user.
+// The secret and its uri are only returned when the enrollment starts,
+// and the recovery codes only when it's confirmed
+type TwoFactor struct {
+	Username      string
+	Enabled       bool
+	Required      bool
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+	// the code that confirms the enrollment
+	Code string
+	user *User
+}
+
+// returns the state of the second factor of the user
+func twoFactorOf(u *User) *TwoFactor {
+	return &TwoFactor{
+		Username: u.Username(),
+		Enabled:  u.TOTPEnabled,
+		Required: u.RequiresTwoFactor(),
+		user:     u,
+	}
+}
+
+func (tf *TwoFactor) UnmarshalJSON(data []byte) error {
+	alias := struct {
+		Code string `json:"code"`
+	}{}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	tf.Code = alias.Code
+	return nil
+}
+
+func (tf *TwoFactor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username      string   `json:"username"`
+		Enabled       bool     `json:"enabled"`
+		Required      bool     `json:"required"`
+		Secret        string   `json:"secret,omitempty"`
+		URI           string   `json:"uri,omitempty"`
+		RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	}{
+		Username:      tf.Username,
+		Enabled:       tf.Enabled,
+		Required:      tf.Required,
+		Secret:        tf.Secret,
+		URI:           tf.URI,
+		RecoveryCodes: tf.RecoveryCodes,
+	})
+}
+
+/**
+-- Resource implementation
+*/
+
+func (tf *TwoFactor) Id() string {
+	return tf.Username
+}
+
+func (tf *TwoFactor) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Unmarshal(data, tf)
+	}
+	return spellbook.NewUnsupportedError()
+}
+
+func (tf *TwoFactor) ToRepresentation(rtype spellbook.RepresentationType) ([]byte, error) {
+	switch rtype {
+	case spellbook.RepresentationTypeJSON:
+		return json.Marshal(tf)
+	}
+	return nil, spellbook.NewUnsupportedError()
+}
@@ -0,0 +1,189 @@
+package identity
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"errors"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+func NewTwoFactorController() *spellbook.RestController {
+	return NewTwoFactorControllerWithKey("")
+}
+
+func NewTwoFactorControllerWithKey(key string) *spellbook.RestController {
+	handler := spellbook.BaseRestHandler{Manager: TwoFactorManager{}}
+	c := spellbook.NewRestController(handler)
+	c.Key = key
+	c.Private = true
+	return c
+}
+
+// TwoFactorManager enrolls and resets the second factor of the users. The id is the username.
+// POST starts the enrollment of the current user and returns the secret,
+// PUT confirms it with a code and returns the recovery codes, DELETE removes the second factor.
+// Users with PermissionEditPermissions can reset the second factor of every user
+type TwoFactorManager struct{}
+
+func (manager TwoFactorManager) NewResource(ctx context.Context) (spellbook.Resource, error) {
+	return &TwoFactor{}, nil
+}
+
+func (manager TwoFactorManager) FromId(ctx context.Context, id string) (spellbook.Resource, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if current == nil {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+	if id != current.Username() && !current.HasPermission(spellbook.PermissionReadUser) {
+		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, id, nil); err != nil {
+		log.Errorf(ctx, "could not retrieve user %s: %s", id, err.Error())
+		return nil, err
+	}
+	grantRoles(ctx, &u)
+
+	return twoFactorOf(&u), nil
+}
+
+func (manager TwoFactorManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+func (manager TwoFactorManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
+	return nil, spellbook.NewUnsupportedError()
+}
+
+// starts the enrollment of the current user. The second factor is enabled once a code confirms it
+func (manager TwoFactorManager) Create(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	// the second factor of an impersonated user is only changed by the user
+	current, ok := spellbook.IdentityFromContext(ctx).(User)
+	if !ok || current.Impersonator() != nil {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	u := User{}
+	if err := model.FromStringID(ctx, &u, current.Username(), nil); err != nil {
+		return err
+	}
+
+	if u.TOTPEnabled {
+		return spellbook.NewConflictError(fmt.Sprintf("user %s already has a second factor", u.Username()))
+	}
+
+	if err := u.enrollTwoFactor(); err != nil {
+		return err
+	}
+	if err := model.Update(ctx, &u); err != nil {
+		return fmt.Errorf("error enrolling the second factor of user %s: %s", u.Username(), err.Error())
+	}
+	grantRoles(ctx, &u)
+
+	tf := res.(*TwoFactor)
+	*tf = *twoFactorOf(&u)
+	tf.Secret = u.TOTPSecret
+	tf.URI = TOTPURI(u.TOTPSecret, u.Username())
+	return nil
+}
+
+// confirms the enrollment with a code of the secret. The session of the request counts as authenticated with the second factor
+func (manager TwoFactorManager) Update(ctx context.Context, res spellbook.Resource, bundle []byte) error {
+	tf := res.(*TwoFactor)
+	if current := spellbook.IdentityFromContext(ctx); current == nil || current.Username() != tf.Username || spellbook.ImpersonatorFromContext(ctx) != nil {
+		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEnabled))
+	}
+
+	other := TwoFactor{}
+	if err := other.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err != nil {
+		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
+	}
+
+	u := tf.user
+	step, err := checkEnrollment(u, other.Code)
+	if err != nil {
+		return err
+	}
+
+	codes, err := u.enableTwoFactor(step)
+	if err != nil {
+		return err
+	}
+	if err := model.Update(ctx, u); err != nil {
+		return fmt.Errorf("error enabling the second factor of user %s: %s", u.Username(), err.Error())
+	}
+
+	if session := SessionFromContext(ctx); session != nil {
+		session.SecondFactor = true
+		if err := model.Update(ctx, session); err != nil {
+			log.Errorf(ctx, "error updating session %s: %s", session.Id(), err.Error())
+		}
+	}
+
+	*tf = *twoFactorOf(u)
+	tf.RecoveryCodes = codes
+	return nil
+}
+
+// removes the second factor. Users reset the second factor of others with PermissionEditPermissions,
+// which also closes their sessions
+func (manager TwoFactorManager) Delete(ctx context.Context, res spellbook.Resource) error {
+	tf := res.(*TwoFactor)
+	current := spellbook.IdentityFromContext(ctx)
+	own, err := checkTwoFactorReset(ctx, current, tf)
+	if err != nil {
+		return err
+	}
+
+	u := tf.user
+	u.resetTwoFactor()
+	if err := model.Update(ctx, u); err != nil {
+		return fmt.Errorf("error resetting the second factor of user %s: %s", u.Username(), err.Error())
+	}
+
+	if own {
+		return nil
+	}
+	return closeSessions(ctx, u.Username())
+}
+
+// checks the code that confirms the enrollment and returns its period
+func checkEnrollment(u *User, code string) (int64, error) {
+	if code == "" {
+		return 0, spellbook.NewFieldError("code", spellbook.ErrMissingField)
+	}
+	if u.TOTPEnabled {
+		return 0, spellbook.NewConflictError(fmt.Sprintf("user %s already has a second factor", u.Username()))
+	}
+	if u.TOTPSecret == "" {
+		return 0, spellbook.NewConflictError(fmt.Sprintf("user %s didn't start the enrollment of a second factor", u.Username()))
+	}
+
+	step, ok := ValidateTOTP(u.TOTPSecret, code, time.Now().UTC(), 0)
+	if !ok {
+		return 0, spellbook.NewFieldError("code", errors.New("invalid code"))
+	}
+	return step, nil
+}
+
+// checks that the current identity can reset the second factor. own is true if it's its own second factor.
+// Users can only remove their own if it's not required, from a session authenticated with it
+func checkTwoFactorReset(ctx context.Context, current spellbook.Identity, tf *TwoFactor) (own bool, err error) {
+	if current == nil || spellbook.ImpersonatorFromContext(ctx) != nil {
+		return false, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+	if current.HasPermission(spellbook.PermissionEditPermissions) {
+		return current.Username() == tf.Username, nil
+	}
+	if current.Username() != tf.Username || tf.Required {
+		return false, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+	if session := SessionFromContext(ctx); tf.Enabled && (session == nil || !session.SecondFactor) {
+		return false, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+	}
+	return true, nil
+}
@@ -1,7 +1,6 @@
 package identity
 
 import (
-	"crypto/sha1"
 	"crypto/sha256"
 	"database/sql"
 	"decodica.com/spellbook"
@@ -18,6 +17,7 @@ import (
 
 const (
 	tokenSeparator = "|"
+	// length of the legacy tokens, before the encoded key
 	hashLen        = 28
 	UsernameMaxLen = 32
 	UsernameMinLen = 4
@@ -30,26 +30,97 @@ type User struct {
 	Name    string `gorm:"NOT NULL"`
 	Surname string `gorm:"NOT NULL"`
 	//username    string `model:"-"`
-	Email      string               `gorm:"NOT NULL;UNIQUE_INDEX:idx_users_email"`
-	Password   string               `gorm:"NOT NULL"`
-	Token      string               `gorm:"-"`
-	SqlToken   sql.NullString       `model:"-" gorm:"UNIQUE_INDEX:idx_users_token;column:token"`
-	Locale     string               `gorm:"NOT NULL"`
-	Permission spellbook.Permission `gorm:"NOT NULL"`
+	Email    string                  `gorm:"NOT NULL;UNIQUE_INDEX:idx_users_email"`
+	Password string                  `gorm:"NOT NULL"`
+	Token    string                  `gorm:"-"`
+	SqlToken sql.NullString          `model:"-" gorm:"UNIQUE_INDEX:idx_users_token;column:token"`
+	Locale   string                  `gorm:"NOT NULL"`
+	Grants   spellbook.PermissionSet `gorm:"type:text;column:grants"`
+	// Deprecated: the bitmask of the permissions stored before the permission registry, see MigratePermissions
+	Permission int64 `json:"-" gorm:"NOT NULL"`
 	LastLogin  time.Time
-	gUser      *guser.User `model:"-",json:"-"`
+	// the expiry of the token issued before sessions, see LegacyTokenDuration
+	TokenExpires time.Time
+	// when the email has been verified. The zero time if it's not verified
+	EmailVerified time.Time
+	Roles         []string    `gorm:"-"`
+	SqlRoles      string      `model:"-" gorm:"column:roles"`
+	Groups        []string    `gorm:"-"`
+	SqlGroups     string      `model:"-" gorm:"column:groups"`
+	gUser         *guser.User `model:"-",json:"-"`
+	// the second factor: the totp secret is enabled once the enrollment is confirmed
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	// the hashes of the unused recovery codes
+	RecoveryCodes    []string `gorm:"-"`
+	SqlRecoveryCodes string   `model:"-" gorm:"column:recovery_codes"`
+	// the account of an OpenID Connect provider the user logs in with
+	OIDCIssuer  string `gorm:"INDEX:idx_users_oidc"`
+	OIDCSubject string `gorm:"INDEX:idx_users_oidc"`
+	// the permissions granted by the roles, computed on authentication
+	effective spellbook.PermissionSet `model:"-" gorm:"-"`
+	// whether one of the roles requires a second factor, computed on authentication
+	twoFactorRole bool `model:"-" gorm:"-"`
+	// the user authenticated without the second factor it requires, and is only enabled
+	restricted bool `model:"-" gorm:"-"`
+	// the user acting on behalf of this user, see ImpersonationManager
+	impersonator *User `model:"-" gorm:"-"`
 }
 
+// gorm hooks: roles, groups and recovery codes are stored as comma separated lists
+func (user *User) BeforeSave() error {
+	user.SqlRoles = joinNames(user.Roles)
+	user.SqlGroups = joinNames(user.Groups)
+	user.SqlRecoveryCodes = joinNames(user.RecoveryCodes)
+	return nil
+}
+
+func (user *User) AfterFind() error {
+	user.Roles = splitNames(user.SqlRoles)
+	user.Groups = splitNames(user.SqlGroups)
+	user.RecoveryCodes = splitNames(user.SqlRecoveryCodes)
+	return nil
+}
+
+// stores the hash of the token. An empty token removes the stored one
 func (user *User) setToken(tkn string) {
-	user.Token = tkn
 	if tkn == "" {
+		user.Token = ""
 		user.SqlToken.Valid = false
+		user.TokenExpires = time.Time{}
 		return
 	}
+	user.Token = HashToken(tkn)
 	user.SqlToken.Valid = true
-	user.SqlToken.String = tkn
+	user.SqlToken.String = user.Token
 }
 
+// Reports whether the token issued before sessions expired.
+// A token without expiry is given one, and started is true: the expiry must be saved
+func (user *User) legacyTokenExpired(now time.Time) (expired bool, started bool) {
+	if user.TokenExpires.IsZero() {
+		user.TokenExpires = now.Add(LegacyTokenDuration)
+		return false, true
+	}
+	return !now.Before(user.TokenExpires), false
+}
+
+// reports whether the user proved to own its email
+func (user User) IsEmailVerified() bool {
+	return user.Email != "" && !user.EmailVerified.IsZero()
+}
+
+// changes the email of the user. A new email must be verified again
+func (user *User) setEmail(email string) {
+	if email == user.Email {
+		return
+	}
+	user.Email = email
+	user.EmailVerified = time.Time{}
+}
+
+// returns the stored token, which is either a hash or a legacy plaintext token
 func (user *User) getToken() string {
 	if user.SqlToken.Valid {
 		return user.SqlToken.String
@@ -65,6 +136,8 @@ func (user *User) UnmarshalJSON(data []byte) error {
 		Username    string   `json:"username"`
 		Email       string   `json:"email"`
 		Permissions []string `json:"permissions"`
+		Roles       []string `json:"roles"`
+		Groups      []string `json:"groups"`
 	}{}
 
 	err := json.Unmarshal(data, &alias)
@@ -77,15 +150,21 @@ func (user *User) UnmarshalJSON(data []byte) error {
 	user.Email = alias.Email
 	//user.username = alias.Username
 	user.GrantNamedPermissions(alias.Permissions)
+	user.Roles = alias.Roles
+	user.Groups = alias.Groups
 	return nil
 }
 
 func (user *User) MarshalJSON() ([]byte, error) {
 	type Alias struct {
-		Name        string   `json:"name"`
-		Surname     string   `json:"surname"`
-		Email       string   `json:"email"`
-		Permissions []string `json:"permissions"`
+		Name          string   `json:"name"`
+		Surname       string   `json:"surname"`
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"emailVerified"`
+		TwoFactor     bool     `json:"twoFactor"`
+		Permissions   []string `json:"permissions"`
+		Roles         []string `json:"roles"`
+		Groups        []string `json:"groups"`
 	}
 
 	return json.Marshal(&struct {
@@ -94,26 +173,32 @@ func (user *User) MarshalJSON() ([]byte, error) {
 	}{
 		user.Username(),
 		Alias{
-			Name:        user.Name,
-			Surname:     user.Surname,
-			Email:       user.Email,
-			Permissions: user.Permissions(),
+			Name:          user.Name,
+			Surname:       user.Surname,
+			Email:         user.Email,
+			EmailVerified: user.IsEmailVerified(),
+			TwoFactor:     user.TOTPEnabled,
+			Permissions:   user.Permissions(),
+			Roles:         nonNilNames(user.Roles),
+			Groups:        nonNilNames(user.Groups),
 		},
 	})
 }
 
 func (user User) Permissions() []string {
-	var perms []string
-	for permission, description := range spellbook.Permissions {
-		if user.HasPermission(permission) {
-			perms = append(perms, description)
-		}
+	if user.restricted {
+		return []string{spellbook.PermissionName(spellbook.PermissionEnabled)}
 	}
-	return perms
+	return user.permissions().Union(user.effective).Names()
 }
 
+// reports whether the permission is granted to the user, directly or by its roles.
+// A user authenticated without the second factor it requires is only enabled
 func (user User) HasPermission(permission spellbook.Permission) bool {
-	return user.Permission&permission != 0
+	if user.restricted {
+		return permission == spellbook.PermissionEnabled && user.permissions().Has(permission)
+	}
+	return user.permissions().Has(permission) || user.effective.Has(permission)
 }
 
 // sanitizes a string to be used a username
@@ -141,15 +226,6 @@ func SanitizeUserName(username string) string {
 	return u
 }
 
-func (user User) hash() string {
-	now := time.Now().UTC().Unix()
-	s := fmt.Sprintf("%s%s%s%s%d", user.StringID(), tokenSeparator, user.Password, tokenSeparator, now)
-	hasher := sha1.New()
-	hasher.Write([]byte(s))
-	hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-	return hash
-}
-
 func (user User) IsGUser() bool {
 	return user.gUser != nil
 }
@@ -164,6 +240,8 @@ func (user User) Username() string {
 	return user.StringID()
 }
 
+// Returns the legacy sha-256 hash of the password.
+// Deprecated: only used to verify the passwords stored before the introduction of PasswordHasher, use NewPasswordHash
 func HashPassword(password string, salt string) string {
 	hasher := sha256.New()
 	hasher.Write([]byte(password))
@@ -177,8 +255,12 @@ func (user User) GenerateToken() (string, error) {
 	if user.Id() == "" {
 		return "", errors.New("can't generate token. User does not exists")
 	}
-	hash := user.hash()
-	return fmt.Sprintf("%s%s", hash, user.EncodedKey()), nil
+	// the encoded key lets the datastore authenticator retrieve the user
+	tkn, err := NewRandomToken()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s", tkn, user.EncodedKey()), nil
 }
 
 /**
@@ -56,14 +56,18 @@ func (manager UserManager) FromId(ctx context.Context, id string) (spellbook.Res
 }
 
 func (manager UserManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager UserManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 
 	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
 	}
 
 	var users []*User
 	q := model.NewQuery(&User{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -73,17 +77,19 @@ func (manager UserManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &users)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &users)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(users))
@@ -91,7 +97,26 @@ func (manager UserManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		resources[i] = users[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &users, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager UserManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+
+	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadUser) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadUser))
+	}
+
+	q := model.NewQuery(&User{})
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
 func (manager UserManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -121,15 +146,14 @@ func (manager UserManager) ListOfProperties(ctx context.Context, opts spellbook.
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, err
 	}
 
 	q = q.Distinct(name)
 	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
+	err = q.GetAll(ctx, &conts)
 	if err != nil {
 		return nil, err
 	}
@@ -158,8 +182,9 @@ func (manager UserManager) Create(ctx context.Context, res spellbook.Resource, b
 	}
 
 	meta := struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string `json:"username" validate:"required,datastorekey"`
+		Password string `json:"password" validate:"required,len=8:"`
+		Email    string `json:"email" validate:"email"`
 	}{}
 
 	err := json.Unmarshal(bundle, &meta)
@@ -167,24 +192,12 @@ func (manager UserManager) Create(ctx context.Context, res spellbook.Resource, b
 		return spellbook.NewFieldError("json", fmt.Errorf("invalid json: %s", string(bundle)))
 	}
 
+	meta.Username = SanitizeUserName(meta.Username)
 	username := meta.Username
-	username = SanitizeUserName(username)
 
-	uf := spellbook.NewRawField("username", true, username)
-	uf.AddValidator(spellbook.DatastoreKeyNameValidator{})
-
-	// validate the username. Accepted values for the username are implementation dependent
-	if err := uf.Validate(); err != nil {
-		msg := fmt.Sprintf("invalid username %s", user.Username())
-		return spellbook.NewFieldError("username", errors.New(msg))
-	}
-
-	pf := spellbook.NewRawField("password", true, meta.Password)
-	pf.AddValidator(spellbook.LenValidator{MinLen: 8})
-
-	if err := pf.Validate(); err != nil {
-		msg := fmt.Sprintf("invalid password %s for username %s", meta.Password, username)
-		return spellbook.NewFieldError("password", errors.New(msg))
+	// accepted values for the username are implementation dependent
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
 	}
 
 	if !current.HasPermission(spellbook.PermissionEditPermissions) {
@@ -192,6 +205,23 @@ func (manager UserManager) Create(ctx context.Context, res spellbook.Resource, b
 		if !((len(user.Permissions()) == 1 && user.IsEnabled()) || (len(user.Permissions()) == 0 && !user.IsEnabled())) {
 			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
 		}
+		// nor grant roles
+		if len(user.Roles) > 0 || len(user.Groups) > 0 {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
+	}
+
+	if user.Email != "" {
+		if err := checkEmail(ctx, username, user.Email); err != nil {
+			return err
+		}
+	}
+
+	if err := checkRoles(ctx, user.Roles); err != nil {
+		return err
+	}
+	if err := checkGroups(ctx, user.Groups); err != nil {
+		return err
 	}
 
 	// check for user existence
@@ -209,8 +239,11 @@ func (manager UserManager) Create(ctx context.Context, res spellbook.Resource, b
 		return spellbook.NewFieldError("user", errors.New(msg))
 	}
 
-	salt := spellbook.Application().Options().Salt
-	user.Password = HashPassword(meta.Password, salt)
+	hash, err := NewPasswordHash(meta.Password)
+	if err != nil {
+		return fmt.Errorf("error hashing the password of user %s: %s", username, err.Error())
+	}
+	user.Password = hash
 
 	opts := model.CreateOptions{}
 	opts.WithStringId(username)
@@ -240,36 +273,54 @@ func (manager UserManager) Update(ctx context.Context, res spellbook.Resource, b
 
 	tkn, _ := TokenManager{}.NewResource(ctx)
 	token := tkn.(*Token)
-	if err := token.FromRepresentation(spellbook.RepresentationTypeJSON, bundle); err == nil {
-		if token.Password != "" {
-			pf := spellbook.NewRawField("password", true, token.Password)
-			pf.AddValidator(spellbook.LenValidator{MinLen: 8})
-
-			if err := pf.Validate(); err != nil {
-				msg := fmt.Sprintf("invalid password %s for username %s", token.Password, other.Username())
-				return spellbook.NewFieldError("user", errors.New(msg))
-			}
-			salt := spellbook.Application().Options().Salt
-			user.Password = HashPassword(token.Password, salt)
+	// the password is changed only if a new one is sent
+	_ = token.FromRepresentation(spellbook.RepresentationTypeJSON, bundle)
+
+	// password and email are optional, but must be valid if given
+	meta := struct {
+		Password string `json:"password" validate:"len=8:"`
+		Email    string `json:"email" validate:"email"`
+	}{token.Password, other.Email}
+	if err := spellbook.ValidateStruct(meta); err != nil {
+		return err
+	}
+
+	if token.Password != "" {
+		hash, err := NewPasswordHash(token.Password)
+		if err != nil {
+			return fmt.Errorf("error hashing the password of user %s: %s", user.Username(), err.Error())
 		}
+		user.Password = hash
 	}
 
-	if other.Email != "" {
-		ef := spellbook.NewRawField("email", true, other.Email)
-		if err := ef.Validate(); err != nil {
-			msg := fmt.Sprintf("invalid email address: %s", other.Email)
-			return spellbook.NewFieldError("user", errors.New(msg))
+	if other.Email != "" && other.Email != user.Email {
+		if err := checkEmail(ctx, user.Username(), other.Email); err != nil {
+			return err
 		}
-		user.Email = other.Email
+		user.setEmail(other.Email)
 	}
 
 	if !current.HasPermission(spellbook.PermissionEditPermissions) && other.ChangedPermission(*user) {
 		return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
 	}
 
+	if other.ChangedRoles(*user) {
+		if !current.HasPermission(spellbook.PermissionEditPermissions) {
+			return spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionEditPermissions))
+		}
+		if err := checkRoles(ctx, other.Roles); err != nil {
+			return err
+		}
+		if err := checkGroups(ctx, other.Groups); err != nil {
+			return err
+		}
+	}
+
 	user.Name = other.Name
 	user.Surname = other.Surname
-	user.Permission = other.Permission
+	user.SetPermissions(other.Grants)
+	user.Roles = other.Roles
+	user.Groups = other.Groups
 
 	return model.Update(ctx, user)
 }
@@ -288,3 +339,18 @@ func (manager UserManager) Delete(ctx context.Context, res spellbook.Resource) e
 
 	return nil
 }
+
+// returns a ConflictError if the email belongs to another user
+func checkEmail(ctx context.Context, username string, email string) error {
+	var users []*User
+	q := model.NewQuery(&User{}).WithField("Email =", email).Limit(2)
+	if err := q.GetAll(ctx, &users); err != nil {
+		return fmt.Errorf("error retrieving the users with email %s: %s", email, err.Error())
+	}
+	for _, u := range users {
+		if u.Username() != username {
+			return spellbook.NewConflictError(fmt.Sprintf("email %s is already in use", email))
+		}
+	}
+	return nil
+}
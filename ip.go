@@ -0,0 +1,103 @@
+package spellbook
+
+import (
+	"context"
+	"decodica.com/flamel"
+	"net"
+	"strings"
+)
+
+const HeaderForwardedFor = "X-Forwarded-For"
+
+// TrustedProxies are the proxies allowed to report the address of the client with the X-Forwarded-For header.
+// If the request doesn't come from a trusted proxy the header is ignored
+var TrustedProxies IPList
+
+// IPList is a list of IPv4 and IPv6 networks. Single addresses are networks of one address
+type IPList []*net.IPNet
+
+// Parses a comma separated list of addresses and networks in CIDR notation, such as "10.0.0.1, 192.168.0.0/16, 2001:db8::/32".
+// Empty entries are ignored. The error of a malformed entry is a FieldError
+func ParseIPList(s string) (IPList, error) {
+	var list IPList
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, NewValidationError("invalid network %s", entry)
+			}
+			list = append(list, network)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, NewValidationError("invalid ip address %s", entry)
+		}
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+			bits = 8 * net.IPv4len
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return list, nil
+}
+
+// reports whether the address belongs to one of the networks of the list
+func (list IPList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the client of the request.
+// The address of the connection is replaced with the X-Forwarded-For address only if the connection comes from a trusted proxy:
+// the header is read from the closest hop and the first address that isn't a trusted proxy is the client
+func ClientIP(ctx context.Context) net.IP {
+	ins := flamel.InputsFromContext(ctx)
+	var ip net.IP
+	if v4, ok := ins[flamel.KeyRequestIPV4]; ok && v4.Value() != "" {
+		ip = net.ParseIP(v4.Value())
+	} else if v6, ok := ins[flamel.KeyRequestIPV6]; ok {
+		ip = net.ParseIP(v6.Value())
+	}
+
+	if !TrustedProxies.Contains(ip) {
+		return ip
+	}
+
+	forwarded, ok := ins[HeaderForwardedFor]
+	if !ok {
+		return ip
+	}
+
+	var hops []string
+	for _, value := range forwarded.Values() {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// a malformed entry can't be trusted, nor can the entries that precede it
+			return ip
+		}
+		ip = hop
+		if !TrustedProxies.Contains(hop) {
+			return hop
+		}
+	}
+	return ip
+}
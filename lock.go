@@ -0,0 +1,167 @@
+package spellbook
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"google.golang.org/appengine/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Locker grants exclusive leases on keys, so that a read, a check and a write of the datastore
+// can't interleave with the ones of another request. A lease ends when it's released or when it expires,
+// so that a holder that never releases it doesn't block the key for good
+type Locker interface {
+	// acquires the lock of the key for the lease. It reports false, without waiting, if another holder has it.
+	// unlock releases the lock, and is nil if the lock was not acquired
+	Lock(ctx context.Context, key string, lease time.Duration) (unlock func(), ok bool, err error)
+}
+
+// the locker of the datastore managers. The locks must be shared by every instance of the application
+var DefaultLocker Locker = DatastoreLocker{}
+
+// the kind of the entities of the datastore locks
+const lockKind = "SpellbookLock"
+
+type lockEntity struct {
+	Owner   string    `datastore:",noindex"`
+	Expires time.Time `datastore:",noindex"`
+}
+
+// DatastoreLocker keeps the locks as entities of the cloud datastore, acquired and released in transactions,
+// so that they are shared between instances
+type DatastoreLocker struct {
+	// returns the client of the datastore. Defaults to a client of the project of the environment, GOOGLE_CLOUD_PROJECT
+	Client func(ctx context.Context) (*datastore.Client, error)
+}
+
+var defaultDatastoreClient struct {
+	sync.Mutex
+	client *datastore.Client
+}
+
+func (locker DatastoreLocker) client(ctx context.Context) (*datastore.Client, error) {
+	if locker.Client != nil {
+		return locker.Client(ctx)
+	}
+
+	defaultDatastoreClient.Lock()
+	defer defaultDatastoreClient.Unlock()
+	if defaultDatastoreClient.client == nil {
+		client, err := datastore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+		if err != nil {
+			return nil, err
+		}
+		defaultDatastoreClient.client = client
+	}
+	return defaultDatastoreClient.client, nil
+}
+
+// A lock held by a concurrent transaction is reported as not acquired
+func (locker DatastoreLocker) Lock(ctx context.Context, key string, lease time.Duration) (func(), bool, error) {
+	client, err := locker.client(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	owner, err := lockOwner()
+	if err != nil {
+		return nil, false, err
+	}
+
+	k := datastore.NameKey(lockKind, key, nil)
+	acquired := false
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		acquired = false
+		held := lockEntity{}
+		err := tx.Get(k, &held)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		if err == nil && now.Before(held.Expires) {
+			return nil
+		}
+		if _, err := tx.Put(k, &lockEntity{Owner: owner, Expires: now.Add(lease)}); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		return nil, false, nil
+	}
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	unlock := func() {
+		// the lock is deleted only if it's still ours: once expired, another holder can have acquired it
+		_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			held := lockEntity{}
+			if err := tx.Get(k, &held); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					return nil
+				}
+				return err
+			}
+			if held.Owner != owner {
+				return nil
+			}
+			return tx.Delete(k)
+		})
+		if err != nil {
+			log.Errorf(ctx, "error releasing lock %s, it will expire: %s", key, err.Error())
+		}
+	}
+	return unlock, true, nil
+}
+
+func lockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// MemoryLocker keeps the locks in memory. Locks are not shared between instances
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]memoryLock)}
+}
+
+func (locker *MemoryLocker) Lock(ctx context.Context, key string, lease time.Duration) (func(), bool, error) {
+	owner, err := lockOwner()
+	if err != nil {
+		return nil, false, err
+	}
+
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	now := time.Now()
+	if held, ok := locker.locks[key]; ok && now.Before(held.expires) {
+		return nil, false, nil
+	}
+	locker.locks[key] = memoryLock{owner: owner, expires: now.Add(lease)}
+
+	unlock := func() {
+		locker.mu.Lock()
+		defer locker.mu.Unlock()
+		if locker.locks[key].owner == owner {
+			delete(locker.locks, key)
+		}
+	}
+	return unlock, true, nil
+}
@@ -9,7 +9,7 @@ import (
 
 type MailMessage struct {
 	model.Model `json:"-"`
-	Recipient   string    `model:"search,atom"`
+	Recipient   string    `model:"search,atom" validate:"required,email" field:"Recipient"`
 	Sender      string    `model:"search"`
 	Object      string    `model:"search"`
 	Body        string    `model:"search"`
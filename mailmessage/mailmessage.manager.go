@@ -10,7 +10,6 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -49,10 +48,14 @@ func (manager MailMessageManager) FromId(ctx context.Context, strId string) (spe
 }
 
 func (manager MailMessageManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager MailMessageManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 
 	var mailMessages []*MailMessage
 	q := model.NewQuery(&MailMessage{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -62,17 +65,19 @@ func (manager MailMessageManager) ListOf(ctx context.Context, opts spellbook.Lis
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &mailMessages)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &mailMessages)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(mailMessages))
@@ -80,7 +85,21 @@ func (manager MailMessageManager) ListOf(ctx context.Context, opts spellbook.Lis
 		resources[i] = mailMessages[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &mailMessages, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager MailMessageManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	q := model.NewQuery(&MailMessage{})
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
 func (manager MailMessageManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -107,15 +126,14 @@ func (manager MailMessageManager) ListOfProperties(ctx context.Context, opts spe
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, err
 	}
 
 	q = q.Distinct(name)
 	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
+	err = q.GetAll(ctx, &conts)
 	if err != nil {
 		log.Errorf(ctx, "Error retrieving result: %+v", err)
 		return nil, err
@@ -140,13 +158,8 @@ func (manager MailMessageManager) Create(ctx context.Context, res spellbook.Reso
 	mailMessage := res.(*MailMessage)
 	mailMessage.Created = time.Now().UTC()
 
-	if mailMessage.Recipient == "" {
-		msg := fmt.Sprintf("Recipient can't be empty")
-		return spellbook.NewFieldError("Recipient", errors.New(msg))
-	}
-	if !strings.Contains(mailMessage.Recipient, "@") || !strings.Contains(mailMessage.Recipient, ".") {
-		msg := fmt.Sprintf("Recipient not valid")
-		return spellbook.NewFieldError("Recipient", errors.New(msg))
+	if err := spellbook.ValidateStruct(mailMessage); err != nil {
+		return err
 	}
 
 	// list mailMessage
@@ -183,6 +196,10 @@ func (manager MailMessageManager) Update(ctx context.Context, res spellbook.Reso
 		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
 	}
 
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
+	}
+
 	mailMessage := res.(*MailMessage)
 	mailMessage.Recipient = other.Recipient
 	return model.Update(ctx, mailMessage)
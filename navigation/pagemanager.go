@@ -42,13 +42,17 @@ func (manager PageManager) FromId(ctx context.Context, id string) (spellbook.Res
 }
 
 func (manager PageManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager PageManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 	if current := spellbook.IdentityFromContext(ctx); current == nil || !current.HasPermission(spellbook.PermissionReadPage) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadPage))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadPage))
 	}
 
 	var conts []*Page
 	q := model.NewQuery(&Page{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -57,17 +61,19 @@ func (manager PageManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		}
 		q = q.OrderBy(opts.Order, dir)
 	}
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &conts)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &conts)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(conts))
@@ -75,7 +81,11 @@ func (manager PageManager) ListOf(ctx context.Context, opts spellbook.ListOption
 		resources[i] = conts[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &conts, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
 }
 
 func (manager PageManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -0,0 +1,215 @@
+package spellbook
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the registry of the permissions
+var registry = struct {
+	sync.RWMutex
+	permissions map[Permission]bool
+}{permissions: make(map[Permission]bool)}
+
+// Declares a permission of the host application, such as "PERMISSION_READ_INVOICE".
+// Permissions should be registered at startup, before the first request.
+// It panics if the name is empty, contains a comma or is already registered
+func RegisterPermission(name string) Permission {
+	if name == "" || strings.ContainsAny(name, ", ") {
+		panic(fmt.Sprintf("invalid permission name %q", name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	permission := Permission(name)
+	if registry.permissions[permission] {
+		panic(fmt.Sprintf("permission %s is already registered", name))
+	}
+	registry.permissions[permission] = true
+	return permission
+}
+
+func IsRegisteredPermission(permission Permission) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.permissions[permission]
+}
+
+// returns every registered permission, sorted by name
+func RegisteredPermissions() PermissionSet {
+	registry.RLock()
+	defer registry.RUnlock()
+	set := make(PermissionSet, 0, len(registry.permissions))
+	for permission := range registry.permissions {
+		set = append(set, permission)
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	return set
+}
+
+// PermissionSet is a set of permissions, sorted by name and without duplicates.
+// The zero value is the empty set. Methods never modify the set, they return a new one.
+// In JSON the set is the list of the names of its permissions,
+// and in sql the comma separated list of the names
+type PermissionSet []Permission
+
+// returns the set of the given permissions. Empty permissions are ignored
+func NewPermissionSet(permissions ...Permission) PermissionSet {
+	set := make(PermissionSet, 0, len(permissions))
+	for _, permission := range permissions {
+		if permission != "" {
+			set = append(set, permission)
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+
+	// removes the duplicates
+	unique := set[:0]
+	for i, permission := range set {
+		if i == 0 || permission != set[i-1] {
+			unique = append(unique, permission)
+		}
+	}
+	return unique
+}
+
+// returns the set of the named permissions. Names that aren't registered are ignored
+func PermissionSetFromNames(names []string) PermissionSet {
+	permissions := make([]Permission, len(names))
+	for i, name := range names {
+		permissions[i] = NamedPermissionToPermission(name)
+	}
+	return NewPermissionSet(permissions...)
+}
+
+// returns the set of the permissions of a bitmask stored before the registry
+func PermissionSetFromBitmask(mask int64) PermissionSet {
+	var permissions []Permission
+	for i, permission := range legacyPermissionBits {
+		if mask&(1<<uint(i)) != 0 {
+			permissions = append(permissions, permission)
+		}
+	}
+	return NewPermissionSet(permissions...)
+}
+
+func (set PermissionSet) Has(permission Permission) bool {
+	i := sort.Search(len(set), func(i int) bool { return set[i] >= permission })
+	return i < len(set) && set[i] == permission
+}
+
+func (set PermissionSet) IsEmpty() bool {
+	return len(set) == 0
+}
+
+// returns the set with the permissions added
+func (set PermissionSet) With(permissions ...Permission) PermissionSet {
+	return NewPermissionSet(append(append([]Permission{}, set...), permissions...)...)
+}
+
+// returns the set with the permissions removed
+func (set PermissionSet) Without(permissions ...Permission) PermissionSet {
+	return set.Minus(NewPermissionSet(permissions...))
+}
+
+// returns the permissions of both sets
+func (set PermissionSet) Union(other PermissionSet) PermissionSet {
+	return set.With(other...)
+}
+
+// returns the permissions the sets have in common
+func (set PermissionSet) Intersect(other PermissionSet) PermissionSet {
+	result := PermissionSet{}
+	for _, permission := range set {
+		if other.Has(permission) {
+			result = append(result, permission)
+		}
+	}
+	return result
+}
+
+// returns the permissions of the set that the other set doesn't have
+func (set PermissionSet) Minus(other PermissionSet) PermissionSet {
+	result := PermissionSet{}
+	for _, permission := range set {
+		if !other.Has(permission) {
+			result = append(result, permission)
+		}
+	}
+	return result
+}
+
+// reports whether every permission of the other set is in the set
+func (set PermissionSet) Contains(other PermissionSet) bool {
+	return other.Minus(set).IsEmpty()
+}
+
+func (set PermissionSet) Equal(other PermissionSet) bool {
+	if len(set) != len(other) {
+		return false
+	}
+	for i := range set {
+		if set[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (set PermissionSet) Names() []string {
+	names := make([]string, len(set))
+	for i, permission := range set {
+		names[i] = string(permission)
+	}
+	return names
+}
+
+func (set PermissionSet) String() string {
+	return strings.Join(set.Names(), ",")
+}
+
+func (set PermissionSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(set.Names())
+}
+
+func (set *PermissionSet) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	*set = PermissionSetFromNames(names)
+	return nil
+}
+
+// sql.Valuer implementation
+func (set PermissionSet) Value() (driver.Value, error) {
+	return set.String(), nil
+}
+
+// sql.Scanner implementation
+func (set *PermissionSet) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*set = PermissionSet{}
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("can't scan %T into a permission set", src)
+	}
+
+	// like the json names, the names of the column that are not registered are dropped
+	names := strings.Split(s, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+	}
+	*set = PermissionSetFromNames(names)
+	return nil
+}
@@ -0,0 +1,79 @@
+package spellbook
+
+import (
+	"context"
+	"decodica.com/flamel"
+	"net/http"
+)
+
+const ContentTypeProblem = "application/problem+json"
+
+// machine-readable codes of the problems returned by the rest handlers.
+// Codes are stable: clients can rely on them, unlike on the detail messages
+const (
+	ProblemCodeBadRequest         = "bad_request"
+	ProblemCodeInvalidParams      = "invalid_params"
+	ProblemCodeUnauthorized       = "unauthorized"
+	ProblemCodePermissionDenied   = "permission_denied"
+	ProblemCodeNotFound           = "not_found"
+	ProblemCodeUnsupported        = "unsupported"
+	ProblemCodeMethodNotAllowed   = "method_not_allowed"
+	ProblemCodeConflict           = "conflict"
+	ProblemCodePreconditionFailed = "precondition_failed"
+	ProblemCodeRateLimited        = "rate_limited"
+	ProblemCodeNotImplemented     = "not_implemented"
+	ProblemCodeInternal           = "internal_error"
+)
+
+// the type of the problems is "about:blank", unless a base URI is set:
+// in that case the type is the base URI followed by the problem code
+var ProblemTypeBaseURI = ""
+
+// Problem is the RFC 7807 representation of an error
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Code          string         `json:"code"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// InvalidParam describes a field that failed the validation
+type InvalidParam struct {
+	Name   string   `json:"name"`
+	Reason string   `json:"reason"`
+	Args   []string `json:"args,omitempty"`
+}
+
+func NewProblem(status int, code string, detail string) Problem {
+	typ := "about:blank"
+	if ProblemTypeBaseURI != "" {
+		typ = ProblemTypeBaseURI + code
+	}
+	return Problem{
+		Type:   typ,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Adds the field error to the invalid params. The reason is translated in the request language
+func (problem *Problem) AddInvalidParam(ctx context.Context, err FieldError) {
+	problem.InvalidParams = append(problem.InvalidParams, InvalidParam{
+		Name:   err.field,
+		Reason: LocalizeError(ctx, err),
+		Args:   err.args,
+	})
+}
+
+// Renders the problem as the response
+func (problem Problem) Render(out *flamel.ResponseOutput) flamel.HttpResponse {
+	renderer := flamel.JSONRenderer{}
+	renderer.Data = problem
+	out.Renderer = &renderer
+	out.AddHeader("Content-Type", ContentTypeProblem)
+	return flamel.HttpResponse{Status: problem.Status}
+}
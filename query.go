@@ -0,0 +1,82 @@
+package spellbook
+
+import (
+	"context"
+	"fmt"
+	"github.com/decodica/model/v2"
+	"reflect"
+)
+
+// Applies the filters to a datastore query.
+// The datastore can't express every filter operator:
+// an UnsupportedError is returned for the filters that can't be translated into a query
+func FiltersToQuery(q *model.Query, fs []Filter) (*model.Query, error) {
+	for _, f := range fs {
+		if f.Field == "" {
+			continue
+		}
+
+		if f.Group != "" {
+			return nil, NewUnsupportedErrorWithReason(fmt.Sprintf("filter %s: OR groups are not supported by the datastore", f.Field))
+		}
+
+		switch f.Operator {
+		case FilterOperatorLessThan:
+			q = q.WithField(f.Field+" <", f.Value)
+		case FilterOperatorGreaterThan:
+			q = q.WithField(f.Field+" >", f.Value)
+		case FilterOperatorLessOrEqualThan:
+			q = q.WithField(f.Field+" <=", f.Value)
+		case FilterOperatorGreaterOrEqualThan:
+			q = q.WithField(f.Field+" >=", f.Value)
+		case FilterOperatorExact, "":
+			q = q.WithField(f.Field+" =", f.Value)
+		case FilterOperatorPrefix:
+			// the datastore has no prefix match: the prefix is expressed as a range
+			q = q.WithField(f.Field+" >=", f.Value)
+			q = q.WithField(f.Field+" <", f.Value+"\ufffd")
+		default:
+			return nil, NewUnsupportedErrorWithReason(fmt.Sprintf("filter %s: operator %q is not supported by the datastore", f.Field, f.Operator))
+		}
+	}
+	return q, nil
+}
+
+// Applies the page of the list options to a datastore query.
+// The page starts at the native query cursor, if one is given, or at the page offset otherwise
+func PaginateQuery(q *model.Query, opts ListOptions) (*model.Query, error) {
+	if opts.Cursor == "" {
+		q = q.OffsetBy(opts.Page * opts.Size)
+		return q.Limit(opts.Size), nil
+	}
+
+	q, err := q.WithCursor(opts.Cursor)
+	if err != nil {
+		return nil, NewFieldError(FilterCursorKey, fmt.Errorf("invalid cursor %q: %s", opts.Cursor, err.Error()))
+	}
+	return q.Limit(opts.Size), nil
+}
+
+// Returns the cursor of the page that follows a page of count results, fetched by q into dst.
+// The datastore can't tell if the cursor points to the end of the results: after a full page
+// one more result is fetched from the cursor, and the cursor is returned only if that result exists
+func NextQueryCursor(ctx context.Context, q *model.Query, dst interface{}, cursor string, count int, opts ListOptions) (string, error) {
+	if count < opts.Size || cursor == "" {
+		return "", nil
+	}
+
+	q, err := q.WithCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	// the cursor already skips the offset of the page
+	extra := reflect.New(reflect.TypeOf(dst).Elem())
+	if err := q.OffsetBy(0).Limit(1).GetMulti(ctx, extra.Interface()); err != nil {
+		return "", err
+	}
+	if extra.Elem().Len() == 0 {
+		return "", nil
+	}
+	return cursor, nil
+}
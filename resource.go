@@ -5,17 +5,22 @@ import (
 	"decodica.com/flamel"
 	"decodica.com/spellbook/format/csv"
 	"errors"
+	"fmt"
 	"google.golang.org/appengine/log"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type ListOptions struct {
 	Size       int
 	Page       int
+	Cursor     string // opaque position of the page. If set, Page is ignored
 	Order      string // field
 	Descending bool   // if -Order = desc
 	Property   string
-	Filters    []Filter // example url: &filter=Locale=it^Category=services
+	Count      bool     // if true, the total number of resources matching the filters is requested
+	Filters    []Filter // example url: &Locale=it&Category:in=news,events&Published:isnull=false
 }
 
 type FilterOperator string
@@ -27,17 +32,72 @@ const (
 	FilterOperatorGreaterOrEqualThan = "ge"
 	FilterOperatorExact              = "exact"
 	FilterOperatorNotExact           = "nexact"
+	// value is a comma separated list of accepted values
+	FilterOperatorIn       = "in"
+	FilterOperatorContains = "contains"
+	FilterOperatorPrefix   = "prefix"
+	// value is "true" to match empty fields, "false" to match fields with a value
+	FilterOperatorIsNull = "isnull"
 )
 
+// Filters are in AND, unless they share the same Group.
+// Filters in the same group are in OR with each other, and the group is in AND with the other filters.
+// The group is specified with the "@" suffix on the filter key:
+// &Category@c=news&Category@c=events matches the content in category news or events
 type Filter struct {
 	Field    string
 	Value    string
 	Operator FilterOperator
+	Group    string
+}
+
+// Returns the values of a FilterOperatorIn filter
+func (f Filter) Values() []string {
+	values := strings.Split(f.Value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+// Returns true if a FilterOperatorIsNull filter matches empty fields
+func (f Filter) IsNull() (bool, error) {
+	if f.Value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(f.Value)
+}
+
+// Splits the filters into the filters without a group and the grouped filters.
+// Groups are returned in order of first appearance
+func GroupFilters(fs []Filter) ([]Filter, [][]Filter) {
+	var ungrouped []Filter
+	var groups [][]Filter
+	index := make(map[string]int)
+	for _, f := range fs {
+		if f.Group == "" {
+			ungrouped = append(ungrouped, f)
+			continue
+		}
+		i, ok := index[f.Group]
+		if !ok {
+			i = len(groups)
+			index[f.Group] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], f)
+	}
+	return ungrouped, groups
 }
 
 type ListResponse struct {
 	Items interface{} `json:"items"`
 	More  bool        `json:"more"`
+	Next  string      `json:"next,omitempty"`
+	Page  int         `json:"page"`
+	Size  int         `json:"size"`
+	// total number of resources matching the filters. Only set if requested with count=true
+	Total *int `json:"total,omitempty"`
 }
 
 type Manager interface {
@@ -55,6 +115,21 @@ type PatchManager interface {
 	Patch(ctx context.Context, resource Resource, fields map[string]interface{}) error
 }
 
+// CursorManager is implemented by the managers that support cursor pagination.
+// ListOfCursor returns at most opts.Size resources, starting at opts.Cursor if given or at opts.Page otherwise,
+// and the cursor of the following page. The returned cursor is empty if there are no more resources
+type CursorManager interface {
+	Manager
+	ListOfCursor(ctx context.Context, opts ListOptions) ([]Resource, string, error)
+}
+
+// Counter is implemented by the managers that can count the resources matching the list filters.
+// Pagination and order of the options are ignored
+type Counter interface {
+	Manager
+	Count(ctx context.Context, opts ListOptions) (int, error)
+}
+
 type RepresentationType int
 
 const (
@@ -102,6 +177,8 @@ const FilterPropertyKey = "property"
 const FilterOrderKey = "order"
 const FilterResultsKey = "results"
 const FilterPageKey = "page"
+const FilterCursorKey = "cursor"
+const FilterCountKey = "count"
 
 func NewBaseRestController() *RestController {
 	return NewRestController(BaseRestHandler{})
@@ -111,7 +188,11 @@ func NewRestController(handler RestHandler) *RestController {
 	return &RestController{RestHandler: handler}
 }
 
+// Registers the extender to the given hook. Extenders of the same hook are invoked in order of registration
 func (controller *RestController) AddExtender(hook string, extender Extender) {
+	if controller.extenders == nil {
+		controller.extenders = make(map[string][]Extender)
+	}
 	e, ok := controller.extenders[hook]
 	if !ok {
 		e = make([]Extender, 0)
@@ -125,12 +206,34 @@ func (controller *RestController) Process(ctx context.Context, out *flamel.Respo
 	u := IdentityFromContext(ctx)
 
 	if controller.Private && u == nil {
-		return flamel.HttpResponse{Status: http.StatusUnauthorized}
+		return NewProblem(http.StatusUnauthorized, ProblemCodeUnauthorized, Localize(ctx, "authentication is required")).Render(out)
 	}
 
-	ins := flamel.InputsFromContext(ctx)
+	// the handler invokes the extenders at each step of the lifecycle
+	if controller.extenders != nil {
+		ctx = contextWithExtenders(ctx, controller.extenders)
+	}
 
+	ins := flamel.InputsFromContext(ctx)
 	method := ins[flamel.KeyRequestMethod].Value()
+
+	res := controller.handle(ctx, method, out)
+
+	// writes done on behalf of another user are recorded with both identities
+	if impersonator := ImpersonatorFromContext(ctx); impersonator != nil && method != http.MethodGet {
+		url := ""
+		if v, ok := ins[flamel.KeyRequestURL]; ok {
+			url = v.Value()
+		}
+		log.Infof(ctx, "user %s impersonating user %s: %s %s responded %d", impersonator.Username(), u.Username(), method, url, res.Status)
+	}
+
+	return res
+}
+
+// dispatches the request to the handler of its method
+func (controller *RestController) handle(ctx context.Context, method string, out *flamel.ResponseOutput) flamel.HttpResponse {
+	ins := flamel.InputsFromContext(ctx)
 	hasKey := controller.Key != ""
 	prop, hasProperty := ins[FilterPropertyKey]
 
@@ -148,24 +251,24 @@ func (controller *RestController) Process(ctx context.Context, out *flamel.Respo
 	case http.MethodPatch:
 		if !hasKey {
 			log.Errorf(ctx, "no item was specify for patch method")
-			return flamel.HttpResponse{Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, ProblemCodeBadRequest, "no item was specified for patch method").Render(out)
 		}
 		return controller.HandlePatch(ctx, controller.Key, out)
 	case http.MethodPut:
 		if !hasKey {
 			log.Errorf(ctx, "no item was specify for put method")
-			return flamel.HttpResponse{Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, ProblemCodeBadRequest, "no item was specified for put method").Render(out)
 		}
 		return controller.HandlePut(ctx, controller.Key, out)
 	case http.MethodDelete:
 		if !hasKey {
 			log.Errorf(ctx, "no item was specify for delete method")
-			return flamel.HttpResponse{Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, ProblemCodeBadRequest, "no item was specified for delete method").Render(out)
 		}
 		return controller.HandleDelete(ctx, controller.Key, out)
 	}
 
-	return flamel.HttpResponse{Status: http.StatusNotImplemented}
+	return NewProblem(http.StatusNotImplemented, ProblemCodeNotImplemented, fmt.Sprintf("method %s is not implemented", method)).Render(out)
 }
 
 func (controller *RestController) OnDestroy(ctx context.Context) {}
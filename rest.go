@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ReadHandler interface {
@@ -71,6 +72,21 @@ func (handler BaseRestHandler) buildOptions(ctx context.Context, out *flamel.Res
 		}
 	}
 
+	// the cursor, if any, takes precedence over the page
+	if cin, ok := ins[FilterCursorKey]; ok {
+		opts.Cursor = cin.Value()
+	}
+
+	// the total is computed only on request, since it can be expensive
+	if cin, ok := ins[FilterCountKey]; ok {
+		count, err := strconv.ParseBool(cin.Value())
+		if err != nil {
+			msg := fmt.Sprintf("invalid count value : %v. count must be a boolean", cin)
+			return nil, errors.New(msg)
+		}
+		opts.Count = count
+	}
+
 	// order is not mandatory
 	if oin, ok := ins["order"]; ok {
 		oins := oin.Value()
@@ -97,39 +113,55 @@ func (handler BaseRestHandler) buildOptions(ctx context.Context, out *flamel.Res
 	}
 
 	for k, vs := range values {
-		if k == FilterPageKey || k == FilterOrderKey || k == FilterResultsKey || k == FilterPropertyKey {
+		if k == FilterPageKey || k == FilterOrderKey || k == FilterResultsKey || k == FilterPropertyKey || k == FilterCursorKey || k == FilterCountKey {
 			continue
 		}
+
+		// the filter group is the suffix of the key: field:modifier@group
+		group := ""
+		if idx := strings.LastIndex(k, "@"); idx != -1 {
+			group = k[idx+1:]
+			k = k[:idx]
+			if group == "" {
+				return nil, fmt.Errorf("the filter group of %s can't be empty", k)
+			}
+		}
+
 		for _, v := range vs {
-			f := Filter{Value: v}
+			f := Filter{Value: v, Group: group}
 
 			if strings.Contains(k, ":") {
 				spt := strings.Split(k, ":")
 				if len(spt) != 2 {
 					return nil, fmt.Errorf("the filter key must be field:modifier. A single modifier for each filter is allowed")
 				}
+				f.Field = spt[0]
 				switch spt[len(spt)-1] {
 				case "lt":
 					f.Operator = FilterOperatorLessThan
-					f.Field = spt[0]
 				case "gt":
 					f.Operator = FilterOperatorGreaterThan
-					f.Field = spt[0]
 				case "le":
 					f.Operator = FilterOperatorLessOrEqualThan
-					f.Field = spt[0]
 				case "ge":
 					f.Operator = FilterOperatorGreaterOrEqualThan
-					f.Field = spt[0]
 				case "exact":
 					f.Operator = FilterOperatorExact
-					f.Field = spt[0]
 				case "nexact":
 					f.Operator = FilterOperatorNotExact
-					f.Field = spt[0]
+				case "in":
+					f.Operator = FilterOperatorIn
+				case "contains":
+					f.Operator = FilterOperatorContains
+				case "prefix":
+					f.Operator = FilterOperatorPrefix
+				case "isnull":
+					f.Operator = FilterOperatorIsNull
+					if _, err := f.IsNull(); err != nil {
+						return nil, fmt.Errorf("invalid value %q for filter %s: isnull requires a boolean", v, f.Field)
+					}
 				default:
 					f.Operator = FilterOperatorExact
-					f.Field = spt[0]
 				}
 			} else {
 				f.Operator = FilterOperatorExact
@@ -152,10 +184,62 @@ func (handler BaseRestHandler) HandleGet(ctx context.Context, key string, out *f
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	err = runHook(ctx, HookAfterRead, func(e Extender) error { return e.AfterRead(ctx, resource) })
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
+	etag, err := ETag(resource)
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+	out.AddHeader(HeaderETag, etag)
+
+	ins := flamel.InputsFromContext(ctx)
+	if inm, ok := ins[HeaderIfNoneMatch]; ok && MatchETag(inm.Value(), etag) {
+		out.Renderer = &flamel.TextRenderer{}
+		return flamel.HttpResponse{Status: http.StatusNotModified}
+	}
+
 	renderer.Data = resource
 	return flamel.HttpResponse{Status: http.StatusOK}
 }
 
+// Verifies the If-Match header of the request against the current ETag of the resource.
+// If the resource is Versioned, the returned context carries the matched version,
+// so that the manager can verify it again inside the write
+func (handler BaseRestHandler) checkPrecondition(ctx context.Context, resource Resource) (context.Context, error) {
+	ins := flamel.InputsFromContext(ctx)
+	im, ok := ins[HeaderIfMatch]
+	if !ok {
+		return ctx, nil
+	}
+
+	etag, err := ETag(resource)
+	if err != nil {
+		return ctx, err
+	}
+
+	if !MatchETag(im.Value(), etag) {
+		return ctx, NewPreconditionFailedError(fmt.Sprintf("the resource doesn't match %s", im.Value()))
+	}
+
+	if v, ok := resource.(Versioned); ok {
+		ctx = ContextWithVersion(ctx, v.Version())
+	}
+	return ctx, nil
+}
+
+// adds the ETag of the resource to the response
+func (handler BaseRestHandler) addETag(ctx context.Context, resource Resource, out *flamel.ResponseOutput) {
+	etag, err := ETag(resource)
+	if err != nil {
+		log.Warningf(ctx, "can't compute the etag of resource %s: %s", resource.Id(), err.Error())
+		return
+	}
+	out.AddHeader(HeaderETag, etag)
+}
+
 // Called on GET requests.
 // This handler is called when the available values of one property of a resource are requested
 // Returns a list of the values that the requested property can assume
@@ -164,7 +248,7 @@ func (handler BaseRestHandler) HandlePropertyValues(ctx context.Context, out *fl
 	opts.Property = prop
 	opts, err := handler.buildOptions(ctx, out, opts)
 	if err != nil {
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, err, out)
 	}
 
 	results, err := handler.Manager.ListOfProperties(ctx, *opts)
@@ -180,7 +264,7 @@ func (handler BaseRestHandler) HandlePropertyValues(ctx context.Context, out *fl
 	}
 
 	renderer := flamel.JSONRenderer{}
-	renderer.Data = ListResponse{results[:count], l > opts.Size}
+	renderer.Data = ListResponse{Items: results[:count], More: l > opts.Size, Page: opts.Page, Size: opts.Size}
 
 	out.Renderer = &renderer
 
@@ -194,21 +278,51 @@ func (handler BaseRestHandler) HandleList(ctx context.Context, out *flamel.Respo
 	opts := &ListOptions{}
 	opts, err := handler.buildOptions(ctx, out, opts)
 	if err != nil {
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, err, out)
 	}
 
-	results, err := handler.Manager.ListOf(ctx, *opts)
+	var results []Resource
+	next := ""
+	if man, ok := handler.Manager.(CursorManager); ok {
+		results, next, err = man.ListOfCursor(ctx, *opts)
+	} else {
+		results, err = handler.Manager.ListOf(ctx, *opts)
+	}
 	if err != nil {
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
-	// output
+	// the managers return one more result than the page size, to tell if more results follow:
+	// the extra result is not part of the page, and it's not read
 	l := len(results)
 	count := opts.Size
 	if l < opts.Size {
 		count = l
 	}
+	more := l > opts.Size || next != ""
+	results = results[:count]
+
+	for _, resource := range results {
+		r := resource
+		if err := runHook(ctx, HookAfterRead, func(e Extender) error { return e.AfterRead(ctx, r) }); err != nil {
+			return handler.ErrorToStatus(ctx, err, out)
+		}
+	}
+
+	var total *int
+	if opts.Count {
+		man, ok := handler.Manager.(Counter)
+		if !ok {
+			return handler.ErrorToStatus(ctx, NewUnsupportedErrorWithReason("the resource can't be counted"), out)
+		}
+		t, err := man.Count(ctx, *opts)
+		if err != nil {
+			return handler.ErrorToStatus(ctx, err, out)
+		}
+		total = &t
+	}
 
+	// output
 	var renderer flamel.Renderer
 
 	// retrieve the negotiated method
@@ -225,7 +339,7 @@ func (handler BaseRestHandler) HandleList(ctx context.Context, out *flamel.Respo
 		renderer = r
 	} else {
 		jrenderer := flamel.JSONRenderer{}
-		jrenderer.Data = ListResponse{results[:count], l > opts.Size}
+		jrenderer.Data = ListResponse{Items: results, More: more, Next: next, Page: opts.Page, Size: opts.Size, Total: total}
 		renderer = &jrenderer
 	}
 
@@ -244,27 +358,30 @@ func (handler BaseRestHandler) HandlePost(ctx context.Context, out *flamel.Respo
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
-	errs := Errors{}
 	// get the content data
 	ins := flamel.InputsFromContext(ctx)
 	j, ok := ins[flamel.KeyRequestJSON]
 	if !ok {
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, errors.New("the request has no json body"), out)
 	}
 
 	err = resource.FromRepresentation(RepresentationTypeJSON, []byte(j.Value()))
 	if err != nil {
-		msg := fmt.Sprintf("bad json: %s", err.Error())
-		errs.AddError("", errors.New(msg))
-		log.Errorf(ctx, msg)
-		renderer.Data = errs
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, fmt.Errorf("bad json: %s", err.Error()), out)
+	}
+
+	err = runHook(ctx, HookBeforeCreate, func(e Extender) error { return e.BeforeCreate(ctx, resource) })
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
 	}
 
 	if err = handler.Manager.Create(ctx, resource, []byte(j.Value())); err != nil {
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	auditWrite(ctx, AuditActionCreate, resource, nil)
+	runAfterHook(ctx, HookAfterCreate, func(e Extender) error { return e.AfterCreate(ctx, resource) })
+
 	renderer.Data = resource
 	return flamel.HttpResponse{Status: http.StatusCreated}
 }
@@ -277,7 +394,7 @@ func (handler BaseRestHandler) HandlePut(ctx context.Context, key string, out *f
 	ins := flamel.InputsFromContext(ctx)
 	j, ok := ins[flamel.KeyRequestJSON]
 	if !ok {
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, errors.New("the request has no json body"), out)
 	}
 
 	resource, err := handler.Manager.FromId(ctx, key)
@@ -285,10 +402,26 @@ func (handler BaseRestHandler) HandlePut(ctx context.Context, key string, out *f
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	ctx, err = handler.checkPrecondition(ctx, resource)
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
+	before := auditSnapshot(ctx, resource)
+	err = runHook(ctx, HookBeforeUpdate, func(e Extender) error { return e.BeforeUpdate(ctx, resource, []byte(j.Value())) })
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
 	if err = handler.Manager.Update(ctx, resource, []byte(j.Value())); err != nil {
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	auditWrite(ctx, AuditActionUpdate, resource, before)
+
+	runAfterHook(ctx, HookAfterUpdate, func(e Extender) error { return e.AfterUpdate(ctx, resource) })
+
+	handler.addETag(ctx, resource, out)
 	renderer.Data = resource
 	return flamel.HttpResponse{Status: http.StatusOK}
 }
@@ -299,7 +432,9 @@ func (handler BaseRestHandler) HandlePatch(ctx context.Context, key string, out
 	man, ok := handler.Manager.(PatchManager)
 	if !ok {
 		log.Debugf(ctx, "manager is %v", handler.Manager)
-		return handler.ErrorToStatus(ctx, NewUnsupportedError(), out)
+		// the resource doesn't support the method at all
+		out.AddHeader("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}, ", "))
+		return NewProblem(http.StatusMethodNotAllowed, ProblemCodeMethodNotAllowed, "the resource can't be patched").Render(out)
 	}
 
 	renderer := flamel.JSONRenderer{}
@@ -308,7 +443,7 @@ func (handler BaseRestHandler) HandlePatch(ctx context.Context, key string, out
 	ins := flamel.InputsFromContext(ctx)
 	j, ok := ins[flamel.KeyRequestJSON]
 	if !ok {
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+		return handler.badRequest(ctx, errors.New("the request has no json body"), out)
 	}
 
 	resource, err := man.FromId(ctx, key)
@@ -316,16 +451,32 @@ func (handler BaseRestHandler) HandlePatch(ctx context.Context, key string, out
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	ctx, err = handler.checkPrecondition(ctx, resource)
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
 	fields := map[string]interface{}{}
 	if err := json.Unmarshal([]byte(j.Value()), &fields); err != nil {
 		log.Errorf(ctx, "invalid json: %s", err)
 		return handler.ErrorToStatus(ctx, NewFieldError("json", err), out)
 	}
 
+	before := auditSnapshot(ctx, resource)
+	err = runHook(ctx, HookBeforePatch, func(e Extender) error { return e.BeforePatch(ctx, resource, fields) })
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
 	if err = man.Patch(ctx, resource, fields); err != nil {
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	auditWrite(ctx, AuditActionPatch, resource, before)
+
+	runAfterHook(ctx, HookAfterUpdate, func(e Extender) error { return e.AfterUpdate(ctx, resource) })
+
+	handler.addETag(ctx, resource, out)
 	renderer.Data = resource
 	return flamel.HttpResponse{Status: http.StatusOK}
 }
@@ -340,47 +491,71 @@ func (handler BaseRestHandler) HandleDelete(ctx context.Context, key string, out
 		return handler.ErrorToStatus(ctx, err, out)
 	}
 
+	ctx, err = handler.checkPrecondition(ctx, resource)
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
+	before := auditSnapshot(ctx, resource)
+	err = runHook(ctx, HookBeforeDelete, func(e Extender) error { return e.BeforeDelete(ctx, resource) })
+	if err != nil {
+		return handler.ErrorToStatus(ctx, err, out)
+	}
+
 	if err = handler.Manager.Delete(ctx, resource); err != nil {
 		return handler.ErrorToStatus(ctx, err, out)
 	}
+
+	auditWrite(ctx, AuditActionDelete, resource, before)
+
+	runAfterHook(ctx, HookAfterDelete, func(e Extender) error { return e.AfterDelete(ctx, resource) })
 	return flamel.HttpResponse{Status: http.StatusOK}
 }
 
-// Converts an error to its equivalent HTTP representation
+// Converts an error to its equivalent HTTP representation, rendered as an RFC 7807 problem.
+// An UnsupportedError is a bad request: the method is allowed, but the resource can't perform the requested action
 func (handler BaseRestHandler) ErrorToStatus(ctx context.Context, err error, out *flamel.ResponseOutput) flamel.HttpResponse {
 	log.Errorf(ctx, "%s", err.Error())
+	var problem Problem
 	switch e := err.(type) {
 	case UnsupportedError:
-		return flamel.HttpResponse{Status: http.StatusMethodNotAllowed}
+		problem = NewProblem(http.StatusBadRequest, ProblemCodeUnsupported, e.Error())
 	case FieldError:
-		renderer := flamel.JSONRenderer{}
-		renderer.Data = struct {
-			Field string
-			Error string
-			Args  []string
-		}{
-			e.field,
-			e.Error(),
-			e.args,
+		problem = NewProblem(http.StatusBadRequest, ProblemCodeInvalidParams, LocalizeError(ctx, e))
+		problem.AddInvalidParam(ctx, e)
+	case Errors:
+		problem = NewProblem(http.StatusBadRequest, ProblemCodeInvalidParams, Localize(ctx, "the request has invalid parameters"))
+		for _, fe := range e.FieldErrors() {
+			problem.AddInvalidParam(ctx, fe)
 		}
-		out.Renderer = &renderer
-		return flamel.HttpResponse{Status: http.StatusBadRequest}
+	case UnauthorizedError:
+		problem = NewProblem(http.StatusUnauthorized, ProblemCodeUnauthorized, e.Error())
 	case PermissionError:
-		renderer := flamel.JSONRenderer{}
-		renderer.Data = struct {
-			Error string
-		}{
-			e.Error(),
+		problem = NewProblem(http.StatusForbidden, ProblemCodePermissionDenied, e.Error())
+	case ConflictError:
+		problem = NewProblem(http.StatusConflict, ProblemCodeConflict, e.Error())
+	case PreconditionFailedError:
+		problem = NewProblem(http.StatusPreconditionFailed, ProblemCodePreconditionFailed, e.Error())
+	case RateLimitedError:
+		problem = NewProblem(http.StatusTooManyRequests, ProblemCodeRateLimited, e.Error())
+		if e.RetryAfter > 0 {
+			// round up, so that the client doesn't retry too early
+			seconds := int((e.RetryAfter + time.Second - 1) / time.Second)
+			out.AddHeader("Retry-After", strconv.Itoa(seconds))
 		}
-		out.Renderer = &renderer
-		return flamel.HttpResponse{Status: http.StatusForbidden}
 	default:
-		if err == datastore.ErrNoSuchEntity {
-			return flamel.HttpResponse{Status: http.StatusNotFound}
-		}
-		if err == gorm.ErrRecordNotFound {
-			return flamel.HttpResponse{Status: http.StatusNotFound}
+		if err == datastore.ErrNoSuchEntity || err == gorm.ErrRecordNotFound {
+			problem = NewProblem(http.StatusNotFound, ProblemCodeNotFound, Localize(ctx, "the resource doesn't exist"))
+		} else {
+			// the detail of unexpected errors is not disclosed
+			problem = NewProblem(http.StatusInternalServerError, ProblemCodeInternal, "")
 		}
-		return flamel.HttpResponse{Status: http.StatusInternalServerError}
 	}
+	return problem.Render(out)
+}
+
+// renders a malformed request as a problem
+func (handler BaseRestHandler) badRequest(ctx context.Context, err error, out *flamel.ResponseOutput) flamel.HttpResponse {
+	log.Errorf(ctx, "%s", err.Error())
+	return NewProblem(http.StatusBadRequest, ProblemCodeBadRequest, err.Error()).Render(out)
 }
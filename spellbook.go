@@ -83,7 +83,7 @@ type SupportedAction struct {
 type Options struct {
 	// application GCS bucket
 	Bucket string
-	// password salt.
+	// salt of the legacy password hashes. New passwords are hashed with a per-user salt
 	Salt         string
 	Languages    []language.Tag
 	Categories   []SupportedCategory
@@ -0,0 +1,156 @@
+package sql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql/driver"
+	"decodica.com/spellbook"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+)
+
+// cursor is the position of the last item of a page,
+// expressed as the value of the order column and of the primary key of the item.
+// A NULL value of the order column is stored as a missing value
+type cursor struct {
+	Value interface{} `json:"v,omitempty"`
+	Key   interface{} `json:"k"`
+	// the order and the filters of the list the cursor was issued for, see cursorScope
+	Scope string `json:"s"`
+}
+
+// returns the fingerprint of the order and of the filters of the list options:
+// a cursor only points into the list it was issued for
+func cursorScope(opts spellbook.ListOptions) (string, error) {
+	data, err := json.Marshal(struct {
+		Order      string
+		Descending bool
+		Filters    []spellbook.Filter
+	}{opts.Order, opts.Descending, opts.Filters})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func decodeCursor(encoded string) (cursor, error) {
+	c := cursor{}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return c, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// numbers are kept as strings, so that they are bound as they were read
+	decoder.UseNumber()
+	err = decoder.Decode(&c)
+	return c, err
+}
+
+// Applies the order and the page of the list options to the query.
+// The page starts after the cursor, if one is given, or at the page offset otherwise.
+// The primary key of item is always used as the last order criteria, so that the pages are stable.
+// The cursor must have been issued for the same order and filters.
+// One more result than the page size is requested, so that the caller knows if there are more results
+func Paginate(db *gorm.DB, item interface{}, opts spellbook.ListOptions, columns Columns) (*gorm.DB, error) {
+	pk := db.NewScope(item).PrimaryKey()
+	if pk == "" {
+		return nil, fmt.Errorf("can't paginate %T: no primary key found", item)
+	}
+
+	dir := "asc"
+	op := ">"
+	if opts.Descending {
+		dir = "desc"
+		op = "<"
+	}
+
+	order, err := OrderToClause(opts, columns)
+	if err != nil {
+		return nil, err
+	}
+	if order != "" {
+		db = db.Order(order)
+	}
+	db = db.Order(fmt.Sprintf("%q %s", pk, dir))
+
+	if opts.Cursor == "" {
+		db = db.Offset(opts.Page * opts.Size)
+		return db.Limit(opts.Size + 1), nil
+	}
+
+	c, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return nil, spellbook.NewFieldError(spellbook.FilterCursorKey, fmt.Errorf("invalid cursor %q: %s", opts.Cursor, err.Error()))
+	}
+
+	scope, err := cursorScope(opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.Scope != scope {
+		return nil, spellbook.NewFieldError(spellbook.FilterCursorKey, errors.New("the cursor was issued for another order or other filters"))
+	}
+
+	if order == "" {
+		db = db.Where(fmt.Sprintf("%q %s ?", pk, op), c.Key)
+		return db.Limit(opts.Size + 1), nil
+	}
+
+	// NULLs follow every value: see OrderToClause
+	column, _ := columns.Column(opts.Order)
+	switch {
+	case c.Value == nil && !opts.Descending:
+		db = db.Where(fmt.Sprintf("(%q IS NULL AND %q > ?)", column, pk), c.Key)
+	case c.Value == nil:
+		db = db.Where(fmt.Sprintf("(%q IS NOT NULL OR %q < ?)", column, pk), c.Key)
+	case !opts.Descending:
+		db = db.Where(fmt.Sprintf("(%q > ? OR %q IS NULL OR (%q = ? AND %q > ?))", column, column, column, pk), c.Value, c.Value, c.Key)
+	default:
+		db = db.Where(fmt.Sprintf("(%q < ? OR (%q = ? AND %q < ?))", column, column, pk), c.Value, c.Value, c.Key)
+	}
+
+	return db.Limit(opts.Size + 1), nil
+}
+
+// Returns the cursor that points to the results that follow the given item,
+// which is usually the last item of a page
+func NewCursor(db *gorm.DB, item interface{}, opts spellbook.ListOptions, columns Columns) (string, error) {
+	scope := db.NewScope(item)
+	c := cursor{Key: scope.PrimaryKeyValue()}
+
+	var err error
+	if c.Scope, err = cursorScope(opts); err != nil {
+		return "", err
+	}
+
+	if opts.Order != "" {
+		column, ok := columns.Column(opts.Order)
+		if !ok {
+			return "", spellbook.NewFieldError(spellbook.FilterOrderKey, fmt.Errorf("field %q can't be used to order", opts.Order))
+		}
+		field, ok := scope.FieldByName(column)
+		if !ok {
+			return "", fmt.Errorf("column %s not found for %T", column, item)
+		}
+		value := field.Field.Interface()
+		// nullable columns are stored with their driver value
+		if valuer, ok := value.(driver.Valuer); ok {
+			v, err := valuer.Value()
+			if err != nil {
+				return "", err
+			}
+			value = v
+		}
+		c.Value = value
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
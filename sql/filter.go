@@ -0,0 +1,129 @@
+package sql
+
+import (
+	"decodica.com/spellbook"
+	"fmt"
+	"strings"
+)
+
+// Columns is the allow-list of the fields that can be used to filter and order a resource.
+// Keys are the field names, as returned by ToColumnName, values are the corresponding database columns.
+// Fields that are not in the list are rejected with a FieldError
+type Columns map[string]string
+
+// returns the database column of the given field, if the field can be filtered
+func (columns Columns) Column(field string) (string, bool) {
+	if field == "" {
+		return "", false
+	}
+	column, ok := columns[ToColumnName(field)]
+	return column, ok
+}
+
+func OperatorToSymbol(op spellbook.FilterOperator) string {
+	switch op {
+	case spellbook.FilterOperatorLessThan:
+		return "<"
+	case spellbook.FilterOperatorGreaterThan:
+		return ">"
+	case spellbook.FilterOperatorLessOrEqualThan:
+		return "<="
+	case spellbook.FilterOperatorGreaterOrEqualThan:
+		return ">="
+	case spellbook.FilterOperatorExact:
+		return "="
+	case spellbook.FilterOperatorNotExact:
+		return "<>"
+	}
+	return "="
+}
+
+// escapes the LIKE wildcards of a value, so that it is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Compiles a filter into a parameterized condition.
+// The filter value is never written into the condition: it is returned as a bound argument
+func FilterToCondition(f spellbook.Filter, columns Columns) (string, []interface{}, error) {
+	column, ok := columns.Column(f.Field)
+	if !ok {
+		return "", nil, spellbook.NewFieldError(f.Field, fmt.Errorf("field %q can't be used as a filter", f.Field))
+	}
+
+	switch f.Operator {
+	case spellbook.FilterOperatorIn:
+		return fmt.Sprintf("%q IN (?)", column), []interface{}{f.Values()}, nil
+	case spellbook.FilterOperatorContains:
+		return fmt.Sprintf("%q LIKE ?", column), []interface{}{"%" + likeEscaper.Replace(f.Value) + "%"}, nil
+	case spellbook.FilterOperatorPrefix:
+		return fmt.Sprintf("%q LIKE ?", column), []interface{}{likeEscaper.Replace(f.Value) + "%"}, nil
+	case spellbook.FilterOperatorIsNull:
+		isNull, err := f.IsNull()
+		if err != nil {
+			return "", nil, spellbook.NewFieldError(f.Field, fmt.Errorf("invalid value %q for isnull: %s", f.Value, err.Error()))
+		}
+		if isNull {
+			return fmt.Sprintf("%q IS NULL", column), nil, nil
+		}
+		return fmt.Sprintf("%q IS NOT NULL", column), nil, nil
+	}
+
+	os := OperatorToSymbol(f.Operator)
+	return fmt.Sprintf("%q %s ?", column, os), []interface{}{f.Value}, nil
+}
+
+// Compiles the filters into a single parameterized condition.
+// Filters without a group are in AND, filters of the same group are in OR.
+// Returns an empty condition if no filter is given
+func FiltersToCondition(fs []spellbook.Filter, columns Columns) (string, []interface{}, error) {
+	if len(fs) == 0 {
+		return "", nil, nil
+	}
+
+	ungrouped, groups := spellbook.GroupFilters(fs)
+
+	var conditions []string
+	var args []interface{}
+	for _, f := range ungrouped {
+		condition, fargs, err := FilterToCondition(f, columns)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, fargs...)
+	}
+
+	for _, group := range groups {
+		gconditions := make([]string, len(group))
+		for i, f := range group {
+			condition, fargs, err := FilterToCondition(f, columns)
+			if err != nil {
+				return "", nil, err
+			}
+			gconditions[i] = condition
+			args = append(args, fargs...)
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s)", strings.Join(gconditions, " OR ")))
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// Returns the order clause for the given list options.
+// NULL values sort after every other value, so they come last in ascending order and first in descending order.
+// Returns an empty clause if no order is requested
+func OrderToClause(opts spellbook.ListOptions, columns Columns) (string, error) {
+	if opts.Order == "" {
+		return "", nil
+	}
+
+	column, ok := columns.Column(opts.Order)
+	if !ok {
+		return "", spellbook.NewFieldError(spellbook.FilterOrderKey, fmt.Errorf("field %q can't be used to order", opts.Order))
+	}
+
+	dir := "asc nulls last"
+	if opts.Descending {
+		dir = "desc nulls first"
+	}
+	return fmt.Sprintf("%q %s", column, dir), nil
+}
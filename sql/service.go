@@ -2,10 +2,7 @@ package sql
 
 import (
 	"context"
-	"decodica.com/spellbook"
-	"fmt"
 	"github.com/jinzhu/gorm"
-	"strings"
 )
 
 const name = "__sql_service"
@@ -67,51 +64,3 @@ func FromContext(ctx context.Context) *gorm.DB {
 func ToColumnName(name string) string {
 	return gorm.ToColumnName(name)
 }
-
-func OperatorToSymbol(op spellbook.FilterOperator) string {
-	switch op {
-	case spellbook.FilterOperatorLessThan:
-		return "<"
-	case spellbook.FilterOperatorGreaterThan:
-		return ">"
-	case spellbook.FilterOperatorLessOrEqualThan:
-		return "<="
-	case spellbook.FilterOperatorGreaterOrEqualThan:
-		return ">="
-	case spellbook.FilterOperatorExact:
-		return "="
-	case spellbook.FilterOperatorNotExact:
-		return "LIKE"
-	}
-	return "="
-}
-
-func FilterToCondition(f spellbook.Filter, filterCondition func(spellbook.Filter) string) string {
-	if filterCondition != nil {
-		return filterCondition(f)
-	}
-	os := OperatorToSymbol(f.Operator)
-	dbField := ToColumnName(f.Field)
-	return fmt.Sprintf("%q %s '%s'", dbField, os, f.Value)
-}
-
-func FiltersToCondition(fs []spellbook.Filter, conditionsForFilters map[string]func(spellbook.Filter) string) string {
-
-	if fs == nil || len(fs) == 0 {
-		return ""
-	}
-	where := strings.Builder{}
-	for i, f := range fs {
-		if i > 0 {
-			where.WriteString(" AND ")
-		}
-		var filterCondition func(spellbook.Filter) string
-		if conditionsForFilters != nil {
-			if fc, ok := conditionsForFilters[gorm.ToColumnName(f.Field)]; ok {
-				filterCondition = fc
-			}
-		}
-		where.WriteString(FilterToCondition(f, filterCondition))
-	}
-	return where.String()
-}
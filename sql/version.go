@@ -0,0 +1,38 @@
+package sql
+
+import (
+	"context"
+	"decodica.com/spellbook"
+	"github.com/jinzhu/gorm"
+)
+
+// Executes the write, provided that the stored row with the given primary key has the version expected by the request.
+// The row is read into stored and locked until the write is committed, so that concurrent writes can't interleave.
+// If the request doesn't expect any version, the write is executed as is
+func VersionedWrite(ctx context.Context, db *gorm.DB, stored spellbook.Versioned, id interface{}, write func(tx *gorm.DB) error) error {
+	if _, ok := spellbook.VersionFromContext(ctx); !ok {
+		return write(db)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(stored, id).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := spellbook.CheckVersion(ctx, stored); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := write(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
@@ -10,11 +10,11 @@ import (
 
 type Subscription struct {
 	model.Model  `json:"-"`
-	Email        string
-	Country      string
-	FirstName    string
-	LastName     string
-	Organization string
+	Email        string `validate:"required,email" field:"Email"`
+	Country      string `validate:"required" field:"Country"`
+	FirstName    string `validate:"required" field:"FirstName"`
+	LastName     string `validate:"required" field:"LastName"`
+	Organization string `validate:"required" field:"Organization"`
 	Position     string
 	Notes        string
 	Created      time.Time
@@ -108,6 +108,10 @@ func (subscription *Subscription) Id() string {
 	return subscription.StringID()
 }
 
+func (subscription *Subscription) Version() string {
+	return spellbook.TimeVersion(subscription.Updated)
+}
+
 func (subscription *Subscription) FromRepresentation(rtype spellbook.RepresentationType, data []byte) error {
 	switch rtype {
 	case spellbook.RepresentationTypeJSON:
@@ -9,7 +9,6 @@ import (
 	"google.golang.org/appengine/log"
 	"reflect"
 	"sort"
-	"strings"
 	"time"
 )
 
@@ -59,14 +58,18 @@ func (manager subscriptionManager) FromId(ctx context.Context, strId string) (sp
 }
 
 func (manager subscriptionManager) ListOf(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, error) {
+	resources, _, err := manager.ListOfCursor(ctx, opts)
+	return resources, err
+}
+
+func (manager subscriptionManager) ListOfCursor(ctx context.Context, opts spellbook.ListOptions) ([]spellbook.Resource, string, error) {
 	current := spellbook.IdentityFromContext(ctx)
 	if !current.HasPermission(spellbook.PermissionReadSubscription) {
-		return nil, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadSubscription))
+		return nil, "", spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadSubscription))
 	}
 
 	var subscriptions []*Subscription
 	q := model.NewQuery(&Subscription{})
-	q = q.OffsetBy(opts.Page * opts.Size)
 
 	if opts.Order != "" {
 		dir := model.ASC
@@ -76,17 +79,19 @@ func (manager subscriptionManager) ListOf(ctx context.Context, opts spellbook.Li
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// get one more so we know if we are done
-	q = q.Limit(opts.Size + 1)
-	err := q.GetMulti(ctx, &subscriptions)
+	q, err = spellbook.PaginateQuery(q, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	cursor, err := q.GetMultiWithCursor(ctx, &subscriptions)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resources := make([]spellbook.Resource, len(subscriptions))
@@ -94,7 +99,26 @@ func (manager subscriptionManager) ListOf(ctx context.Context, opts spellbook.Li
 		resources[i] = subscriptions[i]
 	}
 
-	return resources, nil
+	next, err := spellbook.NextQueryCursor(ctx, q, &subscriptions, cursor, len(resources), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return resources, next, nil
+}
+
+func (manager subscriptionManager) Count(ctx context.Context, opts spellbook.ListOptions) (int, error) {
+	current := spellbook.IdentityFromContext(ctx)
+	if !current.HasPermission(spellbook.PermissionReadSubscription) {
+		return 0, spellbook.NewPermissionError(spellbook.PermissionName(spellbook.PermissionReadSubscription))
+	}
+
+	q := model.NewQuery(&Subscription{})
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Count(ctx)
 }
 
 func (manager subscriptionManager) ListOfProperties(ctx context.Context, opts spellbook.ListOptions) ([]string, error) {
@@ -125,15 +149,14 @@ func (manager subscriptionManager) ListOfProperties(ctx context.Context, opts sp
 		q = q.OrderBy(opts.Order, dir)
 	}
 
-	for _, filter := range opts.Filters {
-		if filter.Field != "" {
-			q = q.WithField(filter.Field+" =", filter.Value)
-		}
+	q, err := spellbook.FiltersToQuery(q, opts.Filters)
+	if err != nil {
+		return nil, err
 	}
 
 	q = q.Distinct(name)
 	q = q.Limit(opts.Size + 1)
-	err := q.GetAll(ctx, &conts)
+	err = q.GetAll(ctx, &conts)
 	if err != nil {
 		log.Errorf(ctx, "Error retrieving result: %+v", err)
 		return nil, err
@@ -158,29 +181,8 @@ func (manager subscriptionManager) Create(ctx context.Context, res spellbook.Res
 	subscription := res.(*Subscription)
 	subscription.Created = time.Now().UTC()
 
-	if subscription.Email == "" {
-		msg := fmt.Sprintf("Email can't be empty")
-		return spellbook.NewFieldError("Email", errors.New(msg))
-	}
-	if !strings.Contains(subscription.Email, "@") || !strings.Contains(subscription.Email, ".") {
-		msg := fmt.Sprintf("Email not valid")
-		return spellbook.NewFieldError("Email", errors.New(msg))
-	}
-	if subscription.Country == "" {
-		msg := fmt.Sprintf("Country can't be empty")
-		return spellbook.NewFieldError("Country", errors.New(msg))
-	}
-	if subscription.FirstName == "" {
-		msg := fmt.Sprintf("FirstName can't be empty")
-		return spellbook.NewFieldError("FirstName", errors.New(msg))
-	}
-	if subscription.LastName == "" {
-		msg := fmt.Sprintf("LastName can't be empty")
-		return spellbook.NewFieldError("LastName", errors.New(msg))
-	}
-	if subscription.Organization == "" {
-		msg := fmt.Sprintf("Organization can't be empty")
-		return spellbook.NewFieldError("Organization", errors.New(msg))
+	if err := spellbook.ValidateStruct(subscription); err != nil {
+		return err
 	}
 
 	// list subscription
@@ -217,36 +219,17 @@ func (manager subscriptionManager) Update(ctx context.Context, res spellbook.Res
 		return spellbook.NewFieldError("", fmt.Errorf("invalid json %s: %s", string(bundle), err.Error()))
 	}
 
-	if other.Email == "" {
-		msg := fmt.Sprintf("Email can't be empty")
-		return spellbook.NewFieldError("Email", errors.New(msg))
-	}
-	if !strings.Contains(other.Email, "@") || !strings.Contains(other.Email, ".") {
-		msg := fmt.Sprintf("Email not valid")
-		return spellbook.NewFieldError("Email", errors.New(msg))
-	}
-	if other.Country == "" {
-		msg := fmt.Sprintf("Country can't be empty")
-		return spellbook.NewFieldError("Country", errors.New(msg))
-	}
-	if other.FirstName == "" {
-		msg := fmt.Sprintf("FirstName can't be empty")
-		return spellbook.NewFieldError("FirstName", errors.New(msg))
-	}
-	if other.LastName == "" {
-		msg := fmt.Sprintf("LastName can't be empty")
-		return spellbook.NewFieldError("LastName", errors.New(msg))
-	}
-	if other.Organization == "" {
-		msg := fmt.Sprintf("Organization can't be empty")
-		return spellbook.NewFieldError("Organization", errors.New(msg))
+	if err := spellbook.ValidateStruct(other); err != nil {
+		return err
 	}
+
+	// the position is required only when the subscription is updated
 	if other.Position == "" {
-		msg := fmt.Sprintf("Position can't be empty")
-		return spellbook.NewFieldError("Position", errors.New(msg))
+		return spellbook.NewFieldError("Position", errors.New("Position can't be empty"))
 	}
 
 	subscription := res.(*Subscription)
+
 	subscription.Email = other.Email
 	subscription.Country = other.Country
 	subscription.FirstName = other.FirstName
@@ -256,7 +239,13 @@ func (manager subscriptionManager) Update(ctx context.Context, res spellbook.Res
 	subscription.Notes = other.Notes
 	subscription.Updated = time.Now().UTC()
 
-	return model.Update(ctx, subscription)
+	return spellbook.VersionedWrite(ctx, subscription.EncodedKey(), func(ctx context.Context) (spellbook.Versioned, error) {
+		stored := Subscription{}
+		err := model.FromEncodedKey(ctx, &stored, subscription.EncodedKey())
+		return &stored, err
+	}, func(ctx context.Context) error {
+		return model.Update(ctx, subscription)
+	})
 }
 
 func (manager subscriptionManager) Delete(ctx context.Context, res spellbook.Resource) error {
@@ -0,0 +1,319 @@
+package spellbook
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	validateTag = "validate"
+	// overrides the name of the field in the validation errors
+	fieldTag = "field"
+)
+
+// ValidatorFactory returns the validator of a named rule of the validate tag.
+// param is the value that follows the "=" of the rule, if any: for "len=4:32" param is "4:32"
+type ValidatorFactory func(param string) (Validator, error)
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = map[string]ValidatorFactory{
+		"email": func(param string) (Validator, error) {
+			return EmailValidator{}, nil
+		},
+		"len": lenValidatorFactory,
+		"datastorekey": func(param string) (Validator, error) {
+			return DatastoreKeyNameValidator{}, nil
+		},
+		"filename": func(param string) (Validator, error) {
+			return FileNameValidator{}, nil
+		},
+		"phone": func(param string) (Validator, error) {
+			return PhoneNumberValidator{}, nil
+		},
+		"singleline": func(param string) (Validator, error) {
+			return SingleLineTextValidator{}, nil
+		},
+		"numeric": func(param string) (Validator, error) {
+			return NumericValidator{}, nil
+		},
+		// url=http|https|ftp
+		"url": func(param string) (Validator, error) {
+			return URLValidator{Schemes: splitParam(param)}, nil
+		},
+		"slug": func(param string) (Validator, error) {
+			return SlugValidator{}, nil
+		},
+		// the whole value must match the pattern. The rule must be the last of the tag:
+		// the pattern is the rest of the tag, commas included
+		"regex": func(param string) (Validator, error) {
+			re, err := regexp.Compile("^(?:" + param + ")$")
+			if err != nil {
+				return nil, err
+			}
+			return RegexValidator{Regexp: re}, nil
+		},
+		"intrange":   intRangeValidatorFactory,
+		"floatrange": floatRangeValidatorFactory,
+		// date=2006-01-02
+		"date": func(param string) (Validator, error) {
+			return DateValidator{Layout: param}, nil
+		},
+		// enum=draft|published
+		"enum": func(param string) (Validator, error) {
+			return EnumValidator{Values: splitParam(param)}, nil
+		},
+		"iban": func(param string) (Validator, error) {
+			return IBANValidator{}, nil
+		},
+		"vat": func(param string) (Validator, error) {
+			return VATValidator{}, nil
+		},
+		"unicodetext": func(param string) (Validator, error) {
+			return UnicodeTextValidator{}, nil
+		},
+		"iplist": func(param string) (Validator, error) {
+			return IPListValidator{}, nil
+		},
+	}
+)
+
+// splits a list param, such as a|b|c
+func splitParam(param string) []string {
+	if param == "" {
+		return nil
+	}
+	return strings.Split(param, "|")
+}
+
+// splits a min:max param. Missing bounds are returned as empty strings
+func splitBounds(param string) (string, string) {
+	bounds := strings.SplitN(param, ":", 2)
+	if len(bounds) == 1 {
+		return bounds[0], bounds[0]
+	}
+	return bounds[0], bounds[1]
+}
+
+// splits the rules of a validate tag. The regex rule ends the tag, so that its pattern can contain commas
+func splitRules(tag string) []string {
+	var rules []string
+	for tag != "" {
+		rule := strings.TrimLeftFunc(tag, unicode.IsSpace)
+		tag = ""
+		if !strings.HasPrefix(rule, "regex=") {
+			if idx := strings.Index(rule, ","); idx != -1 {
+				rule, tag = rule[:idx], rule[idx+1:]
+			}
+			rule = strings.TrimSpace(rule)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Registers a validator that can be used by name in the validate tag.
+// Registering an existing name replaces the validator
+func RegisterValidator(name string, factory ValidatorFactory) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators[name] = factory
+}
+
+// the param of len is min:max. Either bound can be omitted, a single number sets both
+func lenValidatorFactory(param string) (Validator, error) {
+	min, max := splitBounds(param)
+	v := LenValidator{}
+	var err error
+	if min != "" {
+		if v.MinLen, err = strconv.Atoi(min); err != nil {
+			return nil, fmt.Errorf("invalid len %q: %s", param, err.Error())
+		}
+	}
+	if max != "" {
+		if v.MaxLen, err = strconv.Atoi(max); err != nil {
+			return nil, fmt.Errorf("invalid len %q: %s", param, err.Error())
+		}
+	}
+	return v, nil
+}
+
+// the param of intrange is min:max. A missing bound leaves that side unbounded
+func intRangeValidatorFactory(param string) (Validator, error) {
+	min, max := splitBounds(param)
+	v := IntRangeValidator{Min: math.MinInt64, Max: math.MaxInt64}
+	var err error
+	if min != "" {
+		if v.Min, err = strconv.ParseInt(min, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid intrange %q: %s", param, err.Error())
+		}
+	}
+	if max != "" {
+		if v.Max, err = strconv.ParseInt(max, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid intrange %q: %s", param, err.Error())
+		}
+	}
+	return v, nil
+}
+
+// the param of floatrange is min:max. A missing bound leaves that side unbounded
+func floatRangeValidatorFactory(param string) (Validator, error) {
+	min, max := splitBounds(param)
+	v := FloatRangeValidator{Min: math.Inf(-1), Max: math.Inf(1)}
+	var err error
+	if min != "" {
+		if v.Min, err = strconv.ParseFloat(min, 64); err != nil {
+			return nil, fmt.Errorf("invalid floatrange %q: %s", param, err.Error())
+		}
+	}
+	if max != "" {
+		if v.Max, err = strconv.ParseFloat(max, 64); err != nil {
+			return nil, fmt.Errorf("invalid floatrange %q: %s", param, err.Error())
+		}
+	}
+	return v, nil
+}
+
+// Validates the exported fields of a struct according to their validate tag.
+// The tag is a comma separated list of rules, such as `validate:"required,email,len=4:32"`.
+// A regex rule must come last: its pattern takes the rest of the tag, such as `validate:"required,regex=[a-z]{2,8}"`.
+// "required" rejects zero values. Empty fields that are not required skip the other rules.
+// The other rules are the validators registered by name, see RegisterValidator.
+// Fields of embedded structs are validated as fields of the struct.
+// Returns an Errors with every failing field, named after their field tag, their json tag or, if both are missing, after the field name
+func ValidateStruct(v interface{}) error {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return fmt.Errorf("can't validate a nil %T", v)
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("can't validate %T: not a struct", v)
+	}
+
+	errs := Errors{}
+	if err := validateStruct(value, &errs); err != nil {
+		return err
+	}
+	if errs.HasErrors() {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(value reflect.Value, errs *Errors) error {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		fv := value.Field(i)
+
+		if sf.Anonymous && fv.Kind() == reflect.Struct {
+			if err := validateStruct(fv, errs); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, ok := sf.Tag.Lookup(validateTag)
+		if !ok || tag == "" || sf.PkgPath != "" {
+			continue
+		}
+
+		name := fieldName(sf)
+		if err := validateField(name, fv, tag, errs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateField(name string, value reflect.Value, tag string, errs *Errors) error {
+	required := false
+	var vs []Validator
+	for _, rule := range splitRules(tag) {
+		ruleName := rule
+		param := ""
+		if idx := strings.Index(rule, "="); idx != -1 {
+			ruleName = rule[:idx]
+			param = rule[idx+1:]
+		}
+
+		if ruleName == "required" {
+			required = true
+			continue
+		}
+
+		validatorsMu.RLock()
+		factory, ok := validators[ruleName]
+		validatorsMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown validator %q for field %s", ruleName, name)
+		}
+		validator, err := factory(param)
+		if err != nil {
+			return fmt.Errorf("invalid validator %q for field %s: %s", rule, name, err.Error())
+		}
+		vs = append(vs, validator)
+	}
+
+	str := ""
+	empty := value.IsZero()
+	if value.Kind() == reflect.String {
+		str = value.String()
+		empty = strings.TrimSpace(str) == ""
+	} else if !empty {
+		str = fmt.Sprint(value.Interface())
+	}
+
+	if empty {
+		if required {
+			errs.AddError(name, ErrMissingField)
+		}
+		return nil
+	}
+
+	field := NewRawField(name, required, str)
+	for _, validator := range vs {
+		field.AddValidator(validator)
+	}
+	if err := field.Validate(); err != nil {
+		errs.AddError(name, err)
+	}
+	return nil
+}
+
+// returns the name of the field as seen by the clients:
+// the name given by the field tag or the json name if the field has one,
+// the field name with a lower case initial otherwise
+func fieldName(sf reflect.StructField) string {
+	if name := sf.Tag.Get(fieldTag); name != "" {
+		return name
+	}
+	if tag, ok := sf.Tag.Lookup("json"); ok {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+
+	runes := []rune(sf.Name)
+	// lower the leading acronym, if any: URLPath becomes urlPath
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+	if upper > 1 && upper < len(runes) {
+		upper--
+	}
+	for i := 0; i < upper; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
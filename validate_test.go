@@ -0,0 +1,102 @@
+package spellbook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRules(t *testing.T) {
+	tests := []struct {
+		tag   string
+		rules []string
+	}{
+		{"required", []string{"required"}},
+		{"required, email ,len=4:32", []string{"required", "email", "len=4:32"}},
+		{"required,regex=[a-z]{2,8}", []string{"required", "regex=[a-z]{2,8}"}},
+		{"regex=a,b|c, d", []string{"regex=a,b|c, d"}},
+		{"len=1:10, regex= x", []string{"len=1:10", "regex= x"}},
+	}
+
+	for _, test := range tests {
+		if rules := splitRules(test.tag); !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("the rules of %q are %q, expected %q", test.tag, rules, test.rules)
+		}
+	}
+}
+
+func TestValidateStructRules(t *testing.T) {
+	type item struct {
+		Code   string  `json:"code" validate:"required,regex=[A-Z]{2,3}"`
+		Tags   string  `json:"tags" validate:"regex=[a-z]+(,[a-z]+)*"`
+		Count  int     `json:"count" validate:"intrange=1:"`
+		Ratio  float64 `json:"ratio" validate:"floatrange=:1"`
+		Status string  `json:"status" validate:"enum=draft|published"`
+		Site   string  `json:"site" validate:"url=https"`
+	}
+
+	tests := []struct {
+		item   item
+		fields []string
+	}{
+		{item{Code: "AB", Tags: "a,b,c", Count: 3, Ratio: 0.5, Status: "draft", Site: "https://example.com"}, nil},
+		{item{Code: "ABC"}, nil},
+		{item{}, []string{"code"}},
+		// the pattern must match the whole value
+		{item{Code: "xABx"}, []string{"code"}},
+		{item{Code: "ABCD"}, []string{"code"}},
+		{item{Code: "AB", Tags: "a,,b"}, []string{"tags"}},
+		{item{Code: "AB", Count: -1, Ratio: 2}, []string{"count", "ratio"}},
+		{item{Code: "AB", Status: "archived", Site: "http://example.com"}, []string{"status", "site"}},
+	}
+
+	for _, test := range tests {
+		err := ValidateStruct(&test.item)
+		if len(test.fields) == 0 {
+			if err != nil {
+				t.Errorf("%+v should be valid: %s", test.item, err.Error())
+			}
+			continue
+		}
+
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("%+v should fail with Errors, got %v", test.item, err)
+			continue
+		}
+		invalid := map[string]bool{}
+		for _, fe := range errs.FieldErrors() {
+			invalid[fe.field] = true
+		}
+		if len(invalid) != len(test.fields) {
+			t.Errorf("%+v: the invalid fields are %v, expected %v", test.item, invalid, test.fields)
+		}
+		for _, field := range test.fields {
+			if !invalid[field] {
+				t.Errorf("%+v: field %s should be invalid", test.item, field)
+			}
+		}
+	}
+}
+
+func TestValidateStructFieldNames(t *testing.T) {
+	type item struct {
+		Email    string `json:"mail" validate:"required" field:"Email"`
+		Country  string `json:"country" validate:"required"`
+		URLPath  string `validate:"required"`
+		Position string `validate:"required"`
+	}
+
+	errs, ok := ValidateStruct(&item{}).(Errors)
+	if !ok {
+		t.Fatal("an empty item should fail with Errors")
+	}
+	invalid := map[string]bool{}
+	for _, fe := range errs.FieldErrors() {
+		invalid[fe.field] = true
+	}
+	for _, field := range []string{"Email", "country", "urlPath", "position"} {
+		if !invalid[field] {
+			t.Errorf("field %s should be invalid, got %v", field, invalid)
+		}
+	}
+}
@@ -3,17 +3,24 @@ package spellbook
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"net/mail"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // checks if the given string is an email address
 type EmailValidator struct{}
 
 func (validator EmailValidator) Validate(value string) error {
-	_, err := mail.ParseAddress(value)
-	return err
+	if _, err := mail.ParseAddress(value); err != nil {
+		return NewValidationError("invalid email address %s", value)
+	}
+	return nil
 }
 
 // Validates the len of a string
@@ -36,7 +43,7 @@ func (v LenValidator) Validate(value string) error {
 	if v.MaxLen <= 0 {
 		validate = l >= v.MinLen
 		if !validate {
-			return fmt.Errorf("field must be at least %d characters", v.MinLen)
+			return NewValidationError("field must be at least %s characters", strconv.Itoa(v.MinLen))
 		} else {
 			return nil
 		}
@@ -45,7 +52,7 @@ func (v LenValidator) Validate(value string) error {
 	if v.MinLen <= 0 {
 		validate = l <= v.MaxLen
 		if !validate {
-			return fmt.Errorf("field can't be more than %d characters", v.MaxLen)
+			return NewValidationError("field can't be more than %s characters", strconv.Itoa(v.MaxLen))
 		} else {
 			return nil
 		}
@@ -53,7 +60,7 @@ func (v LenValidator) Validate(value string) error {
 
 	validate = l >= v.MinLen && l <= v.MaxLen
 	if !validate {
-		return fmt.Errorf("field length must be between %d and %d characters", v.MinLen, v.MaxLen)
+		return NewValidationError("field length must be between %s and %s characters", strconv.Itoa(v.MinLen), strconv.Itoa(v.MaxLen))
 	} else {
 		return nil
 	}
@@ -64,11 +71,11 @@ type DatastoreKeyNameValidator struct{}
 
 func (v DatastoreKeyNameValidator) Validate(value string) error {
 	if value == "" {
-		return errors.New("string is empty")
+		return NewValidationError("string is empty")
 	}
 
 	if len(value) > 2 && value[:2] == "__" {
-		return fmt.Errorf("%s can't start with '__'", value)
+		return NewValidationError("%s can't start with '__'", value)
 	}
 
 	return nil
@@ -81,29 +88,29 @@ type FileNameValidator struct {
 
 func (v FileNameValidator) Validate(value string) error {
 	if len(value) > 1024 {
-		return errors.New("file name can't be larger than 1024 bytes")
+		return NewValidationError("file name can't be larger than 1024 bytes")
 	}
 
 	if value == "." || value == "..." || value == ".." {
-		return fmt.Errorf("invalid file name: %s", value)
+		return NewValidationError("invalid file name: %s", value)
 	}
 
 	if strings.HasPrefix(value, ".well-known/acme-challenge") {
-		return errors.New("file name can't start with '.well-known/acme-challenge'")
+		return NewValidationError("file name can't start with '.well-known/acme-challenge'")
 	}
 
 	// todo: validate against unicode chars
 	if strings.Contains(value, "\n") || strings.Contains(value, "\r\n") {
-		return errors.New("file name can't contain new lines or line feeds")
+		return NewValidationError("file name can't contain new lines or line feeds")
 	}
 
 	if value == "" && !v.AllowEmpty {
-		return errors.New("string is empty")
+		return NewValidationError("string is empty")
 	}
 
 	for _, s := range value {
 		if s == '#' || s == '[' || s == ']' || s == '*' || s == '?' {
-			return fmt.Errorf("file name %q contains invalid character %q", value, s)
+			return NewValidationError("file name %s contains invalid character %s", strconv.Quote(value), strconv.QuoteRune(s))
 		}
 	}
 
@@ -149,7 +156,7 @@ func (validator SingleLineTextValidator) Validate(value string) error {
 		return fmt.Errorf("unable to check for non-valid characters: %s", err.Error())
 	}
 	if !ok {
-		return fmt.Errorf("text contains non-alphanumeric characters")
+		return NewValidationError("text contains non-alphanumeric characters")
 	}
 	return nil
 }
@@ -162,7 +169,268 @@ func (validator NumericValidator) Validate(value string) error {
 		return fmt.Errorf("unable to check for non-valid characters: %s", err.Error())
 	}
 	if !ok {
-		return fmt.Errorf("text contains non-alphanumeric characters")
+		return NewValidationError("text contains non-numeric characters")
+	}
+	return nil
+}
+
+// Checks if a string is an absolute url with one of the allowed schemes.
+// If no scheme is given, http and https are allowed
+type URLValidator struct {
+	Schemes []string
+}
+
+func (validator URLValidator) Validate(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+		return NewValidationError("invalid url %s", value)
+	}
+
+	schemes := validator.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return NewValidationError("url scheme %s is not allowed", u.Scheme)
+}
+
+var slugRegexp = regexp.MustCompile("^[a-z0-9]+(-[a-z0-9]+)*$")
+
+// Checks if a string is a slug: lower case letters and numbers, separated by single dashes
+type SlugValidator struct{}
+
+func (validator SlugValidator) Validate(value string) error {
+	if !slugRegexp.MatchString(value) {
+		return NewValidationError("invalid slug %s: only lower case letters, numbers and dashes are allowed", value)
+	}
+	return nil
+}
+
+// Checks if a string matches the regular expression.
+// Unanchored expressions accept any string that contains a match: the regex rule of the validate tag anchors its pattern
+type RegexValidator struct {
+	Regexp *regexp.Regexp
+}
+
+func (validator RegexValidator) Validate(value string) error {
+	if !validator.Regexp.MatchString(value) {
+		return NewValidationError("%s doesn't match the pattern %s", value, validator.Regexp.String())
 	}
 	return nil
 }
+
+// Checks if a string is an integer between Min and Max, both included.
+// Use math.MinInt64 or math.MaxInt64 to leave one side unbounded
+type IntRangeValidator struct {
+	Min int64
+	Max int64
+}
+
+func (validator IntRangeValidator) Validate(value string) error {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return NewValidationError("%s is not an integer", value)
+	}
+	min, max := strconv.FormatInt(validator.Min, 10), strconv.FormatInt(validator.Max, 10)
+	switch {
+	case n < validator.Min && validator.Max == math.MaxInt64:
+		return NewValidationError("value must be at least %s", min)
+	case n > validator.Max && validator.Min == math.MinInt64:
+		return NewValidationError("value must be at most %s", max)
+	case n < validator.Min || n > validator.Max:
+		return NewValidationError("value must be between %s and %s", min, max)
+	}
+	return nil
+}
+
+// Checks if a string is a number between Min and Max, both included.
+// Use math.Inf to leave one side unbounded
+type FloatRangeValidator struct {
+	Min float64
+	Max float64
+}
+
+func (validator FloatRangeValidator) Validate(value string) error {
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return NewValidationError("%s is not a number", value)
+	}
+	min, max := strconv.FormatFloat(validator.Min, 'g', -1, 64), strconv.FormatFloat(validator.Max, 'g', -1, 64)
+	switch {
+	case n < validator.Min && math.IsInf(validator.Max, 1):
+		return NewValidationError("value must be at least %s", min)
+	case n > validator.Max && math.IsInf(validator.Min, -1):
+		return NewValidationError("value must be at most %s", max)
+	case n < validator.Min || n > validator.Max:
+		return NewValidationError("value must be between %s and %s", min, max)
+	}
+	return nil
+}
+
+const DateLayout = "2006-01-02"
+
+// Checks if a string is a date in the given layout, DateLayout if none is given.
+// If Min or Max are not zero, the date must not be before Min or after Max
+type DateValidator struct {
+	Layout string
+	Min    time.Time
+	Max    time.Time
+}
+
+func (validator DateValidator) Validate(value string) error {
+	layout := validator.Layout
+	if layout == "" {
+		layout = DateLayout
+	}
+
+	date, err := time.Parse(layout, value)
+	if err != nil {
+		return NewValidationError("invalid date %s, expected format %s", value, layout)
+	}
+	if !validator.Min.IsZero() && date.Before(validator.Min) {
+		return NewValidationError("date must not be before %s", validator.Min.Format(layout))
+	}
+	if !validator.Max.IsZero() && date.After(validator.Max) {
+		return NewValidationError("date must not be after %s", validator.Max.Format(layout))
+	}
+	return nil
+}
+
+// Checks if a string is one of the accepted values
+type EnumValidator struct {
+	Values []string
+}
+
+func (validator EnumValidator) Validate(value string) error {
+	for _, v := range validator.Values {
+		if v == value {
+			return nil
+		}
+	}
+	return NewValidationError("%s is not one of %s", value, strings.Join(validator.Values, ", "))
+}
+
+// length of the IBAN of each country
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BR": 29,
+	"BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29,
+	"ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28,
+	"HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19,
+	"MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29,
+	"RO": 24, "RS": 22, "SA": 24, "SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+var ibanRegexp = regexp.MustCompile("^[A-Z]{2}[0-9]{2}[A-Z0-9]+$")
+
+// Checks if a string is an IBAN: the length must be the one of the country and the mod-97 checksum must be 1.
+// Spaces are ignored
+type IBANValidator struct{}
+
+func (validator IBANValidator) Validate(value string) error {
+	iban := strings.ToUpper(strings.Replace(value, " ", "", -1))
+	if !ibanRegexp.MatchString(iban) {
+		return NewValidationError("invalid iban %s", value)
+	}
+
+	if l, ok := ibanLengths[iban[:2]]; !ok || l != len(iban) {
+		return NewValidationError("invalid iban %s", value)
+	}
+
+	// move the country and the check digits at the end, then convert the letters to numbers: A = 10, B = 11...
+	rearranged := iban[4:] + iban[:4]
+	var digits strings.Builder
+	for _, r := range rearranged {
+		if r >= 'A' && r <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(r-'A') + 10))
+		} else {
+			digits.WriteRune(r)
+		}
+	}
+
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok || new(big.Int).Mod(n, big.NewInt(97)).Int64() != 1 {
+		return NewValidationError("invalid iban %s", value)
+	}
+	return nil
+}
+
+// format of the VAT numbers of each EU member state, without the country prefix
+var vatRegexps = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U\d{8}$`),
+	"BE": regexp.MustCompile(`^[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^\d{9,10}$`),
+	"CY": regexp.MustCompile(`^\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^\d{8,10}$`),
+	"DE": regexp.MustCompile(`^\d{9}$`),
+	"DK": regexp.MustCompile(`^\d{8}$`),
+	"EE": regexp.MustCompile(`^\d{9}$`),
+	"EL": regexp.MustCompile(`^\d{9}$`),
+	"ES": regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^\d{8}$`),
+	"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"HR": regexp.MustCompile(`^\d{11}$`),
+	"HU": regexp.MustCompile(`^\d{8}$`),
+	"IE": regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^\d{11}$`),
+	"LT": regexp.MustCompile(`^(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^\d{8}$`),
+	"LV": regexp.MustCompile(`^\d{11}$`),
+	"MT": regexp.MustCompile(`^\d{8}$`),
+	"NL": regexp.MustCompile(`^\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^\d{10}$`),
+	"PT": regexp.MustCompile(`^\d{9}$`),
+	"RO": regexp.MustCompile(`^\d{2,10}$`),
+	"SE": regexp.MustCompile(`^\d{10}01$`),
+	"SI": regexp.MustCompile(`^\d{8}$`),
+	"SK": regexp.MustCompile(`^\d{10}$`),
+	"XI": regexp.MustCompile(`^(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`),
+}
+
+// Checks if a string is an EU VAT number, prefixed by the country code.
+// Only the format of each country is checked, not the existence of the number.
+// Spaces, dots and dashes are ignored
+type VATValidator struct{}
+
+func (validator VATValidator) Validate(value string) error {
+	vat := strings.ToUpper(value)
+	vat = strings.NewReplacer(" ", "", ".", "", "-", "").Replace(vat)
+	if len(vat) < 4 {
+		return NewValidationError("invalid vat number %s", value)
+	}
+
+	re, ok := vatRegexps[vat[:2]]
+	if !ok {
+		return NewValidationError("invalid vat number %s: unknown country %s", value, vat[:2])
+	}
+	if !re.MatchString(vat[2:]) {
+		return NewValidationError("invalid vat number %s", value)
+	}
+	return nil
+}
+
+var unicodeTextRegexp = regexp.MustCompile(`^[\p{L}\p{M}\p{N}'’ .-]+$`)
+
+// Checks if a string contains only letters of any alphabet, including accented letters,
+// numbers, apostrophes, hyphens, periods and spaces. Tabs and new lines are not allowed
+type UnicodeTextValidator struct{}
+
+func (validator UnicodeTextValidator) Validate(value string) error {
+	if !unicodeTextRegexp.MatchString(value) {
+		return NewValidationError("text contains invalid characters")
+	}
+	return nil
+}
+
+// Checks if a string is a comma separated list of ip addresses and networks, see ParseIPList
+type IPListValidator struct{}
+
+func (validator IPListValidator) Validate(value string) error {
+	_, err := ParseIPList(value)
+	return err
+}
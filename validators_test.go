@@ -0,0 +1,229 @@
+package spellbook
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type validatorTest struct {
+	value string
+	valid bool
+}
+
+func runValidatorTests(t *testing.T, validator Validator, tests []validatorTest) {
+	t.Helper()
+	for _, test := range tests {
+		err := validator.Validate(test.value)
+		if test.valid && err != nil {
+			t.Errorf("%T: %q should be valid: %s", validator, test.value, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%T: %q should be invalid", validator, test.value)
+		}
+	}
+}
+
+func TestURLValidator(t *testing.T) {
+	runValidatorTests(t, URLValidator{}, []validatorTest{
+		{"https://example.com", true},
+		{"http://example.com/path?q=1", true},
+		{"HTTPS://example.com", true},
+		{"ftp://example.com", false},
+		{"example.com", false},
+		{"/relative/path", false},
+		{"https://", false},
+		{"", false},
+	})
+	runValidatorTests(t, URLValidator{Schemes: []string{"ftp"}}, []validatorTest{
+		{"ftp://example.com", true},
+		{"https://example.com", false},
+	})
+}
+
+func TestSlugValidator(t *testing.T) {
+	runValidatorTests(t, SlugValidator{}, []validatorTest{
+		{"hello", true},
+		{"hello-world-2", true},
+		{"2024", true},
+		{"Hello", false},
+		{"hello--world", false},
+		{"-hello", false},
+		{"hello-", false},
+		{"hello_world", false},
+		{"", false},
+	})
+}
+
+func TestRegexValidator(t *testing.T) {
+	runValidatorTests(t, RegexValidator{Regexp: regexp.MustCompile("^[a-z]{2,4}$")}, []validatorTest{
+		{"ab", true},
+		{"abcd", true},
+		{"a", false},
+		{"abcde", false},
+		{"AB", false},
+	})
+}
+
+func TestIntRangeValidator(t *testing.T) {
+	runValidatorTests(t, IntRangeValidator{Min: 1, Max: 10}, []validatorTest{
+		{"1", true},
+		{"10", true},
+		{" 5 ", true},
+		{"0", false},
+		{"11", false},
+		{"1.5", false},
+		{"ten", false},
+	})
+	runValidatorTests(t, IntRangeValidator{Min: math.MinInt64, Max: 0}, []validatorTest{
+		{"-9223372036854775808", true},
+		{"0", true},
+		{"1", false},
+	})
+}
+
+func TestFloatRangeValidator(t *testing.T) {
+	runValidatorTests(t, FloatRangeValidator{Min: -1.5, Max: 2.5}, []validatorTest{
+		{"-1.5", true},
+		{"2.5", true},
+		{"0", true},
+		{"1e0", true},
+		{"-1.51", false},
+		{"2.51", false},
+		{"abc", false},
+	})
+	runValidatorTests(t, FloatRangeValidator{Min: 0, Max: math.Inf(1)}, []validatorTest{
+		{"0", true},
+		{"1e300", true},
+		{"-0.1", false},
+	})
+}
+
+func TestRangeValidatorMessages(t *testing.T) {
+	tests := []struct {
+		validator Validator
+		value     string
+		message   string
+	}{
+		{IntRangeValidator{Min: 1, Max: 10}, "0", "between 1 and 10"},
+		{IntRangeValidator{Min: 1, Max: math.MaxInt64}, "0", "at least 1"},
+		{IntRangeValidator{Min: math.MinInt64, Max: 10}, "11", "at most 10"},
+		{FloatRangeValidator{Min: 0.5, Max: 1.5}, "2", "between 0.5 and 1.5"},
+		{FloatRangeValidator{Min: 0.5, Max: math.Inf(1)}, "0", "at least 0.5"},
+		{FloatRangeValidator{Min: math.Inf(-1), Max: 1.5}, "2", "at most 1.5"},
+	}
+
+	for _, test := range tests {
+		err := test.validator.Validate(test.value)
+		if err == nil {
+			t.Errorf("%T: %q should be invalid", test.validator, test.value)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%T: the error of %q is %q, expected %q", test.validator, test.value, err.Error(), test.message)
+		}
+	}
+}
+
+func TestDateValidator(t *testing.T) {
+	runValidatorTests(t, DateValidator{}, []validatorTest{
+		{"2024-02-29", true},
+		{"2023-02-29", false},
+		{"2024-13-01", false},
+		{"29/02/2024", false},
+		{"", false},
+	})
+	runValidatorTests(t, DateValidator{Layout: "02/01/2006"}, []validatorTest{
+		{"29/02/2024", true},
+		{"2024-02-29", false},
+	})
+
+	min := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	max := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	runValidatorTests(t, DateValidator{Min: min, Max: max}, []validatorTest{
+		{"2024-01-01", true},
+		{"2024-12-31", true},
+		{"2023-12-31", false},
+		{"2025-01-01", false},
+	})
+}
+
+func TestEnumValidator(t *testing.T) {
+	runValidatorTests(t, EnumValidator{Values: []string{"draft", "published"}}, []validatorTest{
+		{"draft", true},
+		{"published", true},
+		{"Draft", false},
+		{"archived", false},
+		{"", false},
+	})
+}
+
+func TestIBANValidator(t *testing.T) {
+	runValidatorTests(t, IBANValidator{}, []validatorTest{
+		{"GB82WEST12345698765432", true},
+		{"GB82 WEST 1234 5698 7654 32", true},
+		{"gb82west12345698765432", true},
+		{"DE89370400440532013000", true},
+		{"IT60X0542811101000000123456", true},
+		{"NO9386011117947", true},
+		// wrong check digits
+		{"GB83WEST12345698765432", false},
+		{"DE89370400440532013001", false},
+		// wrong length for the country
+		{"GB82WEST1234569876543", false},
+		{"IT60X054281110100000012345", false},
+		// unknown country
+		{"XX82WEST12345698765432", false},
+		{"GB82-WEST-1234", false},
+		{"", false},
+	})
+}
+
+func TestVATValidator(t *testing.T) {
+	runValidatorTests(t, VATValidator{}, []validatorTest{
+		{"ATU12345678", true},
+		{"BE0123456789", true},
+		{"DE123456789", true},
+		{"EL123456789", true},
+		{"ESX1234567X", true},
+		{"FRXX123456789", true},
+		{"IE1234567WA", true},
+		{"IT12345678901", true},
+		{"it 123.456.789-01", true},
+		{"NL123456789B01", true},
+		{"SE123456789001", true},
+		{"XIGD123", true},
+		{"AT12345678", false},
+		{"BE2123456789", false},
+		{"DE12345678", false},
+		{"FRIO123456789", false},
+		{"IT1234567890", false},
+		{"NL123456789A01", false},
+		{"SE123456789002", false},
+		{"GR123456789", false},
+		{"US123456789", false},
+		{"IT", false},
+	})
+}
+
+func TestUnicodeTextValidator(t *testing.T) {
+	runValidatorTests(t, UnicodeTextValidator{}, []validatorTest{
+		{"hello world", true},
+		{"perché l'altro", true},
+		{"Ærøskøbing 42", true},
+		{"Добрый день", true},
+		{"東京", true},
+		{"d’Artagnan", true},
+		{"é", true},
+		{"Jean-Luc", true},
+		{"J. R. Tolkien", true},
+		{"hello!", false},
+		{"hello\tworld", false},
+		{"hello\nworld", false},
+		{"<script>", false},
+		{"a_b", false},
+		{"", false},
+	})
+}